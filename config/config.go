@@ -3,15 +3,35 @@ package config
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"bloat/model"
+	"bloat/util"
 )
 
+// Listener is an address to serve on. Network is either "tcp" or "unix".
+// The listener uses TLS if CertFile and KeyFile are set, or with
+// certificates obtained from Let's Encrypt if Autocert is set. Mode is the
+// permissions of the socket of unix listeners, 0 if left to the umask.
+type Listener struct {
+	Network  string
+	Address  string
+	CertFile string
+	KeyFile  string
+	Autocert bool
+	Mode     os.FileMode
+}
+
 type config struct {
-	ListenAddress   string
+	Listeners       []Listener
 	ClientName      string
 	ClientScope     string
 	ClientWebsite   string
@@ -22,26 +42,919 @@ type config struct {
 	CustomCSS       string
 	PostFormats     []model.PostFormat
 	LogFile         string
+	LogLevel        util.Level
+	LogJSON         bool
+	AccessLogFile   string
+	AccessLogJSON   bool
+	LogMaxSize      int64
+	LogMaxAge       time.Duration
+	LogMaxFiles     int
+	OverrideDir     string
+	BackupDirectory string
+	BackupInterval  time.Duration
+	ShowWhatsNew    bool
+	RedisAddress    string
+	RedisPassword   string
+	SQLiteFile      string
+	PostgresURL     string
+	StoreDriver     string
+	StoreSource     string
+	MediaProxy      bool
+	MediaProxyHosts []string
+	MediaProxyMax   int64
+	AvatarCacheDir  string
+	EmojiCache      bool
+	ReloadTemplates bool
+	PublicThreads   bool
+
+	UpstreamDialTimeout     time.Duration
+	UpstreamTLSTimeout      time.Duration
+	UpstreamResponseTimeout time.Duration
+	UpstreamMaxIdleConns    int
+	UpstreamKeepAlives      bool
+
+	// ClientAppWebsite and UserAgent are empty if not set
+	ClientAppWebsite string
+	UserAgent        string
+
+	SessionLifetime time.Duration
+	SlidingSessions bool
+	SessionSecret   string
+	StorageSecret   string
+
+	ShutdownTimeout time.Duration
+
+	// The security headers are left to their defaults if empty, and not
+	// sent if "off"
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+
+	// CookieSecure defaults to whether ClientWebsite is https
+	CookieSecure    bool
+	cookieSecureSet bool
+	CookieSameSite  http.SameSite
+
+	// The limits of the requests that change something, per minute, 0 if
+	// they're disabled
+	WriteRateLimit   int
+	WriteRateLimitIP int
+	WriteRateBurst   int
+
+	// MaxUploadSize is 0 if only the limit of the instance applies
+	MaxUploadSize int64
+	// UploadDir defaults to a directory in the temporary directory
+	UploadDir string
+
+	InstanceCacheTTL   time.Duration
+	InstanceCacheStore bool
+
+	// MetricsListener and PprofListener serve the metrics and the
+	// profiles, nil if they're disabled
+	MetricsListener *Listener
+	PprofListener   *Listener
+
+	// AutocertHosts defaults to the host of ClientWebsite
+	AutocertHosts []string
+	AutocertDir   string
+	AutocertEmail string
+}
+
+var keys = []string{
+	"listen_address",
+	"client_name",
+	"client_scope",
+	"client_website",
+	"client_app_website",
+	"user_agent",
+	"single_instance",
+	"static_directory",
+	"templates_path",
+	"database_path",
+	"custom_css",
+	"post_formats",
+	"log_file",
+	"log_level",
+	"log_format",
+	"access_log",
+	"access_log_format",
+	"log_max_size",
+	"log_max_age",
+	"log_max_files",
+	"override_directory",
+	"backup_directory",
+	"backup_interval",
+	"show_whats_new",
+	"redis_address",
+	"redis_password",
+	"sqlite_file",
+	"postgres_url",
+	"store_driver",
+	"store_source",
+	"media_proxy",
+	"media_proxy_hosts",
+	"media_proxy_max_size",
+	"avatar_cache_directory",
+	"cache_emoji_images",
+	"reload_templates",
+	"public_threads",
+	"upstream_dial_timeout",
+	"upstream_tls_timeout",
+	"upstream_response_timeout",
+	"upstream_max_idle_conns",
+	"upstream_keep_alives",
+	"session_lifetime",
+	"sliding_sessions",
+	"session_secret",
+	"storage_secret",
+	"autocert_hosts",
+	"autocert_directory",
+	"autocert_email",
+	"shutdown_timeout",
+	"metrics_address",
+	"pprof_address",
+	"content_security_policy",
+	"frame_options",
+	"referrer_policy",
+	"cookie_secure",
+	"cookie_samesite",
+	"write_rate_limit",
+	"write_rate_limit_ip",
+	"write_rate_burst",
+	"max_upload_size",
+	"upload_directory",
+	"instance_cache_ttl",
+	"instance_cache_store",
+}
+
+// Error describes a single problem found in the config. Line is 0 for
+// problems that don't belong to a particular line, e.g. a missing key.
+type Error struct {
+	File string
+	Line int
+	Text string
+	Msg  string
+	Hint string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if len(e.File) > 0 {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	b.WriteString(e.Msg)
+	if len(e.Text) > 0 {
+		b.WriteString("\n\t")
+		b.WriteString(e.Text)
+	}
+	if len(e.Hint) > 0 {
+		b.WriteString("\n\thint: ")
+		b.WriteString(e.Hint)
+	}
+	return b.String()
+}
+
+// Errors is the list of all problems found while parsing the config.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	var s []string
+	for _, e := range es {
+		s = append(s, e.Error())
+	}
+	return strings.Join(s, "\n")
 }
 
-func (c *config) IsValid() bool {
-	if len(c.ListenAddress) < 1 ||
-		len(c.ClientName) < 1 ||
-		len(c.ClientScope) < 1 ||
-		len(c.ClientWebsite) < 1 ||
-		len(c.StaticDirectory) < 1 ||
-		len(c.TemplatesPath) < 1 ||
-		len(c.DatabasePath) < 1 {
-		return false
+func (c *config) validate() (errs Errors) {
+	required := []struct {
+		key string
+		val string
+		eg  string
+	}{
+		{"client_name", c.ClientName, "bloat"},
+		{"client_scope", c.ClientScope, "read write follow"},
+		{"client_website", c.ClientWebsite, "http://127.0.0.1:8080"},
+		{"database_path", c.DatabasePath, "database"},
+	}
+	if len(c.Listeners) < 1 {
+		errs = append(errs, &Error{
+			Msg:  "missing value for listen_address",
+			Hint: "add a line like \"listen_address=127.0.0.1:8080\"",
+		})
+	}
+	for _, r := range required {
+		// The database isn't stored in database_path when another
+		// store is used
+		if r.key == "database_path" && c.stores() > 0 {
+			continue
+		}
+		if len(r.val) < 1 {
+			errs = append(errs, &Error{
+				Msg:  "missing value for " + r.key,
+				Hint: "add a line like \"" + r.key + "=" + r.eg + "\"",
+			})
+		}
+	}
+	if len(c.BackupDirectory) > 0 && c.BackupInterval <= 0 {
+		errs = append(errs, &Error{
+			Msg:  "missing value for backup_interval",
+			Hint: "add a line like \"backup_interval=24h\" or remove backup_directory",
+		})
+	}
+	if c.stores() > 1 {
+		errs = append(errs, &Error{
+			Msg:  "only one of redis_address, sqlite_file, postgres_url and store_driver can be set",
+			Hint: "remove all but one of them",
+		})
+	}
+	if c.PublicThreads && len(c.SingleInstance) < 1 {
+		errs = append(errs, &Error{
+			Msg:  "public_threads needs single_instance",
+			Hint: "set single_instance or remove public_threads",
+		})
+	}
+	if len(c.ClientWebsite) > 0 && !isURL(c.ClientWebsite) {
+		errs = append(errs, &Error{
+			Msg:  "invalid value for client_website",
+			Hint: "use a full URL starting with \"http://\" or \"https://\"",
+		})
+	}
+	for _, l := range c.Listeners {
+		if l.Autocert && len(c.AutocertDir) < 1 {
+			errs = append(errs, &Error{
+				Msg:  "missing value for autocert_directory",
+				Hint: "add a line like \"autocert_directory=autocert\"",
+			})
+			break
+		}
+	}
+	if c.CookieSameSite == http.SameSiteNoneMode && !c.CookieSecure {
+		errs = append(errs, &Error{
+			Msg:  "cookie_samesite=none needs secure cookies",
+			Hint: "set cookie_secure=true or use another cookie_samesite",
+		})
+	}
+	if len(c.ClientAppWebsite) > 0 && !isURL(c.ClientAppWebsite) {
+		errs = append(errs, &Error{
+			Msg:  "invalid value for client_app_website",
+			Hint: "use a full URL starting with \"http://\" or \"https://\"",
+		})
 	}
-	return true
+	return
 }
 
+// stores returns the number of stores set besides database_path.
+func (c *config) stores() (n int) {
+	for _, v := range []string{c.RedisAddress, c.SQLiteFile, c.PostgresURL,
+		c.StoreDriver} {
+		if len(v) > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// Store returns the driver and the source of the storage backend, as
+// expected by util.OpenBackend.
+func (c *config) Store() (driver string, source string) {
+	switch {
+	case len(c.StoreDriver) > 0:
+		return c.StoreDriver, c.StoreSource
+	case len(c.RedisAddress) > 0:
+		source = c.RedisAddress
+		if len(c.RedisPassword) > 0 {
+			source += " password=" + c.RedisPassword
+		}
+		return "redis", source
+	case len(c.SQLiteFile) > 0:
+		return "sqlite", c.SQLiteFile
+	case len(c.PostgresURL) > 0:
+		return "postgres", c.PostgresURL
+	}
+	return "file", c.DatabasePath
+}
+
+// BasePath returns the path bloat is served under, taken from the path of
+// client_website without the trailing '/', e.g. "/bloat" for
+// "https://example.com/bloat/". It's empty if bloat is served at the root.
+func (c *config) BasePath() string {
+	u, err := url.Parse(c.ClientWebsite)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") ||
+		strings.HasPrefix(s, "https://")
+}
+
+// suggest returns the known key closest to k, or an empty string if none
+// of them is close enough to be a likely typo.
+func suggest(k string) (s string) {
+	min := len(k)/2 + 1
+	for _, key := range keys {
+		d := distance(k, key)
+		if d < min {
+			min, s = d, key
+		}
+	}
+	return
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// parseListener parses a listen_address value of the form
+// "ADDRESS [cert=FILE key=FILE | autocert] [mode=MODE]". It returns a non
+// empty message describing the problem if the value is invalid.
+func parseListener(val string) (l Listener, msg string) {
+	fields := strings.Fields(val)
+	if len(fields) < 1 {
+		return l, "empty address"
+	}
+	if strings.HasPrefix(fields[0], "unix:") {
+		l.Network = "unix"
+		l.Address = strings.TrimPrefix(fields[0], "unix:")
+		if len(l.Address) < 1 {
+			return l, "empty socket path"
+		}
+	} else {
+		l.Network = "tcp"
+		l.Address = fields[0]
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return l, err.Error()
+		}
+	}
+	for _, f := range fields[1:] {
+		if f == "autocert" {
+			l.Autocert = true
+			continue
+		}
+		index := strings.IndexRune(f, '=')
+		if index < 1 {
+			return l, "invalid option " + f
+		}
+		switch f[:index] {
+		case "cert":
+			l.CertFile = f[index+1:]
+		case "key":
+			l.KeyFile = f[index+1:]
+		case "mode":
+			if l.Network != "unix" {
+				return l, "mode is only for unix sockets"
+			}
+			mode, err := strconv.ParseUint(f[index+1:], 8, 32)
+			if err != nil || mode == 0 || mode > 0777 {
+				return l, "invalid mode " + f[index+1:]
+			}
+			l.Mode = os.FileMode(mode)
+		default:
+			return l, "unknown option " + f[:index]
+		}
+	}
+	if (len(l.CertFile) > 0) != (len(l.KeyFile) > 0) {
+		return l, "both cert and key are needed for TLS"
+	}
+	if l.Autocert && len(l.CertFile) > 0 {
+		return l, "autocert can't be used with cert and key"
+	}
+	return
+}
+
+// parseExtraListener parses the address of a listener besides the ones of
+// listen_address, which can't use autocert.
+func parseExtraListener(key string, val string) (*Listener, *Error) {
+	l, msg := parseListener(val)
+	if len(msg) > 0 {
+		return nil, &Error{
+			Msg: "invalid value for " + key + ": " + msg,
+			Hint: "use \"ADDRESS [cert=FILE key=FILE] [mode=MODE]\", " +
+				"where ADDRESS is \"HOST:PORT\" or \"unix:PATH\"",
+		}
+	}
+	if l.Autocert {
+		return nil, &Error{
+			Msg:  "invalid value for " + key + ": autocert is only for listen_address",
+			Hint: "use cert and key instead",
+		}
+	}
+	return &l, nil
+}
+
+func parsePostFormats(val string) (formats []model.PostFormat, ok bool) {
+	vals := strings.Split(val, ",")
+	for _, v := range vals {
+		pair := strings.Split(v, ":")
+		if len(pair) != 2 {
+			return nil, false
+		}
+		n := strings.TrimSpace(pair[0])
+		t := strings.TrimSpace(pair[1])
+		if len(n) < 1 || len(t) < 1 {
+			return nil, false
+		}
+		formats = append(formats, model.PostFormat{
+			Name: n,
+			Type: t,
+		})
+	}
+	return formats, true
+}
+
+// envPrefix is the prefix of the environment variables that set the config
+// keys, e.g. BLOAT_CLIENT_NAME sets client_name.
+const envPrefix = "BLOAT_"
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// hasEnv reports whether any config key is set in the environment.
+func hasEnv() bool {
+	for _, key := range keys {
+		if _, ok := os.LookupEnv(envName(key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setEnv sets the keys that are set in the environment, overriding the
+// values of the file. Several addresses can be given to listen_address,
+// separated by ',', and they replace the ones of the file. Variables with
+// the prefix that don't match a key are reported like unknown keys.
+func (c *config) setEnv() (errs Errors) {
+	for _, key := range keys {
+		name := envName(key)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		vals := []string{val}
+		if key == "listen_address" {
+			c.Listeners = nil
+			vals = strings.Split(val, ",")
+		}
+		for _, v := range vals {
+			if e := c.set(key, strings.TrimSpace(v)); e != nil {
+				e.Text = name + "=" + val
+				errs = append(errs, e)
+			}
+		}
+	}
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, envPrefix))
+		if isKey(key) {
+			continue
+		}
+		e := &Error{
+			Text: kv,
+			Msg:  "unknown config variable " + name,
+		}
+		if s := suggest(key); len(s) > 0 {
+			e.Hint = "did you mean \"" + envName(s) + "\"?"
+		}
+		errs = append(errs, e)
+	}
+	return
+}
+
+func isKey(k string) bool {
+	for _, key := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// set sets the value of the config key, or returns the problem with it.
+func (c *config) set(key string, val string) *Error {
+	switch key {
+	case "listen_address":
+		l, msg := parseListener(val)
+		if len(msg) > 0 {
+			return &Error{
+				Msg: "invalid value for " + key + ": " + msg,
+				Hint: "use \"ADDRESS [cert=FILE key=FILE | autocert] [mode=MODE]\", " +
+					"where ADDRESS is \"HOST:PORT\" or \"unix:PATH\", " +
+					"and MODE is octal, e.g. \"0660\"",
+			}
+		}
+		c.Listeners = append(c.Listeners, l)
+	case "client_name":
+		c.ClientName = val
+	case "client_scope":
+		c.ClientScope = val
+	case "client_website":
+		c.ClientWebsite = val
+	case "client_app_website":
+		c.ClientAppWebsite = val
+	case "user_agent":
+		c.UserAgent = val
+	case "single_instance":
+		c.SingleInstance = val
+	case "static_directory":
+		c.StaticDirectory = val
+	case "templates_path":
+		c.TemplatesPath = val
+	case "database_path":
+		c.DatabasePath = val
+	case "custom_css":
+		c.CustomCSS = val
+	case "post_formats":
+		formats, ok := parsePostFormats(val)
+		if !ok {
+			return &Error{
+				Msg: "invalid value for " + key,
+				Hint: "use a list of Name:mime/type pairs separated by ',', " +
+					"e.g. \"PlainText:text/plain,HTML:text/html\"",
+			}
+		}
+		c.PostFormats = formats
+	case "show_whats_new":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.ShowWhatsNew = val == "true"
+	case "log_file":
+		c.LogFile = val
+	case "log_level":
+		l, ok := util.ParseLevel(val)
+		if !ok {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use one of \"debug\", \"info\", \"warn\" and \"error\"",
+			}
+		}
+		c.LogLevel = l
+	case "log_format":
+		if val != "text" && val != "json" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"text\" or \"json\"",
+			}
+		}
+		c.LogJSON = val == "json"
+	case "access_log":
+		c.AccessLogFile = val
+	case "access_log_format":
+		if val != "combined" && val != "json" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"combined\" or \"json\"",
+			}
+		}
+		c.AccessLogJSON = val == "json"
+	case "log_max_size":
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a size in bytes, e.g. \"104857600\" for 100MB, or 0 for no limit",
+			}
+		}
+		c.LogMaxSize = size
+	case "log_max_age":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a duration, e.g. \"24h\", or 0 for no limit",
+			}
+		}
+		c.LogMaxAge = d
+	case "log_max_files":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a number, e.g. \"7\", or 0 to keep all the files",
+			}
+		}
+		c.LogMaxFiles = n
+	case "override_directory":
+		c.OverrideDir = val
+	case "media_proxy":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.MediaProxy = val == "true"
+	case "media_proxy_hosts":
+		c.MediaProxyHosts = nil
+		for _, h := range strings.Split(val, ",") {
+			h = strings.TrimSpace(h)
+			if len(h) > 0 {
+				c.MediaProxyHosts = append(c.MediaProxyHosts, h)
+			}
+		}
+	case "media_proxy_max_size":
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a size in bytes, e.g. \"52428800\" for 50MB, or 0 for no limit",
+			}
+		}
+		c.MediaProxyMax = size
+	case "max_upload_size":
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a size in bytes, e.g. \"104857600\" for 100MB, or 0 for no limit",
+			}
+		}
+		c.MaxUploadSize = size
+	case "upload_directory":
+		c.UploadDir = val
+	case "instance_cache_ttl":
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a duration, e.g. \"1h\"",
+			}
+		}
+		c.InstanceCacheTTL = d
+	case "instance_cache_store":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.InstanceCacheStore = val == "true"
+	case "cache_emoji_images":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.EmojiCache = val == "true"
+	case "reload_templates":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.ReloadTemplates = val == "true"
+	case "public_threads":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.PublicThreads = val == "true"
+	case "upstream_dial_timeout", "upstream_tls_timeout",
+		"upstream_response_timeout":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a duration, e.g. \"10s\", or 0 for the Go default",
+			}
+		}
+		switch key {
+		case "upstream_dial_timeout":
+			c.UpstreamDialTimeout = d
+		case "upstream_tls_timeout":
+			c.UpstreamTLSTimeout = d
+		case "upstream_response_timeout":
+			c.UpstreamResponseTimeout = d
+		}
+	case "upstream_max_idle_conns":
+		max, err := strconv.Atoi(val)
+		if err != nil || max < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a number of connections, e.g. \"16\"",
+			}
+		}
+		c.UpstreamMaxIdleConns = max
+	case "upstream_keep_alives":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.UpstreamKeepAlives = val == "true"
+	case "shutdown_timeout":
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a duration, e.g. \"10s\", or 0 to close the connections right away",
+			}
+		}
+		c.ShutdownTimeout = d
+	case "metrics_address":
+		l, e := parseExtraListener(key, val)
+		if e != nil {
+			return e
+		}
+		c.MetricsListener = l
+	case "pprof_address":
+		l, e := parseExtraListener(key, val)
+		if e != nil {
+			return e
+		}
+		c.PprofListener = l
+	case "content_security_policy":
+		c.ContentSecurityPolicy = val
+	case "frame_options":
+		c.FrameOptions = val
+	case "referrer_policy":
+		c.ReferrerPolicy = val
+	case "cookie_secure":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.CookieSecure = val == "true"
+		c.cookieSecureSet = true
+	case "cookie_samesite":
+		switch val {
+		case "lax":
+			c.CookieSameSite = http.SameSiteLaxMode
+		case "strict":
+			c.CookieSameSite = http.SameSiteStrictMode
+		case "none":
+			c.CookieSameSite = http.SameSiteNoneMode
+		default:
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use one of \"lax\", \"strict\" and \"none\"",
+			}
+		}
+	case "write_rate_limit", "write_rate_limit_ip", "write_rate_burst":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a number, e.g. \"30\", or 0 to disable the limit",
+			}
+		}
+		switch key {
+		case "write_rate_limit":
+			c.WriteRateLimit = n
+		case "write_rate_limit_ip":
+			c.WriteRateLimitIP = n
+		default:
+			c.WriteRateBurst = n
+		}
+	case "session_lifetime":
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a duration, e.g. \"8760h\" for a year",
+			}
+		}
+		c.SessionLifetime = d
+	case "session_secret", "storage_secret":
+		if len(val) < 32 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a random string of at least 32 characters",
+			}
+		}
+		if key == "session_secret" {
+			c.SessionSecret = val
+		} else {
+			c.StorageSecret = val
+		}
+	case "sliding_sessions":
+		if val != "true" && val != "false" {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use either \"true\" or \"false\"",
+			}
+		}
+		c.SlidingSessions = val == "true"
+	case "autocert_hosts":
+		c.AutocertHosts = nil
+		for _, h := range strings.Split(val, ",") {
+			h = strings.TrimSpace(h)
+			if len(h) > 0 {
+				c.AutocertHosts = append(c.AutocertHosts, h)
+			}
+		}
+	case "autocert_directory":
+		c.AutocertDir = val
+	case "autocert_email":
+		c.AutocertEmail = val
+	case "avatar_cache_directory":
+		c.AvatarCacheDir = val
+	case "redis_address":
+		c.RedisAddress = val
+	case "redis_password":
+		c.RedisPassword = val
+	case "sqlite_file":
+		c.SQLiteFile = val
+	case "postgres_url":
+		c.PostgresURL = val
+	case "store_driver":
+		c.StoreDriver = val
+	case "store_source":
+		c.StoreSource = val
+	case "backup_directory":
+		c.BackupDirectory = val
+	case "backup_interval":
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return &Error{
+				Msg:  "invalid value for " + key,
+				Hint: "use a positive duration, e.g. \"24h\" or \"30m\"",
+			}
+		}
+		c.BackupInterval = d
+	default:
+		e := &Error{
+			Msg: "unknown config key " + key,
+		}
+		if s := suggest(key); len(s) > 0 {
+			e.Hint = "did you mean \"" + s + "\"?"
+		}
+		return e
+	}
+	return nil
+}
+
+// Parse reads the config from r, with the keys set in the environment taking
+// precedence. Instead of stopping at the first problem, it keeps going and
+// returns all of them at once as Errors.
 func Parse(r io.Reader) (c *config, err error) {
+	var errs Errors
 	c = new(config)
+	c.MediaProxyMax = 50 << 20
+	c.UpstreamDialTimeout = 10 * time.Second
+	c.UpstreamTLSTimeout = 10 * time.Second
+	c.UpstreamResponseTimeout = 30 * time.Second
+	c.UpstreamMaxIdleConns = 16
+	c.UpstreamKeepAlives = true
+	c.SessionLifetime = 365 * 24 * time.Hour
+	c.ShutdownTimeout = 10 * time.Second
+	c.LogLevel = util.LevelInfo
+	c.CookieSameSite = http.SameSiteLaxMode
+	c.WriteRateLimit = 30
+	c.WriteRateLimitIP = 120
+	c.WriteRateBurst = 10
+	c.MaxUploadSize = 100 << 20
+	c.InstanceCacheTTL = time.Hour
 	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		line := strings.TrimSpace(text)
 
 		if len(line) < 1 {
 			continue
@@ -54,62 +967,52 @@ func Parse(r io.Reader) (c *config, err error) {
 
 		index = strings.IndexRune(line, '=')
 		if index < 1 {
-			return nil, errors.New("invalid config key")
+			errs = append(errs, &Error{
+				Line: n,
+				Text: text,
+				Msg:  "invalid line",
+				Hint: "use the \"key=value\" form",
+			})
+			continue
 		}
 
 		key := strings.TrimSpace(line[:index])
 		val := strings.TrimSpace(line[index+1 : len(line)])
 
-		switch key {
-		case "listen_address":
-			c.ListenAddress = val
-		case "client_name":
-			c.ClientName = val
-		case "client_scope":
-			c.ClientScope = val
-		case "client_website":
-			c.ClientWebsite = val
-		case "single_instance":
-			c.SingleInstance = val
-		case "static_directory":
-			c.StaticDirectory = val
-		case "templates_path":
-			c.TemplatesPath = val
-		case "database_path":
-			c.DatabasePath = val
-		case "custom_css":
-			c.CustomCSS = val
-		case "post_formats":
-			vals := strings.Split(val, ",")
-			var formats []model.PostFormat
-			for _, v := range vals {
-				pair := strings.Split(v, ":")
-				if len(pair) != 2 {
-					return nil, errors.New("invalid config key " + key)
-				}
-				n := strings.TrimSpace(pair[0])
-				t := strings.TrimSpace(pair[1])
-				if len(n) < 1 || len(t) < 1 {
-					return nil, errors.New("invalid config key " + key)
-				}
-				formats = append(formats, model.PostFormat{
-					Name: n,
-					Type: t,
-				})
-			}
-			c.PostFormats = formats
-		case "log_file":
-			c.LogFile = val
-		default:
-			return nil, errors.New("invalid config key " + key)
+		if e := c.set(key, val); e != nil {
+			e.Line = n
+			e.Text = text
+			errs = append(errs, e)
 		}
 	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
 
+	errs = append(errs, c.setEnv()...)
+	if !c.cookieSecureSet {
+		c.CookieSecure = strings.HasPrefix(c.ClientWebsite, "https://")
+	}
+	if len(c.AutocertHosts) < 1 {
+		u, err := url.Parse(c.ClientWebsite)
+		if err == nil && len(u.Hostname()) > 0 {
+			c.AutocertHosts = []string{u.Hostname()}
+		}
+	}
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	return
 }
 
+// ParseFile reads the config from file and the environment. The file may be
+// missing if the config is set in the environment instead.
 func ParseFile(file string) (c *config, err error) {
 	f, err := os.Open(file)
+	if os.IsNotExist(err) && hasEnv() {
+		return Parse(strings.NewReader(""))
+	}
 	if err != nil {
 		return
 	}
@@ -124,5 +1027,14 @@ func ParseFile(file string) (c *config, err error) {
 		return nil, errors.New("invalid config file")
 	}
 
-	return Parse(f)
+	c, err = Parse(f)
+	if errs, ok := err.(Errors); ok {
+		for _, e := range errs {
+			// Problems of the environment have a text but no line
+			if e.Line > 0 || len(e.Text) < 1 {
+				e.File = file
+			}
+		}
+	}
+	return
 }
@@ -2,7 +2,11 @@ module bloat
 
 require (
 	github.com/gorilla/mux v1.7.3
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sync v0.4.0
 )
 
-go 1.13
+go 1.16
@@ -1,34 +1,339 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"embed"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	// Time zones of the users' settings don't depend on the system
+	_ "time/tzdata"
 
 	"bloat/config"
+	"bloat/mastodon"
+	"bloat/model"
 	"bloat/renderer"
 	"bloat/repo"
 	"bloat/service"
 	"bloat/util"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	configFile = "/etc/bloat.conf"
+	// version is set at build time with -ldflags "-X main.version=..."
+	version     = "dev"
+	configFile  = "/etc/bloat.conf"
+	checkConfig = false
 )
 
+//go:embed templates static
+var embedded embed.FS
+
+// defaultConfig is the documented config, printed by gen-config
+//
+//go:embed bloat.conf
+var defaultConfig []byte
+
+const usage = "usage: bloat [-f config] [serve | check-config | gen-config | backup dest]"
+
 func errExit(err error) {
 	fmt.Fprintln(os.Stderr, err.Error())
 	os.Exit(1)
 }
 
+// dataFS returns the directory dir, or the embedded directory name if dir is
+// empty.
+func dataFS(dir string, name string) (fs.FS, error) {
+	if len(dir) > 0 {
+		return os.DirFS(dir), nil
+	}
+	return fs.Sub(embedded, name)
+}
+
+// backupLoop backs up dbs to dir every interval, and counts the results in
+// metrics. Failed backups are only told to the administrator.
+func backupLoop(dir string, interval time.Duration, metrics *util.Metrics,
+	logger *util.Logger, dbs ...util.Store) {
+
+	metrics.Counter("bloat_backups_total", "Periodic backups by result.",
+		"result")
+	for range time.Tick(interval) {
+		name := "bloat-" + time.Now().Format("20060102-150405") + ".tar.gz"
+		err := util.BackupFile(filepath.Join(dir, name), dbs...)
+		if err != nil {
+			logger.Error("backup failed", "err", err)
+			metrics.Add("bloat_backups_total", 1, "failure")
+			continue
+		}
+		metrics.Add("bloat_backups_total", 1, "success")
+	}
+}
+
+// cleanSessions removes the expired sessions, the sessions that weren't
+// signed in to within a day, and the feeds and the apps that no session uses
+// anymore. Apps are kept with cleanApps unset, as the sessions aren't stored
+// when they're kept in cookies. The apps and the feeds are listed before the
+// sessions, so that the ones added meanwhile aren't taken for unused.
+func cleanSessions(sessionRepo model.SessionRepo, appRepo model.AppRepo,
+	feedRepo model.FeedRepo, cleanApps bool) (err error) {
+
+	instances, err := appRepo.List()
+	if err != nil {
+		return
+	}
+	feeds, err := feedRepo.List()
+	if err != nil {
+		return
+	}
+	sessions, err := sessionRepo.List()
+	if err != nil {
+		return
+	}
+	used := make(map[string]bool)
+	feedTokens := make(map[string]string)
+	for _, s := range sessions {
+		if !s.IsLoggedIn() && time.Since(s.Created) > 24*time.Hour {
+			sessionRepo.Remove(s.ID)
+			continue
+		}
+		used[s.InstanceDomain] = true
+		feedTokens[s.ID] = s.FeedToken
+	}
+	for _, f := range feeds {
+		if feedTokens[f.SessionID] != f.Token {
+			feedRepo.Remove(f.Token)
+		}
+	}
+	if cleanApps {
+		for _, instance := range instances {
+			if !used[instance] {
+				appRepo.Remove(instance)
+			}
+		}
+	}
+	return
+}
+
+// securityHeaders returns the security headers of the responses, with the
+// values of the config replacing the defaults. The default policy allows
+// media from anywhere, as it's loaded from the instances unless proxied, and
+// inline styles for the user CSS and the styles of remote statuses. Frames
+// are only allowed on bloat's own pages, for the nav and the compose frame.
+func securityHeaders(csp string, frameOptions string, referrerPolicy string,
+	customCSS string) http.Header {
+	if len(csp) < 1 {
+		styles := "'self' 'unsafe-inline'"
+		if u, err := url.Parse(customCSS); err == nil && len(u.Host) > 0 {
+			styles += " " + u.Scheme + "://" + u.Host
+		}
+		csp = "default-src 'self'; img-src * data: blob:; media-src *; " +
+			"font-src * data:; style-src " + styles + "; " +
+			"object-src 'none'; base-uri 'self'; frame-ancestors 'self'"
+	}
+	if len(frameOptions) < 1 {
+		frameOptions = "SAMEORIGIN"
+	}
+	if len(referrerPolicy) < 1 {
+		referrerPolicy = "same-origin"
+	}
+	h := make(http.Header)
+	h.Set("X-Content-Type-Options", "nosniff")
+	for k, v := range map[string]string{
+		"Content-Security-Policy": csp,
+		"X-Frame-Options":         frameOptions,
+		"Referrer-Policy":         referrerPolicy,
+	} {
+		if v != "off" {
+			h.Set(k, v)
+		}
+	}
+	return h
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration,
+	maxFiles int) (*util.LogFile, error) {
+	f, err := util.OpenLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f.MaxSize = maxSize
+	f.MaxAge = maxAge
+	f.MaxFiles = maxFiles
+	return f, nil
+}
+
+// reopenLoop opens the log files again on SIGUSR1, so that they can be
+// rotated by tools like logrotate.
+func reopenLoop(files []*util.LogFile, logger *util.Logger) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	for range sigc {
+		for _, f := range files {
+			if err := f.Reopen(); err != nil {
+				logger.Error("reopening the log file failed", "err", err)
+			}
+		}
+		logger.Info("reopened the log files")
+	}
+}
+
+// cleanLoop removes the expired cache entries and sessions, and the avatars
+// that weren't cached in the last month, as most of them are of accounts
+// that are no longer seen.
+func cleanLoop(cacheRepo model.CacheRepo, avatarCache *util.AvatarCache,
+	sessionRepo model.SessionRepo, appRepo model.AppRepo,
+	feedRepo model.FeedRepo, cleanUploads func() error, cleanApps bool,
+	logger *util.Logger) {
+
+	for range time.Tick(24 * time.Hour) {
+		err := cacheRepo.Clean()
+		if err != nil {
+			logger.Error("cleaning cache failed", "err", err)
+		}
+		err = cleanSessions(sessionRepo, appRepo, feedRepo, cleanApps)
+		if err != nil {
+			logger.Error("cleaning sessions failed", "err", err)
+		}
+		if avatarCache != nil {
+			err = avatarCache.Clean(30 * 24 * time.Hour)
+			if err != nil {
+				logger.Error("cleaning avatar cache failed", "err", err)
+			}
+		}
+		err = cleanUploads()
+		if err != nil {
+			logger.Error("cleaning uploads failed", "err", err)
+		}
+	}
+}
+
+// endpoint is a listener with the handler it serves.
+type endpoint struct {
+	config.Listener
+	handler http.Handler
+}
+
+// serve serves the endpoints until one of them fails or the process is
+// interrupted, and then shuts all of them down. New connections are refused
+// right away, while the requests in flight are given up to timeout to
+// finish, unless another signal comes in meanwhile.
+func serve(endpoints []endpoint, autocertTLS *tls.Config,
+	timeout time.Duration, logger *util.Logger) (err error) {
+
+	var servers []*http.Server
+	errc := make(chan error, len(endpoints))
+	for _, l := range endpoints {
+		if l.Network == "unix" {
+			// Remove the socket left over by a previous run, but not
+			// another file that is there by mistake
+			if fi, lerr := os.Lstat(l.Address); lerr == nil {
+				if fi.Mode()&os.ModeSocket == 0 {
+					err = errors.New(l.Address +
+						" exists and isn't a socket")
+					break
+				}
+				os.Remove(l.Address)
+			}
+		}
+		var ln net.Listener
+		ln, err = net.Listen(l.Network, l.Address)
+		if err != nil {
+			break
+		}
+		if l.Mode != 0 {
+			err = os.Chmod(l.Address, l.Mode)
+			if err != nil {
+				ln.Close()
+				break
+			}
+		}
+		srv := &http.Server{Handler: l.handler}
+		servers = append(servers, srv)
+		go func(l endpoint) {
+			var err error
+			if len(l.CertFile) > 0 {
+				logger.Info("listening", "network", l.Network,
+					"address", l.Address, "tls", "cert")
+				err = srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+			} else if l.Autocert {
+				logger.Info("listening", "network", l.Network,
+					"address", l.Address, "tls", "autocert")
+				srv.TLSConfig = autocertTLS
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				logger.Info("listening", "network", l.Network,
+					"address", l.Address)
+				err = srv.Serve(ln)
+			}
+			errc <- err
+		}(l)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	if err == nil {
+		select {
+		case err = <-errc:
+		case sig := <-sigc:
+			logger.Info("shutting down", "signal", sig)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sigc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if srv.Shutdown(ctx) != nil {
+				logger.Warn("closing the connections still in use")
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	return
+}
+
 func main() {
-	opts, _, err := util.Getopts(os.Args, "f:")
+	// The -check-config option of older versions is kept as an alias of the
+	// check-config command. It doesn't fit getopt's single letter options,
+	// so it's picked out of the arguments beforehand.
+	var args []string
+	for _, arg := range os.Args {
+		if arg == "-check-config" || arg == "--check-config" {
+			checkConfig = true
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	opts, optind, err := util.Getopts(args, "f:")
 	if err != nil {
-		errExit(err)
+		errExit(errors.New(err.Error() + "\n" + usage))
 	}
 
 	for _, opt := range opts {
@@ -38,67 +343,361 @@ func main() {
 		}
 	}
 
+	// Without a command, the server is run
+	var cmd []string
+	if optind < len(args) {
+		cmd = args[optind:]
+		switch {
+		case cmd[0] == "serve" && len(cmd) == 1:
+			cmd = nil
+		case cmd[0] == "check-config" && len(cmd) == 1:
+			checkConfig = true
+			cmd = nil
+		case cmd[0] == "gen-config" && len(cmd) == 1:
+			os.Stdout.Write(defaultConfig)
+			return
+		case cmd[0] == "backup" && len(cmd) == 2:
+		default:
+			errExit(errors.New(usage))
+		}
+	}
+
 	config, err := config.ParseFile(configFile)
 	if err != nil {
 		errExit(err)
 	}
 
-	if !config.IsValid() {
-		errExit(errors.New("invalid config"))
+	var overrideTemplatesGlobPattern, overrideStaticDir string
+	if len(config.OverrideDir) > 0 {
+		overrideTemplatesGlobPattern = filepath.Join(config.OverrideDir,
+			"templates", "*")
+		overrideStaticDir = filepath.Join(config.OverrideDir, "static")
 	}
 
-	templatesGlobPattern := filepath.Join(config.TemplatesPath, "*")
-	renderer, err := renderer.NewRenderer(templatesGlobPattern)
+	// The templates and static files built into the binary are used unless
+	// a directory is configured for them.
+	templatesFS, err := dataFS(config.TemplatesPath, "templates")
+	if err != nil {
+		errExit(err)
+	}
+	staticDir, err := dataFS(config.StaticDirectory, "static")
 	if err != nil {
 		errExit(err)
 	}
 
-	err = os.Mkdir(config.DatabasePath, 0755)
-	if err != nil && !os.IsExist(err) {
+	var staticFS http.FileSystem = http.FS(staticDir)
+	staticDirs := []fs.FS{staticDir}
+	if len(overrideStaticDir) > 0 {
+		staticFS = util.OverlayFS{http.Dir(overrideStaticDir), staticFS}
+		staticDirs = []fs.FS{os.DirFS(overrideStaticDir), staticDir}
+	}
+	themes, err := util.Themes(staticDirs...)
+	if err != nil {
 		errExit(err)
 	}
 
-	sessionDBPath := filepath.Join(config.DatabasePath, "session")
-	sessionDB, err := util.NewDatabse(sessionDBPath)
+	// Fingerprints would go stale as static files are edited along with
+	// the templates.
+	var staticHashes map[string]string
+	if !config.ReloadTemplates {
+		staticHashes, err = util.Fingerprint(staticFS, staticDirs...)
+		if err != nil {
+			errExit(err)
+		}
+	}
+
+	renderer, err := renderer.NewRenderer(templatesFS,
+		renderer.Options{
+			OverrideGlobPattern: overrideTemplatesGlobPattern,
+			MediaProxy:          config.MediaProxy,
+			AvatarCache:         len(config.AvatarCacheDir) > 0,
+			EmojiCache:          config.EmojiCache,
+			StaticHashes:        staticHashes,
+			Reload:              config.ReloadTemplates,
+			BasePath:            config.BasePath(),
+		})
 	if err != nil {
 		errExit(err)
 	}
 
-	appDBPath := filepath.Join(config.DatabasePath, "app")
-	appDB, err := util.NewDatabse(appDBPath)
+	if checkConfig {
+		fmt.Println("config ok")
+		return
+	}
+
+	var sessionDB, appDB, cacheDB, feedDB, accountDB util.Store
+	backend, err := util.OpenBackend(config.Store())
+	if err != nil {
+		errExit(err)
+	}
+	sessionDB, err = backend.Store("session")
+	if err != nil {
+		errExit(err)
+	}
+	appDB, err = backend.Store("app")
+	if err != nil {
+		errExit(err)
+	}
+	cacheDB, err = backend.Store("cache")
+	if err != nil {
+		errExit(err)
+	}
+	feedDB, err = backend.Store("feed")
 	if err != nil {
 		errExit(err)
 	}
+	accountDB, err = backend.Store("account")
+	if err != nil {
+		errExit(err)
+	}
+
+	// The stores are measured along with the requests when the metrics
+	// are enabled
+	var metrics *util.Metrics
+	if config.MetricsListener != nil && len(cmd) < 1 {
+		metrics = util.NewMetrics()
+		sessionDB = metrics.Store(sessionDB)
+		appDB = metrics.Store(appDB)
+		cacheDB = metrics.Store(cacheDB)
+		feedDB = metrics.Store(feedDB)
+		accountDB = metrics.Store(accountDB)
+		metrics.Gauge("bloat_sessions", "Sessions in the store.",
+			func() float64 {
+				keys, _ := sessionDB.Keys()
+				return float64(len(keys))
+			})
+	}
+
+	if len(cmd) > 0 {
+		err = util.BackupFile(cmd[1], sessionDB, appDB, feedDB,
+			accountDB)
+		if err != nil {
+			errExit(err)
+		}
+		return
+	}
 
-	sessionRepo := repo.NewSessionRepo(sessionDB)
-	appRepo := repo.NewAppRepo(appDB)
+	var storageSealer *util.Sealer
+	if len(config.StorageSecret) > 0 {
+		storageSealer, err = util.NewSealer(config.StorageSecret)
+		if err != nil {
+			errExit(err)
+		}
+	}
+
+	sessionRepo := repo.NewSessionRepo(sessionDB, storageSealer)
+	appRepo := repo.NewAppRepo(appDB, storageSealer)
+	cacheRepo := repo.NewCacheRepo(cacheDB)
+	instanceCache := repo.NewMemCacheRepo(nil)
+	if config.InstanceCacheStore {
+		instanceCache = repo.NewMemCacheRepo(cacheRepo)
+	}
+	feedRepo := repo.NewFeedRepo(feedDB)
+	accountSettingsRepo := repo.NewAccountSettingsRepo(accountDB)
 
 	customCSS := config.CustomCSS
 	if len(customCSS) > 0 && !strings.HasPrefix(customCSS, "http://") &&
 		!strings.HasPrefix(customCSS, "https://") {
-		customCSS = "/static/" + customCSS
+		customCSS = config.BasePath() +
+			util.StaticURL(staticHashes, customCSS)
 	}
 
-	var logger *log.Logger
+	var logger *util.Logger
+	var logFiles []*util.LogFile
 	if len(config.LogFile) < 1 {
-		logger = log.New(os.Stdout, "", log.LstdFlags)
+		logger = util.NewLogger(os.Stdout, config.LogLevel, config.LogJSON)
 	} else {
-		lf, err := os.OpenFile(config.LogFile,
-			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		lf, err := openLogFile(config.LogFile, config.LogMaxSize,
+			config.LogMaxAge, config.LogMaxFiles)
 		if err != nil {
 			errExit(err)
 		}
 		defer lf.Close()
-		logger = log.New(lf, "", log.LstdFlags)
+		logFiles = append(logFiles, lf)
+		logger = util.NewLogger(lf, config.LogLevel, config.LogJSON)
 	}
 
-	s := service.NewService(config.ClientName, config.ClientScope,
-		config.ClientWebsite, customCSS, config.SingleInstance,
-		config.PostFormats, renderer, sessionRepo, appRepo)
-	handler := service.NewHandler(s, logger, config.StaticDirectory)
+	var accessLog *util.AccessLog
+	if len(config.AccessLogFile) > 0 {
+		af, err := openLogFile(config.AccessLogFile,
+			config.LogMaxSize, config.LogMaxAge, config.LogMaxFiles)
+		if err != nil {
+			errExit(err)
+		}
+		defer af.Close()
+		logFiles = append(logFiles, af)
+		accessLog = util.NewAccessLog(af, config.AccessLogJSON)
+	}
 
-	logger.Println("listening on", config.ListenAddress)
-	err = http.ListenAndServe(config.ListenAddress, handler)
+	if len(logFiles) > 0 {
+		go reopenLoop(logFiles, logger)
+	}
+
+	userAgent := config.UserAgent
+	if len(userAgent) < 1 {
+		userAgent = "bloat/" + version
+	}
+	appWebsite := config.ClientAppWebsite
+	if len(appWebsite) < 1 {
+		appWebsite = config.ClientWebsite
+	}
+
+	var mediaProxy *util.MediaProxy
+	if config.MediaProxy {
+		mediaProxy = util.NewMediaProxy(config.MediaProxyHosts,
+			config.MediaProxyMax)
+		mediaProxy.UserAgent = userAgent
+	}
+
+	// Media fetched for the caches is subject to the same host allowlist
+	// as the media proxy.
+	fetcher := mediaProxy
+	if fetcher == nil {
+		fetcher = util.NewMediaProxy(config.MediaProxyHosts, 0)
+		fetcher.UserAgent = userAgent
+	}
+
+	var avatarCache *util.AvatarCache
+	if len(config.AvatarCacheDir) > 0 {
+		avatarCache, err = util.NewAvatarCache(config.AvatarCacheDir, fetcher)
+		if err != nil {
+			errExit(err)
+		}
+	}
+
+	uploadDir := config.UploadDir
+	if len(uploadDir) < 1 {
+		uploadDir = filepath.Join(os.TempDir(), "bloat-uploads")
+	}
+	err = os.MkdirAll(uploadDir, 0700)
+	if err != nil {
+		errExit(err)
+	}
+
+	var emojiFetcher *util.MediaProxy
+	if config.EmojiCache {
+		emojiFetcher = fetcher
+	}
+
+	httpClient := mastodon.NewHTTPClient(mastodon.HTTPOptions{
+		DialTimeout:           config.UpstreamDialTimeout,
+		TLSHandshakeTimeout:   config.UpstreamTLSTimeout,
+		ResponseHeaderTimeout: config.UpstreamResponseTimeout,
+		MaxIdleConns:          config.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   config.UpstreamMaxIdleConns,
+		DisableKeepAlives:     !config.UpstreamKeepAlives,
+		UserAgent:             userAgent,
+	})
+	httpClient.Transport = util.RequestIDTransport(httpClient.Transport)
+	httpClient.Transport = metrics.Transport(httpClient.Transport)
+	httpClient.Transport = logger.Transport(httpClient.Transport)
+
+	var sealer *util.Sealer
+	if len(config.SessionSecret) > 0 {
+		sealer, err = util.NewSealer(config.SessionSecret)
+		if err != nil {
+			errExit(err)
+		}
+	}
+
+	s := service.NewService(service.Options{
+		ClientName:          config.ClientName,
+		ClientScope:         config.ClientScope,
+		ClientWebsite:       config.ClientWebsite,
+		AppWebsite:          appWebsite,
+		CustomCSS:           customCSS,
+		SingleInstance:      config.SingleInstance,
+		PostFormats:         config.PostFormats,
+		Version:             version,
+		ShowWhatsNew:        config.ShowWhatsNew,
+		PublicThreads:       config.PublicThreads,
+		Themes:              themes,
+		Renderer:            renderer,
+		SessionRepo:         sessionRepo,
+		AppRepo:             appRepo,
+		CacheRepo:           cacheRepo,
+		FeedRepo:            feedRepo,
+		AccountSettingsRepo: accountSettingsRepo,
+		MediaProxy:          mediaProxy,
+		AvatarCache:         avatarCache,
+		EmojiFetcher:        emojiFetcher,
+		Fetcher:             fetcher,
+		HTTPClient:          httpClient,
+		SessionLifetime:     config.SessionLifetime,
+		SlidingSessions:     config.SlidingSessions,
+		Sealer:              sealer,
+		BasePath:            config.BasePath(),
+		CookieSecure:        config.CookieSecure,
+		CookieSameSite:      config.CookieSameSite,
+		WriteLimiter: util.NewLimiter(config.WriteRateLimit,
+			config.WriteRateBurst),
+		WriteIPLimiter: util.NewLimiter(config.WriteRateLimitIP,
+			config.WriteRateBurst),
+		MaxUploadSize:     config.MaxUploadSize,
+		UploadDir:         uploadDir,
+		InstanceCache:     instanceCache,
+		InstanceCacheTTL:  config.InstanceCacheTTL,
+		RelationshipCache: repo.NewMemCacheRepo(nil),
+	})
+
+	go cleanLoop(cacheRepo, avatarCache, sessionRepo, appRepo, feedRepo,
+		s.CleanUploads, len(config.SessionSecret) < 1, logger)
+
+	if len(config.BackupDirectory) > 0 {
+		go backupLoop(config.BackupDirectory, config.BackupInterval,
+			metrics, logger, sessionDB, appDB, feedDB, accountDB)
+	}
+
+	handler := service.NewHandler(s, logger, staticFS, staticHashes,
+		metrics, accessLog)
+	handler = util.HeaderHandler(handler, securityHeaders(
+		config.ContentSecurityPolicy, config.FrameOptions,
+		config.ReferrerPolicy, customCSS))
+
+	// The certificates of autocert listeners are obtained from Let's
+	// Encrypt on first use, with the TLS-ALPN challenge, so that nothing
+	// needs to listen on port 80
+	var autocertTLS *tls.Config
+	for _, l := range config.Listeners {
+		if l.Autocert {
+			m := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				Cache:      autocert.DirCache(config.AutocertDir),
+				HostPolicy: autocert.HostWhitelist(config.AutocertHosts...),
+				Email:      config.AutocertEmail,
+			}
+			autocertTLS = m.TLSConfig()
+			break
+		}
+	}
+
+	var endpoints []endpoint
+	for _, l := range config.Listeners {
+		endpoints = append(endpoints, endpoint{l, handler})
+	}
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		endpoints = append(endpoints,
+			endpoint{*config.MetricsListener, mux})
+	}
+	if config.PprofListener != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		endpoints = append(endpoints,
+			endpoint{*config.PprofListener, mux})
+	}
+	err = serve(endpoints, autocertTLS, config.ShutdownTimeout, logger)
+	// The stores aren't used anymore once serve returns
+	if c, ok := backend.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil {
+			logger.Error("closing the store failed", "err", cerr)
+		}
+	}
 	if err != nil {
 		errExit(err)
 	}
@@ -53,22 +53,14 @@ type AccountSource struct {
 	Fields    *[]Field `json:"fields"`
 }
 
-// GetAccount return Account.
+// GetAccount return Account. Only Pleroma includes the relationship to the
+// account, see GetAccountRelationships.
 func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
 	var account Account
 	err := c.doAPI(ctx, http.MethodGet, fmt.Sprintf("/api/v1/accounts/%s", url.PathEscape(string(id))), nil, &account, nil)
 	if err != nil {
 		return nil, err
 	}
-	if account.Pleroma == nil || len(account.Pleroma.Relationship.ID) < 1 {
-		rs, err := c.GetAccountRelationships(ctx, []string{id})
-		if err != nil {
-			return nil, err
-		}
-		if len(rs) > 0 {
-			account.Pleroma = &AccountPleroma{*rs[0]}
-		}
-	}
 	return &account, nil
 }
 
@@ -153,6 +145,18 @@ func (c *Client) GetAccountStatuses(ctx context.Context, id string, onlyMedia bo
 	return statuses, nil
 }
 
+// GetAccountPinnedStatuses return statuses pinned by specified accuont.
+func (c *Client) GetAccountPinnedStatuses(ctx context.Context, id string) ([]*Status, error) {
+	var statuses []*Status
+	params := url.Values{}
+	params.Set("pinned", "true")
+	err := c.doAPI(ctx, http.MethodGet, fmt.Sprintf("/api/v1/accounts/%s/statuses", url.PathEscape(string(id))), params, &statuses, nil)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
 // GetAccountFollowers return followers list.
 func (c *Client) GetAccountFollowers(ctx context.Context, id string, pg *Pagination) ([]*Account, error) {
 	var accounts []*Account
@@ -195,16 +199,22 @@ type Relationship struct {
 	Requested           bool   `json:"requested"`
 	DomainBlocking      bool   `json:"domain_blocking"`
 	ShowingReblogs      bool   `json:"showing_reblogs"`
+	Notifying           bool   `json:"notifying"`
 	Endorsed            bool   `json:"endorsed"`
 }
 
-// AccountFollow follow the account.
-func (c *Client) AccountFollow(ctx context.Context, id string, reblogs *bool) (*Relationship, error) {
+// AccountFollow follow the account. The boosts and the notifications of new
+// statuses of the account are left as they are when reblogs and notify are
+// nil.
+func (c *Client) AccountFollow(ctx context.Context, id string, reblogs *bool, notify *bool) (*Relationship, error) {
 	var relationship Relationship
 	params := url.Values{}
 	if reblogs != nil {
 		params.Set("reblogs", strconv.FormatBool(*reblogs))
 	}
+	if notify != nil {
+		params.Set("notify", strconv.FormatBool(*notify))
+	}
 	err := c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/accounts/%s/follow", url.PathEscape(id)), params, &relationship, nil)
 	if err != nil {
 		return nil, err
@@ -242,10 +252,15 @@ func (c *Client) AccountUnblock(ctx context.Context, id string) (*Relationship,
 	return &relationship, nil
 }
 
-// AccountMute mute the account.
-func (c *Client) AccountMute(ctx context.Context, id string) (*Relationship, error) {
+// AccountMute mute the account. The instance decides whether the
+// notifications from the account are muted too when notifications is nil.
+func (c *Client) AccountMute(ctx context.Context, id string, notifications *bool) (*Relationship, error) {
 	var relationship Relationship
-	err := c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/accounts/%s/mute", url.PathEscape(string(id))), nil, &relationship, nil)
+	params := url.Values{}
+	if notifications != nil {
+		params.Set("notifications", strconv.FormatBool(*notifications))
+	}
+	err := c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/accounts/%s/mute", url.PathEscape(string(id))), params, &relationship, nil)
 	if err != nil {
 		return nil, err
 	}
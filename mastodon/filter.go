@@ -27,7 +27,9 @@ func (c *Client) GetFilters(ctx context.Context) ([]*Filter, error) {
 	return filters, nil
 }
 
-func (c *Client) AddFilter(ctx context.Context, phrase string, context []string, irreversible bool, wholeWord bool, expiresIn *time.Time) error {
+// AddFilter adds a filter that expires after expiresIn seconds, or never if
+// expiresIn is 0.
+func (c *Client) AddFilter(ctx context.Context, phrase string, context []string, irreversible bool, wholeWord bool, expiresIn int) error {
 	params := url.Values{}
 	params.Set("phrase", phrase)
 	for i := range context {
@@ -35,8 +37,8 @@ func (c *Client) AddFilter(ctx context.Context, phrase string, context []string,
 	}
 	params.Set("irreversible", strconv.FormatBool(irreversible))
 	params.Set("whole_word", strconv.FormatBool(wholeWord))
-	if expiresIn != nil {
-		params.Set("expires_in", expiresIn.Format(time.RFC3339))
+	if expiresIn > 0 {
+		params.Set("expires_in", strconv.Itoa(expiresIn))
 	}
 	err := c.doAPI(ctx, http.MethodPost, "/api/v1/filters", params, nil, nil)
 	if err != nil {
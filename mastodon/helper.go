@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 // Base64EncodeFileName returns the base64 data URI format string of the file with the file name.
@@ -40,6 +42,50 @@ func Base64Encode(file *os.File) (string, error) {
 // String is a helper function to get the pointer value of a string.
 func String(v string) *string { return &v }
 
+// ErrUnauthorized is returned when the instance rejects the access token,
+// e.g. because it was revoked or has expired.
+var ErrUnauthorized = errors.New("access token rejected by the instance")
+
+// ErrPreviewUnsupported is returned by PreviewStatus when the instance isn't
+// known to preview posts.
+var ErrPreviewUnsupported = errors.New("instance can't preview posts")
+
+// RateLimitError is returned when the instance throttles the requests.
+type RateLimitError struct {
+	// Reset is when requests are allowed again, zero if unknown
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by the instance, retry after %ds",
+		int(e.RetryAfter().Seconds()))
+}
+
+// RetryAfter returns how long to wait before retrying the request.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	if e.Reset.IsZero() {
+		return time.Minute
+	}
+	d := time.Until(e.Reset).Round(time.Second)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// parseRateLimitError reads the reset time of the X-RateLimit-Reset header
+// that Mastodon and Pleroma send, or of the standard Retry-After header.
+func parseRateLimitError(resp *http.Response) error {
+	e := &RateLimitError{}
+	if t, err := time.Parse(time.RFC3339,
+		resp.Header.Get("X-RateLimit-Reset")); err == nil {
+		e.Reset = t
+	} else if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.Reset = time.Now().Add(time.Duration(n) * time.Second)
+	}
+	return e
+}
+
 func parseAPIError(prefix string, resp *http.Response) error {
 	errMsg := fmt.Sprintf("%s: %s", prefix, resp.Status)
 	var e struct {
@@ -17,6 +17,56 @@ type Instance struct {
 	Stats          *InstanceStats    `json:"stats,omitempty"`
 	Languages      []string          `json:"languages"`
 	ContactAccount *Account          `json:"account"`
+	Pleroma        *InstancePleroma  `json:"pleroma,omitempty"`
+
+	// Mastodon has the limits in Configuration, Pleroma in the other
+	// fields
+	Configuration       *InstanceConfiguration `json:"configuration,omitempty"`
+	UploadLimit         int64                  `json:"upload_limit,omitempty"`
+	MaxMediaAttachments int64                  `json:"max_media_attachments,omitempty"`
+}
+
+// InstancePleroma holds the Pleroma specific information of an instance.
+type InstancePleroma struct {
+	Metadata struct {
+		PostFormats []string `json:"post_formats"`
+	} `json:"metadata"`
+}
+
+// PostFormats returns the content types accepted for posts by the instance.
+// Only Pleroma advertises them, other instances return nil.
+func (i *Instance) PostFormats() []string {
+	if i.Pleroma == nil {
+		return nil
+	}
+	return i.Pleroma.Metadata.PostFormats
+}
+
+// defaultMaxMediaAttachments is the number of attachments of a status on
+// instances that don't tell.
+const defaultMaxMediaAttachments = 4
+
+// MediaLimits returns the largest attachment and the number of attachments
+// of a status accepted by the instance. The size is 0 if the instance doesn't
+// advertise it.
+func (i *Instance) MediaLimits() (size int64, count int64) {
+	size = i.UploadLimit
+	count = i.MaxMediaAttachments
+	if c := i.Configuration; c != nil {
+		if c.MediaAttachments.ImageSizeLimit > size {
+			size = c.MediaAttachments.ImageSizeLimit
+		}
+		if c.MediaAttachments.VideoSizeLimit > size {
+			size = c.MediaAttachments.VideoSizeLimit
+		}
+		if c.Statuses.MaxMediaAttachments > 0 {
+			count = c.Statuses.MaxMediaAttachments
+		}
+	}
+	if count < 1 {
+		count = defaultMaxMediaAttachments
+	}
+	return
 }
 
 // InstanceStats hold information for mastodon instance stats.
@@ -73,3 +123,75 @@ func (c *Client) GetInstanceEmojis(ctx context.Context) ([]*Emoji, error) {
 	}
 	return emojis, nil
 }
+
+// InstanceV2 hold information for mastodon instance returned by the v2
+// instance API.
+type InstanceV2 struct {
+	Domain        string                `json:"domain"`
+	Title         string                `json:"title"`
+	Version       string                `json:"version"`
+	SourceURL     string                `json:"source_url"`
+	Description   string                `json:"description"`
+	Usage         InstanceUsage         `json:"usage"`
+	Languages     []string              `json:"languages"`
+	Configuration InstanceConfiguration `json:"configuration"`
+	Registrations InstanceRegistrations `json:"registrations"`
+	Contact       InstanceContact       `json:"contact"`
+	Rules         []InstanceRule        `json:"rules"`
+}
+
+// InstanceUsage hold information for instance usage.
+type InstanceUsage struct {
+	Users struct {
+		ActiveMonth int64 `json:"active_month"`
+	} `json:"users"`
+}
+
+// InstanceConfiguration hold information for configured instance limits.
+type InstanceConfiguration struct {
+	Statuses struct {
+		MaxCharacters            int64 `json:"max_characters"`
+		MaxMediaAttachments      int64 `json:"max_media_attachments"`
+		CharactersReservedPerURL int64 `json:"characters_reserved_per_url"`
+	} `json:"statuses"`
+	MediaAttachments struct {
+		SupportedMimeTypes []string `json:"supported_mime_types"`
+		ImageSizeLimit     int64    `json:"image_size_limit"`
+		VideoSizeLimit     int64    `json:"video_size_limit"`
+	} `json:"media_attachments"`
+	Polls struct {
+		MaxOptions             int64 `json:"max_options"`
+		MaxCharactersPerOption int64 `json:"max_characters_per_option"`
+		MinExpiration          int64 `json:"min_expiration"`
+		MaxExpiration          int64 `json:"max_expiration"`
+	} `json:"polls"`
+}
+
+// InstanceRegistrations hold information for instance registration status.
+type InstanceRegistrations struct {
+	Enabled          bool   `json:"enabled"`
+	ApprovalRequired bool   `json:"approval_required"`
+	Message          string `json:"message"`
+}
+
+// InstanceContact hold information for instance contact.
+type InstanceContact struct {
+	Email   string   `json:"email"`
+	Account *Account `json:"account"`
+}
+
+// InstanceRule hold information for an instance rule.
+type InstanceRule struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// GetInstanceV2 return InstanceV2.
+func (c *Client) GetInstanceV2(ctx context.Context) (*InstanceV2, error) {
+	var instance InstanceV2
+	err := c.doAPI(ctx, http.MethodGet, "/api/v2/instance", nil, &instance, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
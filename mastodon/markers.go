@@ -0,0 +1,37 @@
+package mastodon
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Marker hold information for the last read position of a timeline.
+type Marker struct {
+	LastReadID string    `json:"last_read_id"`
+	Version    int64     `json:"version"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// GetMarkers return markers of the timelines, which are either "home" or
+// "notifications".
+func (c *Client) GetMarkers(ctx context.Context, timelines []string) (map[string]*Marker, error) {
+	params := url.Values{}
+	for _, t := range timelines {
+		params.Add("timeline[]", t)
+	}
+	markers := make(map[string]*Marker)
+	err := c.doAPI(ctx, http.MethodGet, "/api/v1/markers", params, &markers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+// SetMarker set the last read position of a timeline.
+func (c *Client) SetMarker(ctx context.Context, timeline string, lastReadID string) error {
+	params := url.Values{}
+	params.Set(timeline+"[last_read_id]", lastReadID)
+	return c.doAPI(ctx, http.MethodPost, "/api/v1/markers", params, nil, nil)
+}
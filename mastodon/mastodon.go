@@ -9,12 +9,15 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tomnomnom/linkheader"
 )
@@ -25,6 +28,63 @@ type Config struct {
 	ClientID     string
 	ClientSecret string
 	AccessToken  string
+	// HTTPClient is used for the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// HTTPOptions are the timeouts and the connection pooling of the HTTP client
+// used for the requests to the instances. Zero values keep the defaults of
+// net/http.
+type HTTPOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	DisableKeepAlives     bool
+	// UserAgent is sent with every request, unless it's empty
+	UserAgent string
+}
+
+// userAgentTransport sets the User-Agent header of the requests.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// NewHTTPClient returns a HTTP client with the options. There's no timeout
+// for reading the body, so that the streaming API keeps working.
+func NewHTTPClient(opts HTTPOptions) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.DialTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if opts.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+	if opts.MaxIdleConns > 0 {
+		t.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	t.DisableKeepAlives = opts.DisableKeepAlives
+	if len(opts.UserAgent) > 0 {
+		return &http.Client{Transport: &userAgentTransport{t, opts.UserAgent}}
+	}
+	return &http.Client{Transport: t}
 }
 
 // Client is a API client for mastodon.
@@ -62,77 +122,48 @@ func (c *Client) doAPI(ctx context.Context, method string, uri string, params in
 			return err
 		}
 		defer f.Close()
-
-		var buf bytes.Buffer
-		mw := multipart.NewWriter(&buf)
-		part, err := mw.CreateFormFile("file", filepath.Base(file))
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(part, f)
-		if err != nil {
-			return err
-		}
-		err = mw.Close()
+		fi, err := f.Stat()
 		if err != nil {
 			return err
 		}
-		req, err = http.NewRequest(method, u.String(), &buf)
+		req, ct, err = newMediaRequest(method, u.String(), &Media{
+			Name:   filepath.Base(file),
+			Size:   fi.Size(),
+			Reader: f,
+		})
 		if err != nil {
 			return err
 		}
-		ct = mw.FormDataContentType()
 	} else if file, ok := params.(*multipart.FileHeader); ok {
 		f, err := file.Open()
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-
-		var buf bytes.Buffer
-		mw := multipart.NewWriter(&buf)
 		fname := filepath.Base(file.Filename)
-		err = mw.WriteField("description", fname)
-		if err != nil {
-			return err
-		}
-		part, err := mw.CreateFormFile("file", fname)
+		req, ct, err = newMediaRequest(method, u.String(), &Media{
+			Name:        fname,
+			Description: fname,
+			Size:        file.Size,
+			Reader:      f,
+		})
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(part, f)
+	} else if media, ok := params.(*Media); ok {
+		req, ct, err = newMediaRequest(method, u.String(), media)
 		if err != nil {
 			return err
 		}
-		err = mw.Close()
-		if err != nil {
-			return err
-		}
-		req, err = http.NewRequest(method, u.String(), &buf)
-		if err != nil {
-			return err
-		}
-		ct = mw.FormDataContentType()
 	} else if reader, ok := params.(io.Reader); ok {
-		var buf bytes.Buffer
-		mw := multipart.NewWriter(&buf)
-		part, err := mw.CreateFormFile("file", "upload")
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(part, reader)
-		if err != nil {
-			return err
-		}
-		err = mw.Close()
+		req, ct, err = newMediaRequest(method, u.String(), &Media{
+			Name:   "upload",
+			Size:   -1,
+			Reader: reader,
+		})
 		if err != nil {
 			return err
 		}
-		req, err = http.NewRequest(method, u.String(), &buf)
-		if err != nil {
-			return err
-		}
-		ct = mw.FormDataContentType()
 	} else {
 		if method == http.MethodGet && pg != nil {
 			u.RawQuery = pg.toValues().Encode()
@@ -143,7 +174,10 @@ func (c *Client) doAPI(ctx context.Context, method string, uri string, params in
 		}
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	// Public data can be fetched without a token
+	if len(c.config.AccessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	}
 	if params != nil {
 		req.Header.Set("Content-Type", ct)
 	}
@@ -154,11 +188,18 @@ func (c *Client) doAPI(ctx context.Context, method string, uri string, params in
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return parseRateLimitError(resp)
+	} else if resp.StatusCode == http.StatusUnauthorized &&
+		len(c.config.AccessToken) > 0 {
+		return ErrUnauthorized
+	} else if resp.StatusCode != http.StatusOK {
 		return parseAPIError("bad request", resp)
 	} else if res == nil {
 		return nil
 	} else if pg != nil {
+		// Without a Link header, there are no other pages
+		*pg = Pagination{}
 		if lh := resp.Header.Get("Link"); lh != "" {
 			pg2, err := newPagination(lh)
 			if err != nil {
@@ -170,10 +211,48 @@ func (c *Client) doAPI(ctx context.Context, method string, uri string, params in
 	return json.NewDecoder(resp.Body).Decode(&res)
 }
 
+// newMediaRequest returns a request with m as the file of a multipart form,
+// and the content type of the form. The file is streamed from its reader
+// instead of being copied into memory, so that large videos don't take up
+// the memory of bloat.
+func newMediaRequest(method string, url string, m *Media) (
+	req *http.Request, ct string, err error) {
+
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	if len(m.Description) > 0 {
+		err = mw.WriteField("description", m.Description)
+		if err != nil {
+			return
+		}
+	}
+	_, err = mw.CreateFormFile("file", m.Name)
+	if err != nil {
+		return
+	}
+	// The end of the form, as written by mw.Close
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+	body := io.MultiReader(&head, m.Reader, strings.NewReader(tail))
+	req, err = http.NewRequest(method, url, body)
+	if err != nil {
+		return
+	}
+	// The length is only known along with the size of the file, the body
+	// is sent in chunks otherwise
+	if m.Size >= 0 {
+		req.ContentLength = int64(head.Len()) + m.Size + int64(len(tail))
+	}
+	return req, mw.FormDataContentType(), nil
+}
+
 // NewClient return new mastodon API client.
 func NewClient(config *Config) *Client {
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
 	return &Client{
-		Client: http.DefaultClient,
+		Client: client,
 		config: config,
 	}
 }
@@ -241,6 +320,38 @@ func (c *Client) authenticate(ctx context.Context, params url.Values) error {
 	return nil
 }
 
+// RevokeToken invalidates the access token of the client on the server.
+func (c *Client) RevokeToken(ctx context.Context) error {
+	u, err := url.Parse(c.config.Server)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, "/oauth/revoke")
+
+	params := url.Values{
+		"client_id":     {c.config.ClientID},
+		"client_secret": {c.config.ClientSecret},
+		"token":         {c.config.AccessToken},
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return parseAPIError("bad revocation", resp)
+	}
+	c.config.AccessToken = ""
+	return nil
+}
+
 func (c *Client) GetAccessToken(ctx context.Context) string {
 	if c == nil || c.config == nil {
 		return ""
@@ -257,6 +368,7 @@ type Toot struct {
 	SpoilerText string   `json:"spoiler_text"`
 	Visibility  string   `json:"visibility"`
 	ContentType string   `json:"content_type"`
+	LocalOnly   bool     `json:"local_only"`
 }
 
 // Mention hold information for mention.
@@ -319,61 +431,81 @@ type Emoji struct {
 type Results struct {
 	Accounts []*Account `json:"accounts"`
 	Statuses []*Status  `json:"statuses"`
-	// Hashtags []string   `json:"hashtags"`
+	Hashtags []*Tag     `json:"hashtags"`
 }
 
 // Pagination is a struct for specifying the get range.
+//
+// The list endpoints set it to the range of the neighbouring pages, as given
+// by the Link header of the response: MaxID for the older items, MinID and
+// SinceID for the newer ones. Result holds the two separately.
 type Pagination struct {
 	MaxID   string
 	SinceID string
 	MinID   string
 	Limit   int64
+	Result  *PagedResult
 }
 
-func newPagination(rawlink string) (*Pagination, error) {
+// PagedResult is the range of the pages before and after a list response.
+// Next is nil if there are no older items, Prev if there are no newer ones.
+type PagedResult struct {
+	Next *Pagination
+	Prev *Pagination
+}
+
+func newPagedResult(rawlink string) (*PagedResult, error) {
 	if rawlink == "" {
 		return nil, errors.New("empty link header")
 	}
 
-	p := &Pagination{}
+	r := &PagedResult{}
 	for _, link := range linkheader.Parse(rawlink) {
 		switch link.Rel {
-		case "next":
-			maxID, err := getPaginationID(link.URL, "max_id")
-			if err != nil {
-				return nil, err
-			}
-			p.MaxID = maxID
-		case "prev":
-			sinceID, err := getPaginationID(link.URL, "since_id")
+		case "next", "prev":
+			p, err := linkPagination(link.URL)
 			if err != nil {
 				return nil, err
 			}
-			p.SinceID = sinceID
-
-			minID, err := getPaginationID(link.URL, "min_id")
-			if err != nil {
-				return nil, err
+			if link.Rel == "next" {
+				r.Next = p
+			} else {
+				r.Prev = p
 			}
-			p.MinID = minID
 		}
 	}
-
-	return p, nil
+	return r, nil
 }
 
-func getPaginationID(rawurl, key string) (string, error) {
+func linkPagination(rawurl string) (*Pagination, error) {
 	u, err := url.Parse(rawurl)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	q := u.Query()
+	limit, _ := strconv.ParseInt(q.Get("limit"), 10, 64)
+	return &Pagination{
+		MaxID:   q.Get("max_id"),
+		SinceID: q.Get("since_id"),
+		MinID:   q.Get("min_id"),
+		Limit:   limit,
+	}, nil
+}
 
-	val := u.Query().Get(key)
-	if val == "" {
-		return "", nil
+func newPagination(rawlink string) (*Pagination, error) {
+	r, err := newPagedResult(rawlink)
+	if err != nil {
+		return nil, err
 	}
-
-	return string(val), nil
+	p := &Pagination{Result: r}
+	if r.Next != nil {
+		p.MaxID = r.Next.MaxID
+	}
+	if r.Prev != nil {
+		p.SinceID = r.Prev.SinceID
+		p.MinID = r.Prev.MinID
+	}
+	return p, nil
 }
 
 func (p *Pagination) toValues() url.Values {
@@ -20,6 +20,10 @@ type Notification struct {
 	Account   Account              `json:"account"`
 	Status    *Status              `json:"status"`
 	Pleroma   *NotificationPleroma `json:"pleroma"`
+
+	// Custom fields
+	Others   []Account `json:"others"`
+	OtherIDs []string  `json:"other_ids"`
 }
 
 // GetNotifications return notifications.
@@ -51,6 +55,11 @@ func (c *Client) ClearNotifications(ctx context.Context) error {
 	return c.doAPI(ctx, http.MethodPost, "/api/v1/notifications/clear", nil, nil, nil)
 }
 
+// DismissNotification dismiss a single notification.
+func (c *Client) DismissNotification(ctx context.Context, id string) error {
+	return c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/notifications/%s/dismiss", url.PathEscape(id)), nil, nil, nil)
+}
+
 // ReadNotifications marks notifications as read
 // Currenly only works for Pleroma
 func (c *Client) ReadNotifications(ctx context.Context, maxID string) error {
@@ -58,3 +67,75 @@ func (c *Client) ReadNotifications(ctx context.Context, maxID string) error {
 	params.Set("max_id", maxID)
 	return c.doAPI(ctx, http.MethodPost, "/api/v1/pleroma/notifications/read", params, nil, nil)
 }
+
+// NotificationRequest hold information for a group of filtered
+// notifications from a single account.
+type NotificationRequest struct {
+	ID                 string    `json:"id"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+	Account            Account   `json:"account"`
+	NotificationsCount string    `json:"notifications_count"`
+	LastStatus         *Status   `json:"last_status"`
+}
+
+// NotificationPolicy hold information for the notification filtering
+// policy. Values are one of "accept", "filter" or "drop".
+type NotificationPolicy struct {
+	ForNotFollowing    string `json:"for_not_following"`
+	ForNotFollowers    string `json:"for_not_followers"`
+	ForNewAccounts     string `json:"for_new_accounts"`
+	ForPrivateMentions string `json:"for_private_mentions"`
+	ForLimitedAccounts string `json:"for_limited_accounts"`
+	Summary            struct {
+		PendingRequestsCount      int64 `json:"pending_requests_count"`
+		PendingNotificationsCount int64 `json:"pending_notifications_count"`
+	} `json:"summary"`
+}
+
+// GetNotificationRequests return notification requests.
+func (c *Client) GetNotificationRequests(ctx context.Context, pg *Pagination) ([]*NotificationRequest, error) {
+	var requests []*NotificationRequest
+	err := c.doAPI(ctx, http.MethodGet, "/api/v1/notifications/requests", nil, &requests, pg)
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// AcceptNotificationRequest accept a notification request.
+func (c *Client) AcceptNotificationRequest(ctx context.Context, id string) error {
+	return c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/notifications/requests/%s/accept", url.PathEscape(id)), nil, nil, nil)
+}
+
+// DismissNotificationRequest dismiss a notification request.
+func (c *Client) DismissNotificationRequest(ctx context.Context, id string) error {
+	return c.doAPI(ctx, http.MethodPost, fmt.Sprintf("/api/v1/notifications/requests/%s/dismiss", url.PathEscape(id)), nil, nil, nil)
+}
+
+// GetNotificationPolicy return the notification policy.
+func (c *Client) GetNotificationPolicy(ctx context.Context) (*NotificationPolicy, error) {
+	var policy NotificationPolicy
+	err := c.doAPI(ctx, http.MethodGet, "/api/v2/notifications/policy", nil, &policy, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// UpdateNotificationPolicy update the notification policy.
+func (c *Client) UpdateNotificationPolicy(ctx context.Context, policy *NotificationPolicy) (*NotificationPolicy, error) {
+	params := url.Values{}
+	params.Set("for_not_following", policy.ForNotFollowing)
+	params.Set("for_not_followers", policy.ForNotFollowers)
+	params.Set("for_new_accounts", policy.ForNewAccounts)
+	params.Set("for_private_mentions", policy.ForPrivateMentions)
+	params.Set("for_limited_accounts", policy.ForLimitedAccounts)
+
+	var res NotificationPolicy
+	err := c.doAPI(ctx, http.MethodPatch, "/api/v2/notifications/policy", params, &res, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
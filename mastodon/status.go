@@ -40,6 +40,7 @@ type Status struct {
 	Sensitive          bool         `json:"sensitive"`
 	SpoilerText        string       `json:"spoiler_text"`
 	Visibility         string       `json:"visibility"`
+	LocalOnly          bool         `json:"local_only"`
 	MediaAttachments   []Attachment `json:"media_attachments"`
 	Mentions           []Mention    `json:"mentions"`
 	Tags               []Tag        `json:"tags"`
@@ -251,6 +252,25 @@ func (c *Client) GetTimelineMedia(ctx context.Context, isLocal bool, pg *Paginat
 
 // PostStatus post the toot.
 func (c *Client) PostStatus(ctx context.Context, toot *Toot) (*Status, error) {
+	return c.postStatus(ctx, toot, false)
+}
+
+// PreviewStatus returns the toot as it would be posted, without posting it.
+// Only Pleroma supports previews, other instances would post the toot, so
+// the instance is checked first and ErrPreviewUnsupported is returned if
+// it's not Pleroma.
+func (c *Client) PreviewStatus(ctx context.Context, toot *Toot) (*Status, error) {
+	instance, err := c.GetInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Pleroma == nil {
+		return nil, ErrPreviewUnsupported
+	}
+	return c.postStatus(ctx, toot, true)
+}
+
+func (c *Client) postStatus(ctx context.Context, toot *Toot, preview bool) (*Status, error) {
 	params := url.Values{}
 	params.Set("status", toot.Status)
 	if toot.InReplyToID != "" {
@@ -273,6 +293,13 @@ func (c *Client) PostStatus(ctx context.Context, toot *Toot) (*Status, error) {
 	if toot.ContentType != "" {
 		params.Set("content_type", toot.ContentType)
 	}
+	// Only supported by GoToSocial, Pleroma has the local visibility
+	if toot.LocalOnly {
+		params.Set("local_only", "true")
+	}
+	if preview {
+		params.Set("preview", "true")
+	}
 
 	var status Status
 	err := c.doAPI(ctx, http.MethodPost, "/api/v1/statuses", params, &status, nil)
@@ -336,6 +363,25 @@ func (c *Client) UploadMediaFromMultipartFileHeader(ctx context.Context, fh *mul
 	return &attachment, nil
 }
 
+// Media is a file to upload as a media attachment. Size is the length of the
+// data of Reader, or -1 if it's unknown.
+type Media struct {
+	Name        string
+	Description string
+	Size        int64
+	Reader      io.Reader
+}
+
+// UploadMediaFile uploads the media attachment m.
+func (c *Client) UploadMediaFile(ctx context.Context, m *Media) (*Attachment, error) {
+	var attachment Attachment
+	err := c.doAPI(ctx, http.MethodPost, "/api/v1/media", m, &attachment, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
 // GetTimelineDirect return statuses from direct timeline.
 func (c *Client) GetTimelineDirect(ctx context.Context, pg *Pagination) ([]*Status, error) {
 	params := url.Values{}
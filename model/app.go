@@ -18,4 +18,6 @@ type App struct {
 type AppRepo interface {
 	Add(app App) (err error)
 	Get(instanceDomain string) (app App, err error)
+	Remove(instanceDomain string)
+	List() (instanceDomains []string, err error)
 }
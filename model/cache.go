@@ -0,0 +1,19 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrCacheMiss = errors.New("not in cache")
+)
+
+// CacheRepo keeps data fetched from instances for a while, so that it's
+// shared between sessions and bloat instances using the same store.
+type CacheRepo interface {
+	Set(key string, val []byte, ttl time.Duration) (err error)
+	Get(key string) (val []byte, err error)
+	Remove(key string)
+	Clean() (err error)
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"errors"
+)
+
+var (
+	ErrFeedNotFound = errors.New("feed not found")
+)
+
+// Feed links a feed token to the session whose timelines it gives access
+// to. Feed readers can't sign in, so they authenticate with the token in
+// the URL of the feed instead of the session cookie.
+type Feed struct {
+	Token     string `json:"token"`
+	SessionID string `json:"session_id"`
+}
+
+type FeedRepo interface {
+	Add(feed Feed) (err error)
+	Get(token string) (feed Feed, err error)
+	Remove(token string)
+	List() (feeds []Feed, err error)
+}
@@ -10,6 +10,7 @@ type PostContext struct {
 	DefaultFormat     string
 	ReplyContext      *ReplyContext
 	Formats           []PostFormat
+	Content           string
 }
 
 type ReplyContext struct {
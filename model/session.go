@@ -2,6 +2,7 @@ package model
 
 import (
 	"errors"
+	"time"
 )
 
 var (
@@ -9,20 +10,52 @@ var (
 )
 
 type Session struct {
-	ID             string   `json:"id"`
-	UserID         string   `json:"user_id"`
-	InstanceDomain string   `json:"instance_domain"`
-	AccessToken    string   `json:"access_token"`
-	CSRFToken      string   `json:"csrf_token"`
-	Settings       Settings `json:"settings"`
+	ID              string   `json:"id"`
+	UserID          string   `json:"user_id"`
+	Acct            string   `json:"acct"`
+	InstanceDomain  string   `json:"instance_domain"`
+	AccessToken     string   `json:"access_token"`
+	CSRFToken       string   `json:"csrf_token"`
+	Settings        Settings `json:"settings"`
+	SeenVersion     string   `json:"seen_version"`
+	InstanceVersion string   `json:"instance_version"`
+	PostFormats     []string `json:"post_formats"`
+	FeedToken       string   `json:"feed_token"`
+	// UploadLimit is the size of the largest post accepted by the
+	// instance, 0 if it's unknown
+	UploadLimit int64 `json:"upload_limit,omitempty"`
+	// Expires is zero for sessions created before expiry was stored
+	Expires   time.Time `json:"expires"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used"`
+	UserAgent string    `json:"user_agent"`
+	// App is only set for sessions sealed into the session cookie
+	App *App `json:"app,omitempty"`
+	// Key is only set for sealed sessions, whose ID changes whenever
+	// they're saved, see Handle
+	Key string `json:"key,omitempty"`
 }
 
 type SessionRepo interface {
 	Add(session Session) (err error)
 	Get(sessionID string) (session Session, err error)
 	Remove(sessionID string)
+	List() (sessions []Session, err error)
 }
 
 func (s Session) IsLoggedIn() bool {
 	return len(s.AccessToken) > 0
 }
+
+// Handle returns a key for the state kept for the session, e.g. its rate
+// limits, which stays the same for sealed sessions too.
+func (s Session) Handle() string {
+	if len(s.Key) > 0 {
+		return s.Key
+	}
+	return s.ID
+}
+
+func (s Session) IsExpired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
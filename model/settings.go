@@ -1,17 +1,82 @@
 package model
 
+import (
+	"errors"
+)
+
+var (
+	ErrAccountSettingsNotFound = errors.New("account settings not found")
+)
+
+// ThemeAuto is the theme setting for using the dark theme only when the
+// browser prefers a dark color scheme.
+const ThemeAuto = "auto"
+
 type Settings struct {
-	DefaultVisibility    string `json:"default_visibility"`
-	DefaultFormat        string `json:"default_format"`
-	CopyScope            bool   `json:"copy_scope"`
-	ThreadInNewTab       bool   `json:"thread_in_new_tab"`
-	HideAttachments      bool   `json:"hide_attachments"`
-	MaskNSFW             bool   `json:"mask_nfsw"`
-	NotificationInterval int    `json:"notifications_interval"`
-	FluorideMode         bool   `json:"fluoride_mode"`
-	DarkMode             bool   `json:"dark_mode"`
-	AntiDopamineMode     bool   `json:"anti_dopamine_mode"`
-	CSS                  string `json:"css"`
+	DefaultVisibility    string   `json:"default_visibility"`
+	DefaultFormat        string   `json:"default_format"`
+	CopyScope            bool     `json:"copy_scope"`
+	ReplyOnlyAuthor      bool     `json:"reply_only_author"`
+	ReplyMentionSelf     bool     `json:"reply_mention_self"`
+	ReplyMentionsAtEnd   bool     `json:"reply_mentions_at_end"`
+	ThreadInNewTab       bool     `json:"thread_in_new_tab"`
+	HideAttachments      bool     `json:"hide_attachments"`
+	MaskNSFW             bool     `json:"mask_nfsw"`
+	NotificationInterval int      `json:"notifications_interval"`
+	FluorideMode         bool     `json:"fluoride_mode"`
+	InfiniteScroll       bool     `json:"infinite_scroll"`
+	DesktopNotifications bool     `json:"desktop_notifications"`
+	NotificationSound    bool     `json:"notification_sound"`
+	FaviconBadge         bool     `json:"favicon_badge"`
+	Theme                string   `json:"theme"`
+	DarkMode             bool     `json:"dark_mode"`
+	AntiDopamineMode     bool     `json:"anti_dopamine_mode"`
+	Timezone             string   `json:"timezone"`
+	TwelveHourClock      bool     `json:"twelve_hour_clock"`
+	AbsoluteTime         bool     `json:"absolute_time"`
+	CSS                  string   `json:"css"`
+	CSSSnippets          []string `json:"css_snippets"`
+}
+
+// AccountSettings are the defaults for posting and replying, which follow
+// the account to every browser it's signed in from. The rest of Settings is
+// about presentation and is kept per session, so that each browser can have
+// its own theme.
+type AccountSettings struct {
+	DefaultVisibility  string `json:"default_visibility"`
+	DefaultFormat      string `json:"default_format"`
+	CopyScope          bool   `json:"copy_scope"`
+	ReplyOnlyAuthor    bool   `json:"reply_only_author"`
+	ReplyMentionSelf   bool   `json:"reply_mention_self"`
+	ReplyMentionsAtEnd bool   `json:"reply_mentions_at_end"`
+}
+
+type AccountSettingsRepo interface {
+	Add(account string, settings AccountSettings) (err error)
+	Get(account string) (settings AccountSettings, err error)
+	Remove(account string)
+}
+
+// AccountSettings returns the account wide part of s.
+func (s *Settings) AccountSettings() AccountSettings {
+	return AccountSettings{
+		DefaultVisibility:  s.DefaultVisibility,
+		DefaultFormat:      s.DefaultFormat,
+		CopyScope:          s.CopyScope,
+		ReplyOnlyAuthor:    s.ReplyOnlyAuthor,
+		ReplyMentionSelf:   s.ReplyMentionSelf,
+		ReplyMentionsAtEnd: s.ReplyMentionsAtEnd,
+	}
+}
+
+// SetAccountSettings replaces the account wide part of s with a.
+func (s *Settings) SetAccountSettings(a AccountSettings) {
+	s.DefaultVisibility = a.DefaultVisibility
+	s.DefaultFormat = a.DefaultFormat
+	s.CopyScope = a.CopyScope
+	s.ReplyOnlyAuthor = a.ReplyOnlyAuthor
+	s.ReplyMentionSelf = a.ReplyMentionSelf
+	s.ReplyMentionsAtEnd = a.ReplyMentionsAtEnd
 }
 
 func NewSettings() *Settings {
@@ -19,13 +84,25 @@ func NewSettings() *Settings {
 		DefaultVisibility:    "public",
 		DefaultFormat:        "",
 		CopyScope:            true,
+		ReplyOnlyAuthor:      false,
+		ReplyMentionSelf:     false,
+		ReplyMentionsAtEnd:   false,
 		ThreadInNewTab:       false,
 		HideAttachments:      false,
 		MaskNSFW:             true,
 		NotificationInterval: 0,
 		FluorideMode:         false,
+		InfiniteScroll:       false,
+		DesktopNotifications: false,
+		NotificationSound:    false,
+		FaviconBadge:         false,
+		Theme:                "",
 		DarkMode:             false,
 		AntiDopamineMode:     false,
+		Timezone:             "",
+		TwelveHourClock:      false,
+		AbsoluteTime:         false,
 		CSS:                  "",
+		CSSSnippets:          nil,
 	}
 }
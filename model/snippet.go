@@ -0,0 +1,70 @@
+package model
+
+import "strings"
+
+type CSSSnippet struct {
+	ID          string
+	Name        string
+	Description string
+	CSS         string
+}
+
+// CSSSnippets is the library of optional CSS tweaks users can enable from
+// the settings page without writing any CSS themselves.
+var CSSSnippets = []CSSSnippet{
+	{
+		ID:          "hide_retweets",
+		Name:        "Hide retweets",
+		Description: "Hide retweeted posts from timelines",
+		CSS:         ".status-container-container.retweet { display: none; }",
+	},
+	{
+		ID:          "bigger_fonts",
+		Name:        "Bigger fonts",
+		Description: "Increase the font size of posts",
+		CSS: ".status-content, .status-dname, .status-uname " +
+			"{ font-size: 13pt; }",
+	},
+	{
+		ID:          "compact_mode",
+		Name:        "Compact mode",
+		Description: "Use smaller avatars and less space between posts",
+		CSS: ".status-container-container { margin-bottom: 4px; } " +
+			".status-container .status-profile-img { height: 32px; " +
+			"width: 32px; min-height: 32px; min-width: 32px; }",
+	},
+	{
+		ID:          "hide_avatars",
+		Name:        "Hide avatars",
+		Description: "Hide profile pictures in timelines",
+		CSS:         ".status-profile-img-container { display: none; }",
+	},
+}
+
+func IsCSSSnippet(id string) bool {
+	for _, s := range CSSSnippets {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ComposeCSS returns the CSS of the enabled snippets followed by the
+// user's own CSS, so that the latter can override the snippets.
+func ComposeCSS(ids []string, css string) string {
+	enabled := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		enabled[id] = true
+	}
+	var parts []string
+	for _, s := range CSSSnippets {
+		if enabled[s.ID] {
+			parts = append(parts, s.CSS)
+		}
+	}
+	if len(css) > 0 {
+		parts = append(parts, css)
+	}
+	return strings.Join(parts, "\n")
+}
@@ -1,21 +1,41 @@
 package renderer
 
 import (
+	"time"
+
 	"bloat/mastodon"
 	"bloat/model"
 )
 
+// Capabilities tells which of the optional features are supported by the
+// instance of the user, so that templates can leave out the controls of the
+// unsupported ones instead of showing buttons that fail.
+type Capabilities struct {
+	Bookmarks            bool
+	DismissNotifications bool
+	NotificationRequests bool
+	LocalVisibility      bool
+}
+
 type Context struct {
-	HideAttachments  bool
-	MaskNSFW         bool
-	FluorideMode     bool
-	ThreadInNewTab   bool
-	DarkMode         bool
-	CSRFToken        string
-	UserID           string
-	AntiDopamineMode bool
-	UserCSS          string
-	Referrer         string
+	HideAttachments      bool
+	MaskNSFW             bool
+	FluorideMode         bool
+	InfiniteScroll       bool
+	DesktopNotifications bool
+	NotificationSound    bool
+	FaviconBadge         bool
+	ThreadInNewTab       bool
+	Theme                string
+	CSRFToken            string
+	UserID               string
+	AntiDopamineMode     bool
+	UserCSS              string
+	Referrer             string
+	Capabilities         Capabilities
+	Location             *time.Location
+	TwelveHourClock      bool
+	AbsoluteTime         bool
 }
 
 type CommonData struct {
@@ -25,12 +45,28 @@ type CommonData struct {
 	Count           int
 	RefreshInterval int
 	Target          string
+	Meta            *Meta
+}
+
+// Meta is the OpenGraph metadata of a page, used by chat apps and social
+// networks for the previews of links to it.
+type Meta struct {
+	SiteName    string
+	Title       string
+	Description string
+	Image       string
+	URL         string
 }
 
 type NavData struct {
-	CommonData  *CommonData
-	User        *mastodon.Account
-	PostContext model.PostContext
+	CommonData   *CommonData
+	User         *mastodon.Account
+	PostContext  model.PostContext
+	WhatsNew     string
+	PollInterval int
+	Accounts     []string
+	// MultiAccount is set if other accounts can be signed in to
+	MultiAccount bool
 }
 
 type ErrorData struct {
@@ -38,6 +74,8 @@ type ErrorData struct {
 	Err        string
 	Retry      bool
 	SessionErr bool
+	// RequestID lets the users refer to the error in the logs
+	RequestID string
 }
 
 type HomePageData struct {
@@ -46,6 +84,8 @@ type HomePageData struct {
 
 type SigninData struct {
 	*CommonData
+	// Expired is set if the previous session was rejected by the instance
+	Expired bool
 }
 
 type RootData struct {
@@ -60,6 +100,7 @@ type TimelineData struct {
 	Statuses []*mastodon.Status
 	NextLink string
 	PrevLink string
+	ReadID   string
 }
 
 type ThreadData struct {
@@ -69,12 +110,30 @@ type ThreadData struct {
 	ReplyMap    map[string][]mastodon.ReplyInfo
 }
 
+// Notice is a failure of something bloat did for the user outside of the
+// page they were looking at, e.g. an import.
+type Notice struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
 type NotificationData struct {
 	*CommonData
 	Notifications []*mastodon.Notification
 	UnreadCount   int
 	ReadID        string
 	NextLink      string
+	PrevLink      string
+	PollInterval  int
+	Notices       []Notice
+}
+
+type NotificationRequestsData struct {
+	*CommonData
+	Requests []*mastodon.NotificationRequest
+	Policy   *mastodon.NotificationPolicy
+	NextLink string
+	PrevLink string
 }
 
 type UserData struct {
@@ -83,8 +142,10 @@ type UserData struct {
 	IsCurrent bool
 	Type      string
 	Users     []*mastodon.Account
+	Pinned    []*mastodon.Status
 	Statuses  []*mastodon.Status
 	NextLink  string
+	PrevLink  string
 }
 
 type UserSearchData struct {
@@ -97,6 +158,77 @@ type UserSearchData struct {
 
 type AboutData struct {
 	*CommonData
+	Instance   *mastodon.Instance
+	InstanceV2 *mastodon.InstanceV2
+}
+
+type CompatFeature struct {
+	Name      string
+	Supported bool
+}
+
+type VersionData struct {
+	*CommonData
+	Version         string
+	InstanceVersion string
+	Features        []CompatFeature
+}
+
+type ArchiveData struct {
+	*CommonData
+}
+
+// ImportResult is the outcome of importing an account of an account list,
+// with Error empty if it succeeded.
+type ImportResult struct {
+	Acct  string
+	Error string
+}
+
+type AccountListsData struct {
+	*CommonData
+	// List is the account list of the import, if any
+	List     string
+	Imported bool
+	Results  []ImportResult
+	// Rest is the CSV of the accounts left to import, Left their number
+	Rest  string
+	Left  int
+	Error string
+}
+
+type PreviewData struct {
+	*CommonData
+	Status         *mastodon.Status
+	PostContext    model.PostContext
+	HadAttachments bool
+	// Unformatted is set if the preview shows the content as plain text
+	// instead of in the chosen format
+	Unformatted bool
+}
+
+type FeedData struct {
+	Title    string
+	Website  string
+	Link     string
+	Updated  time.Time
+	Statuses []*mastodon.Status
+}
+
+type PublicStatusData struct {
+	*CommonData
+	Status *mastodon.Status
+}
+
+type PermalinkData struct {
+	*CommonData
+	Status *mastodon.Status
+}
+
+type ArchiveExportData struct {
+	User     *mastodon.Account
+	Statuses []*mastodon.Status
+	Date     time.Time
 }
 
 type EmojiData struct {
@@ -120,8 +252,10 @@ type SearchData struct {
 	*CommonData
 	Q        string
 	Type     string
+	From     string
 	Users    []*mastodon.Account
 	Statuses []*mastodon.Status
+	Hashtags []*mastodon.Tag
 	NextLink string
 }
 
@@ -129,6 +263,37 @@ type SettingsData struct {
 	*CommonData
 	Settings    *model.Settings
 	PostFormats []model.PostFormat
+	CSSSnippets []model.CSSSnippet
+	Themes      []string
+	Website     string
+	FeedToken   string
+
+	EnabledCSSSnippets map[string]bool
+}
+
+type DoActionData struct {
+	*CommonData
+	Action string
+	URL    string
+	Status *mastodon.Status
+}
+
+// SessionInfo describes a signed in session of the account. ID is a handle
+// of the session, not the session ID.
+type SessionInfo struct {
+	ID        string
+	Created   time.Time
+	LastUsed  time.Time
+	UserAgent string
+	Current   bool
+}
+
+type SessionsData struct {
+	*CommonData
+	Sessions []SessionInfo
+	// Sealed is set if the sessions are kept in the browsers, which can't
+	// be signed out from elsewhere then
+	Sealed bool
 }
 
 type FiltersData struct {
@@ -2,34 +2,52 @@ package renderer
 
 import (
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	"bloat/mastodon"
+	"bloat/util"
 )
 
 type Page string
 
 const (
-	SigninPage       = "signin.tmpl"
-	ErrorPage        = "error.tmpl"
-	NavPage          = "nav.tmpl"
-	RootPage         = "root.tmpl"
-	TimelinePage     = "timeline.tmpl"
-	ThreadPage       = "thread.tmpl"
-	NotificationPage = "notification.tmpl"
-	UserPage         = "user.tmpl"
-	UserSearchPage   = "usersearch.tmpl"
-	AboutPage        = "about.tmpl"
-	EmojiPage        = "emoji.tmpl"
-	LikedByPage      = "likedby.tmpl"
-	RetweetedByPage  = "retweetedby.tmpl"
-	SearchPage       = "search.tmpl"
-	SettingsPage     = "settings.tmpl"
-	FiltersPage      = "filters.tmpl"
+	SigninPage               = "signin.tmpl"
+	ErrorPage                = "error.tmpl"
+	NavPage                  = "nav.tmpl"
+	RootPage                 = "root.tmpl"
+	TimelinePage             = "timeline.tmpl"
+	TimelineStatusesPage     = "timeline-statuses"
+	ThreadPage               = "thread.tmpl"
+	NotificationPage         = "notification.tmpl"
+	NotificationRequestsPage = "notificationrequests.tmpl"
+	UserPage                 = "user.tmpl"
+	UserSearchPage           = "usersearch.tmpl"
+	AboutPage                = "about.tmpl"
+	VersionPage              = "version.tmpl"
+	ArchivePage              = "archive.tmpl"
+	ArchiveExportPage        = "archiveexport.tmpl"
+	AccountListsPage         = "accountlists.tmpl"
+	EmojiPage                = "emoji.tmpl"
+	LikedByPage              = "likedby.tmpl"
+	RetweetedByPage          = "retweetedby.tmpl"
+	SearchPage               = "search.tmpl"
+	SettingsPage             = "settings.tmpl"
+	FiltersPage              = "filters.tmpl"
+	SessionsPage             = "sessions.tmpl"
+	DoActionPage             = "doaction.tmpl"
+	PreviewPage              = "preview.tmpl"
+	FeedPage                 = "feed.tmpl"
+	PublicStatusPage         = "publicstatus.tmpl"
+	PermalinkPage            = "permalink.tmpl"
+	PostFormPage             = "postform.tmpl"
+	StatusPage               = "status.tmpl"
 )
 
 type TemplateData struct {
@@ -37,32 +55,45 @@ type TemplateData struct {
 	Ctx  *Context
 }
 
-func emojiFilter(content string, emojis []mastodon.Emoji) string {
+// emojiReplacements returns the shortcode to image replacements for emojis.
+// Emojis of remote statuses and accounts don't always come with both URLs
+// set, so the static URL is used as a fallback, and emojis without any URL
+// are left as plain shortcodes.
+func emojiReplacements(emojis []mastodon.Emoji, height int,
+	media func(string) string) []string {
 	var replacements []string
-	var r string
 	for _, e := range emojis {
-		r = fmt.Sprintf("<img class=\"emoji\" src=\"%s\" alt=\":%s:\" title=\":%s:\" height=\"24\" />",
-			e.URL, e.ShortCode, e.ShortCode)
+		src := e.URL
+		if len(src) < 1 {
+			src = e.StaticURL
+		}
+		if len(src) < 1 || len(e.ShortCode) < 1 {
+			continue
+		}
+		r := fmt.Sprintf("<img class=\"emoji\" src=\"%s\" alt=\":%s:\" title=\":%s:\" height=\"%d\" />",
+			html.EscapeString(media(src)), html.EscapeString(e.ShortCode),
+			html.EscapeString(e.ShortCode), height)
 		replacements = append(replacements, ":"+e.ShortCode+":", r)
 	}
+	return replacements
+}
+
+func emojiFilter(content string, emojis []mastodon.Emoji,
+	media func(string) string) string {
+	replacements := emojiReplacements(emojis, 24, media)
 	return strings.NewReplacer(replacements...).Replace(content)
 }
 
 func statusContentFilter(spoiler string, content string,
-	emojis []mastodon.Emoji, mentions []mastodon.Mention) string {
+	emojis []mastodon.Emoji, mentions []mastodon.Mention,
+	media func(string) string, base string) string {
 
-	var replacements []string
-	var r string
 	if len(spoiler) > 0 {
 		content = spoiler + "<br />" + content
 	}
-	for _, e := range emojis {
-		r = fmt.Sprintf("<img class=\"emoji\" src=\"%s\" alt=\":%s:\" title=\":%s:\" height=\"32\" />",
-			e.URL, e.ShortCode, e.ShortCode)
-		replacements = append(replacements, ":"+e.ShortCode+":", r)
-	}
+	replacements := emojiReplacements(emojis, 32, media)
 	for _, m := range mentions {
-		replacements = append(replacements, `"`+m.URL+`"`, `"/user/`+m.ID+`" title="@`+m.Acct+`"`)
+		replacements = append(replacements, `"`+m.URL+`"`, `"`+base+`/user/`+m.ID+`" title="@`+m.Acct+`"`)
 	}
 	return strings.NewReplacer(replacements...).Replace(content)
 }
@@ -123,6 +154,45 @@ func formatTimeRFC822(t time.Time) string {
 	return t.Format(time.RFC822)
 }
 
+// formatTime formats t for display, in the time zone and with the clock of
+// the user's settings.
+func formatTime(ctx *Context, t time.Time) string {
+	layout := "02 Jan 06 15:04 MST"
+	if ctx.TwelveHourClock {
+		layout = "02 Jan 06 3:04 PM MST"
+	}
+	if ctx.Location != nil {
+		t = t.In(ctx.Location)
+	}
+	return t.Format(layout)
+}
+
+// displayTimeSince and displayTimeUntil return the time relative to now, or
+// the full time if the user prefers it.
+func displayTimeSince(ctx *Context, t time.Time) string {
+	if ctx.AbsoluteTime {
+		return formatTime(ctx, t)
+	}
+	return timeSince(t)
+}
+
+func displayTimeUntil(ctx *Context, t time.Time) string {
+	if ctx.AbsoluteTime {
+		return formatTime(ctx, t)
+	}
+	return timeUntil(t)
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatInt(n>>20, 10) + "MB"
+	case n >= 1<<10:
+		return strconv.FormatInt(n>>10, 10) + "KB"
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
 func withContext(data interface{}, ctx *Context) TemplateData {
 	return TemplateData{data, ctx}
 }
@@ -133,29 +203,126 @@ type Renderer interface {
 
 type renderer struct {
 	template *template.Template
+	// parse is set if the templates are parsed again for every page
+	parse func() (*template.Template, error)
 }
 
-func NewRenderer(templateGlobPattern string) (r *renderer, err error) {
-	t := template.New("default")
-	t, err = t.Funcs(template.FuncMap{
-		"EmojiFilter":             emojiFilter,
-		"StatusContentFilter":     statusContentFilter,
-		"DisplayInteractionCount": displayInteractionCount,
-		"TimeSince":               timeSince,
-		"TimeUntil":               timeUntil,
-		"FormatTimeRFC3339":       formatTimeRFC3339,
-		"FormatTimeRFC822":        formatTimeRFC822,
-		"WithContext":             withContext,
-	}).ParseGlob(templateGlobPattern)
+// Options are the deployment specific settings of the renderer.
+type Options struct {
+	// Templates matching OverrideGlobPattern replace the ones of the same
+	// name. An empty pattern disables overrides.
+	OverrideGlobPattern string
+	// Remote media, avatars and custom emojis are loaded through bloat
+	MediaProxy  bool
+	AvatarCache bool
+	EmojiCache  bool
+	// Fingerprints of the static files, as returned by util.Fingerprint
+	StaticHashes map[string]string
+	// Parse the templates again for every page
+	Reload bool
+	// The path bloat is served under, e.g. "/bloat", which the links of
+	// the pages start with
+	BasePath string
+}
+
+// NewRenderer parses the templates in the root of templates, followed by the
+// overrides of opts. Template errors are returned here even with opts.Reload
+// set, so that bloat doesn't start with broken templates.
+func NewRenderer(templates fs.FS, opts Options) (r *renderer, err error) {
+	mediaProxy, avatarCache, emojiCache := opts.MediaProxy,
+		opts.AvatarCache, opts.EmojiCache
+	base := opts.BasePath
+	isRemote := func(u string) bool {
+		return strings.HasPrefix(u, "http://") ||
+			strings.HasPrefix(u, "https://")
+	}
+	media := func(u string) string {
+		if mediaProxy && isRemote(u) {
+			return base + util.ProxyPath(u)
+		}
+		return u
+	}
+	emoji := func(u string) string {
+		if emojiCache && isRemote(u) {
+			return base + util.EmojiPath(u)
+		}
+		return media(u)
+	}
+	avatar := func(u string, size int) string {
+		if avatarCache && isRemote(u) && util.AvatarSizes[size] {
+			return base + util.AvatarPath(u, size)
+		}
+		return media(u)
+	}
+	parse := func() (t *template.Template, err error) {
+		t = template.New("default")
+		t, err = t.Funcs(template.FuncMap{
+			"EmojiFilter": func(content string, emojis []mastodon.Emoji) string {
+				return emojiFilter(content, emojis, emoji)
+			},
+			"StatusContentFilter": func(spoiler string, content string,
+				emojis []mastodon.Emoji, mentions []mastodon.Mention) string {
+				return statusContentFilter(spoiler, content, emojis, mentions,
+					emoji, base)
+			},
+			"Media":                   media,
+			"Avatar":                  avatar,
+			"Emoji":                   emoji,
+			"DisplayInteractionCount": displayInteractionCount,
+			"TimeSince":               timeSince,
+			"TimeUntil":               timeUntil,
+			"FormatTimeRFC3339":       formatTimeRFC3339,
+			"FormatTimeRFC822":        formatTimeRFC822,
+			"FormatTime":              formatTime,
+			"DisplayTimeSince":        displayTimeSince,
+			"DisplayTimeUntil":        displayTimeUntil,
+			"FormatSize":              formatSize,
+			"WithContext":             withContext,
+			"HasSuffix":               strings.HasSuffix,
+			"Static": func(name string) string {
+				return base + util.StaticURL(opts.StaticHashes, name)
+			},
+			"Base": func() string {
+				return base
+			},
+		}).ParseFS(templates, "*")
+		if err != nil {
+			return
+		}
+		if len(opts.OverrideGlobPattern) > 0 {
+			var files []string
+			files, err = filepath.Glob(opts.OverrideGlobPattern)
+			if err != nil {
+				return
+			}
+			if len(files) > 0 {
+				t, err = t.ParseFiles(files...)
+				if err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+	t, err := parse()
 	if err != nil {
 		return
 	}
-	return &renderer{
-		template: t,
-	}, nil
+	r = &renderer{template: t}
+	if opts.Reload {
+		r.parse = parse
+	}
+	return
 }
 
 func (r *renderer) Render(ctx *Context, writer io.Writer,
 	page string, data interface{}) (err error) {
-	return r.template.ExecuteTemplate(writer, page, withContext(data, ctx))
+	t := r.template
+	if r.parse != nil {
+		t, err = r.parse()
+		if err != nil {
+			return
+		}
+	}
+	return t.ExecuteTemplate(writer, page, withContext(data, ctx))
 }
@@ -0,0 +1,48 @@
+package repo
+
+import (
+	"encoding/json"
+
+	"bloat/model"
+	"bloat/util"
+)
+
+type accountSettingsRepo struct {
+	db util.Store
+}
+
+func NewAccountSettingsRepo(db util.Store) *accountSettingsRepo {
+	return &accountSettingsRepo{
+		db: db,
+	}
+}
+
+func (repo *accountSettingsRepo) Add(account string,
+	s model.AccountSettings) (err error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	err = repo.db.Set(account, data)
+	return
+}
+
+func (repo *accountSettingsRepo) Get(account string) (s model.AccountSettings,
+	err error) {
+	data, err := repo.db.Get(account)
+	if err != nil {
+		err = model.ErrAccountSettingsNotFound
+		return
+	}
+
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (repo *accountSettingsRepo) Remove(account string) {
+	repo.db.Remove(account)
+}
@@ -8,16 +8,23 @@ import (
 )
 
 type appRepo struct {
-	db *util.Database
+	db util.Store
+	// The client secrets of the apps are encrypted with sealer, if it's set
+	sealer *util.Sealer
 }
 
-func NewAppRepo(db *util.Database) *appRepo {
+func NewAppRepo(db util.Store, sealer *util.Sealer) *appRepo {
 	return &appRepo{
-		db: db,
+		db:     db,
+		sealer: sealer,
 	}
 }
 
 func (repo *appRepo) Add(a model.App) (err error) {
+	a.ClientSecret, err = seal(repo.sealer, a.ClientSecret)
+	if err != nil {
+		return
+	}
 	data, err := json.Marshal(a)
 	if err != nil {
 		return
@@ -37,6 +44,23 @@ func (repo *appRepo) Get(instanceDomain string) (a model.App, err error) {
 	if err != nil {
 		return
 	}
+	// An app that can't be decrypted after the secret changed is
+	// registered again
+	a.ClientSecret, err = unseal(repo.sealer, a.ClientSecret)
+	if err != nil {
+		err = model.ErrAppNotFound
+		return
+	}
 
 	return
 }
+
+func (repo *appRepo) Remove(instanceDomain string) {
+	repo.db.Remove(instanceDomain)
+}
+
+// List returns the instances with a registered app, including the ones
+// whose app can't be decrypted.
+func (repo *appRepo) List() (instanceDomains []string, err error) {
+	return repo.db.Keys()
+}
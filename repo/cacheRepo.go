@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"encoding/json"
+	"time"
+
+	"bloat/model"
+	"bloat/util"
+)
+
+type cacheRepo struct {
+	db util.Store
+}
+
+type cacheEntry struct {
+	Expires time.Time `json:"expires"`
+	Data    []byte    `json:"data"`
+}
+
+func NewCacheRepo(db util.Store) *cacheRepo {
+	return &cacheRepo{
+		db: db,
+	}
+}
+
+func (repo *cacheRepo) Set(key string, val []byte, ttl time.Duration) (err error) {
+	data, err := json.Marshal(cacheEntry{
+		Expires: time.Now().Add(ttl),
+		Data:    val,
+	})
+	if err != nil {
+		return
+	}
+	return repo.db.Set(key, data)
+}
+
+func (repo *cacheRepo) get(key string) (e cacheEntry, err error) {
+	data, err := repo.db.Get(key)
+	if err != nil {
+		return e, model.ErrCacheMiss
+	}
+	err = json.Unmarshal(data, &e)
+	if err != nil || time.Now().After(e.Expires) {
+		repo.db.Remove(key)
+		return e, model.ErrCacheMiss
+	}
+	return
+}
+
+func (repo *cacheRepo) Get(key string) (val []byte, err error) {
+	e, err := repo.get(key)
+	if err != nil {
+		return
+	}
+	return e.Data, nil
+}
+
+func (repo *cacheRepo) Remove(key string) {
+	repo.db.Remove(key)
+}
+
+// Clean removes the expired entries.
+func (repo *cacheRepo) Clean() (err error) {
+	keys, err := repo.db.Keys()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		repo.get(key)
+	}
+	return
+}
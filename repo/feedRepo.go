@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"encoding/json"
+
+	"bloat/model"
+	"bloat/util"
+)
+
+type feedRepo struct {
+	db util.Store
+}
+
+func NewFeedRepo(db util.Store) *feedRepo {
+	return &feedRepo{
+		db: db,
+	}
+}
+
+func (repo *feedRepo) Add(f model.Feed) (err error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	err = repo.db.Set(f.Token, data)
+	return
+}
+
+func (repo *feedRepo) Get(token string) (f model.Feed, err error) {
+	data, err := repo.db.Get(token)
+	if err != nil {
+		err = model.ErrFeedNotFound
+		return
+	}
+
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (repo *feedRepo) Remove(token string) {
+	repo.db.Remove(token)
+	return
+}
+
+func (repo *feedRepo) List() (feeds []model.Feed, err error) {
+	keys, err := repo.db.Keys()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		f, err := repo.Get(key)
+		if err != nil {
+			continue
+		}
+		feeds = append(feeds, f)
+	}
+	return
+}
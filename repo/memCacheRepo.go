@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"sync"
+	"time"
+
+	"bloat/model"
+)
+
+type memCacheRepo struct {
+	m       sync.Mutex
+	entries map[string]memCacheEntry
+	// store keeps the entries too, if it's set
+	store *cacheRepo
+}
+
+type memCacheEntry struct {
+	expires time.Time
+	data    []byte
+}
+
+// NewMemCacheRepo returns a cache that keeps the entries in memory. With
+// store set, the entries are also kept in store, so that they're shared with
+// other bloat instances and kept across restarts, and the entries of store
+// are copied to memory on their first use.
+func NewMemCacheRepo(store *cacheRepo) *memCacheRepo {
+	return &memCacheRepo{
+		entries: make(map[string]memCacheEntry),
+		store:   store,
+	}
+}
+
+func (repo *memCacheRepo) Set(key string, val []byte, ttl time.Duration) (err error) {
+	repo.set(key, memCacheEntry{time.Now().Add(ttl), val})
+	if repo.store != nil {
+		err = repo.store.Set(key, val, ttl)
+	}
+	return
+}
+
+func (repo *memCacheRepo) set(key string, e memCacheEntry) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+	if len(repo.entries) > 1000 {
+		repo.clean()
+	}
+	repo.entries[key] = e
+}
+
+func (repo *memCacheRepo) Get(key string) (val []byte, err error) {
+	repo.m.Lock()
+	e, ok := repo.entries[key]
+	repo.m.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.data, nil
+	}
+	if repo.store == nil {
+		return nil, model.ErrCacheMiss
+	}
+	se, err := repo.store.get(key)
+	if err != nil {
+		return
+	}
+	repo.set(key, memCacheEntry{se.Expires, se.Data})
+	return se.Data, nil
+}
+
+func (repo *memCacheRepo) Remove(key string) {
+	repo.m.Lock()
+	delete(repo.entries, key)
+	repo.m.Unlock()
+	if repo.store != nil {
+		repo.store.Remove(key)
+	}
+}
+
+// Clean removes the expired entries.
+func (repo *memCacheRepo) Clean() (err error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+	repo.clean()
+	return
+}
+
+func (repo *memCacheRepo) clean() {
+	now := time.Now()
+	for k, e := range repo.entries {
+		if now.After(e.expires) {
+			delete(repo.entries, k)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+
+	"bloat/util"
+)
+
+// sealedPrefix marks the values encrypted with the storage secret. Values
+// without it were stored before the secret was set, and are encrypted the
+// next time they're stored.
+const sealedPrefix = "sealed:"
+
+var errNoSecret = errors.New("encrypted value, but no storage_secret is set")
+
+func seal(s *util.Sealer, v string) (string, error) {
+	if s == nil || len(v) < 1 {
+		return v, nil
+	}
+	sealed, err := s.Seal([]byte(v))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + sealed, nil
+}
+
+func unseal(s *util.Sealer, v string) (string, error) {
+	if !strings.HasPrefix(v, sealedPrefix) {
+		return v, nil
+	}
+	if s == nil {
+		return "", errNoSecret
+	}
+	data, err := s.Open(v[len(sealedPrefix):])
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -8,21 +8,36 @@ import (
 )
 
 type sessionRepo struct {
-	db *util.Database
+	db util.Store
+	// The tokens of the sessions are encrypted with sealer, if it's set
+	sealer *util.Sealer
 }
 
-func NewSessionRepo(db *util.Database) *sessionRepo {
+func NewSessionRepo(db util.Store, sealer *util.Sealer) *sessionRepo {
 	return &sessionRepo{
-		db: db,
+		db:     db,
+		sealer: sealer,
 	}
 }
 
 func (repo *sessionRepo) Add(s model.Session) (err error) {
+	id := s.ID
+	for _, v := range []*string{&s.AccessToken, &s.CSRFToken, &s.FeedToken} {
+		*v, err = seal(repo.sealer, *v)
+		if err != nil {
+			return
+		}
+	}
 	data, err := json.Marshal(s)
 	if err != nil {
 		return
 	}
-	err = repo.db.Set(s.ID, data)
+	// Stores that support it remove the session by themselves once it
+	// expires, instead of on its next use
+	if db, ok := repo.db.(util.ExpiringStore); ok && !s.Expires.IsZero() {
+		return db.SetExpiring(id, data, s.Expires)
+	}
+	err = repo.db.Set(id, data)
 	return
 }
 
@@ -37,6 +52,18 @@ func (repo *sessionRepo) Get(id string) (s model.Session, err error) {
 	if err != nil {
 		return
 	}
+	for _, v := range []*string{&s.AccessToken, &s.CSRFToken, &s.FeedToken} {
+		*v, err = unseal(repo.sealer, *v)
+		if err != nil {
+			return
+		}
+	}
+
+	if s.IsExpired() {
+		repo.db.Remove(id)
+		err = model.ErrSessionNotFound
+		return
+	}
 
 	return
 }
@@ -45,3 +72,19 @@ func (repo *sessionRepo) Remove(id string) {
 	repo.db.Remove(id)
 	return
 }
+
+// List returns all the sessions, skipping the expired ones.
+func (repo *sessionRepo) List() (sessions []model.Session, err error) {
+	keys, err := repo.db.Keys()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		s, err := repo.Get(key)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return
+}
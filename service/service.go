@@ -1,70 +1,279 @@
 package service
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bloat/mastodon"
 	"bloat/model"
 	"bloat/renderer"
 	"bloat/util"
+
+	"golang.org/x/sync/errgroup"
 )
 
 var (
 	errInvalidArgument  = errors.New("invalid argument")
 	errInvalidSession   = errors.New("invalid session")
 	errInvalidCSRFToken = errors.New("invalid csrf token")
+	errCrossOrigin      = errors.New("request from another site")
+	errAccountNotFound  = errors.New("account not found")
+	errStatusNotFound   = errors.New("status not found")
+	errRateLimited      = errors.New("too many requests")
+	errSessionTooLarge  = errors.New("session too large for a cookie")
+	errNoFeeds          = errors.New("feeds need sessions stored on the server")
+	errUploadTooLarge   = errors.New("upload too large")
+	errUploadNotFound   = errors.New("upload not found")
+	errAvatarNotFound   = errors.New("avatar not found")
+	errUnsupportedMedia = errors.New("unsupported media type")
+	errExportTooLarge   = errors.New("too much to export at once")
+	errArchiveTooLarge  = errors.New("media too large for the archive")
 )
 
 type service struct {
-	cname       string
-	cscope      string
-	cwebsite    string
-	css         string
-	instance    string
-	postFormats []model.PostFormat
-	renderer    renderer.Renderer
-	sessionRepo model.SessionRepo
-	appRepo     model.AppRepo
-}
-
-func NewService(cname string, cscope string, cwebsite string,
-	css string, instance string, postFormats []model.PostFormat,
-	renderer renderer.Renderer, sessionRepo model.SessionRepo,
-	appRepo model.AppRepo) *service {
+	cname        string
+	cscope       string
+	cwebsite     string
+	cappwebsite  string
+	css          string
+	instance     string
+	postFormats  []model.PostFormat
+	version      string
+	showWhatsNew bool
+	publicThread bool
+	themes       []string
+	renderer     renderer.Renderer
+	sessionRepo  model.SessionRepo
+	appRepo      model.AppRepo
+	cacheRepo    model.CacheRepo
+	feedRepo     model.FeedRepo
+	mediaProxy   *util.MediaProxy
+	avatarCache  *util.AvatarCache
+	emojiFetcher *util.MediaProxy
+	// fetcher gets remote media for bloat itself, e.g. for the archive
+	fetcher    *util.MediaProxy
+	httpClient *http.Client
+
+	// sessionExp is the lifetime of the sessions, which is extended on use
+	// with slidingExp set
+	sessionExp time.Duration
+	slidingExp bool
+	// Sessions are sealed into the session cookie instead of being stored,
+	// if sealer is set
+	sealer *util.Sealer
+	// accountSettingsRepo keeps the settings shared by the sessions of an
+	// account, see model.AccountSettings
+	accountSettingsRepo model.AccountSettingsRepo
+	// basePath is the path bloat is served under, e.g. "/bloat", which
+	// the links and redirects start with
+	basePath string
+	// The attributes of the cookies, see setCookie
+	cookieSecure   bool
+	cookieSameSite http.SameSite
+	// The requests that change something, i.e. the CSRF protected ones,
+	// are limited for each session by writeLimiter and for each address
+	// by writeIPLimiter, see allowWrite
+	writeLimiter   *util.Limiter
+	writeIPLimiter *util.Limiter
+	// maxUploadSize limits the body of the requests, 0 if there's no limit
+	// but the one of the instance, see parseForm
+	maxUploadSize int64
+	// uploadDir keeps the uploads in progress, see UploadChunk
+	uploadDir string
+	// The info and the custom emojis of the instances are kept in
+	// instanceCache for instanceCacheTTL
+	instanceCache    model.CacheRepo
+	instanceCacheTTL time.Duration
+	// relationshipCache keeps the relationships of the accounts to the
+	// accounts they look at, see relationship
+	relationshipCache model.CacheRepo
+
+	appMu sync.Mutex
+
+	suggestLimiter *util.Limiter
+	signinLimiter  *util.Limiter
+
+	rateLimitMu sync.Mutex
+	rateLimits  map[string]*mastodon.RateLimitError
+}
+
+// The images of custom emojis are cached for emojiImageCacheDuration. The
+// list of emojis is cached along with the instance info, see instanceData.
+const (
+	emojiImageCacheDuration = 7 * 24 * time.Hour
+	emojiImageMaxSize       = 1 << 20
+)
+
+// Suggestions are requested from the instance while typing, so each session
+// is limited to suggestRate requests per minute, and suggestBurst at once.
+const (
+	suggestRate  = 60
+	suggestBurst = 60
+)
+
+const sessionRefreshInterval = time.Hour
+
+// Each sign in may register an app with an arbitrary instance, so the sign
+// ins from each address are limited to signinRate per minute, and
+// signinBurst at once. The OAuth callback of a sign in counts as another one.
+const (
+	signinRate  = 2
+	signinBurst = 20
+)
+
+// Options are the settings and the dependencies of the service, see
+// NewService.
+type Options struct {
+	// The app registered with the instances
+	ClientName    string
+	ClientScope   string
+	ClientWebsite string
+	AppWebsite    string
+
+	CustomCSS string
+	// SingleInstance is the only instance that can be signed in to, if
+	// set
+	SingleInstance string
+	PostFormats    []model.PostFormat
+	Version        string
+	ShowWhatsNew   bool
+	PublicThreads  bool
+	Themes         []string
+	Renderer       renderer.Renderer
+
+	SessionRepo         model.SessionRepo
+	AppRepo             model.AppRepo
+	CacheRepo           model.CacheRepo
+	FeedRepo            model.FeedRepo
+	AccountSettingsRepo model.AccountSettingsRepo
+
+	MediaProxy   *util.MediaProxy
+	AvatarCache  *util.AvatarCache
+	EmojiFetcher *util.MediaProxy
+	Fetcher      *util.MediaProxy
+	HTTPClient   *http.Client
+
+	SessionLifetime time.Duration
+	SlidingSessions bool
+	// Sessions are sealed into the session cookie instead of being
+	// stored, if Sealer is set
+	Sealer *util.Sealer
+
+	BasePath       string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+
+	WriteLimiter   *util.Limiter
+	WriteIPLimiter *util.Limiter
+	MaxUploadSize  int64
+	UploadDir      string
+
+	InstanceCache     model.CacheRepo
+	InstanceCacheTTL  time.Duration
+	RelationshipCache model.CacheRepo
+}
+
+func NewService(o Options) *service {
 	return &service{
-		cname:       cname,
-		cscope:      cscope,
-		cwebsite:    cwebsite,
-		css:         css,
-		instance:    instance,
-		postFormats: postFormats,
-		renderer:    renderer,
-		sessionRepo: sessionRepo,
-		appRepo:     appRepo,
+		cname:          o.ClientName,
+		cscope:         o.ClientScope,
+		cwebsite:       o.ClientWebsite,
+		cappwebsite:    o.AppWebsite,
+		css:            o.CustomCSS,
+		instance:       o.SingleInstance,
+		postFormats:    o.PostFormats,
+		version:        o.Version,
+		showWhatsNew:   o.ShowWhatsNew,
+		publicThread:   o.PublicThreads,
+		themes:         o.Themes,
+		renderer:       o.Renderer,
+		sessionRepo:    o.SessionRepo,
+		appRepo:        o.AppRepo,
+		cacheRepo:      o.CacheRepo,
+		feedRepo:       o.FeedRepo,
+		mediaProxy:     o.MediaProxy,
+		avatarCache:    o.AvatarCache,
+		emojiFetcher:   o.EmojiFetcher,
+		fetcher:        o.Fetcher,
+		httpClient:     o.HTTPClient,
+		sessionExp:     o.SessionLifetime,
+		slidingExp:     o.SlidingSessions,
+		sealer:         o.Sealer,
+		suggestLimiter: util.NewLimiter(suggestRate, suggestBurst),
+		signinLimiter:  util.NewLimiter(signinRate, signinBurst),
+		rateLimits:     make(map[string]*mastodon.RateLimitError),
+
+		accountSettingsRepo: o.AccountSettingsRepo,
+		basePath:            o.BasePath,
+		cookieSecure:        o.CookieSecure,
+		cookieSameSite:      o.CookieSameSite,
+		writeLimiter:        o.WriteLimiter,
+		writeIPLimiter:      o.WriteIPLimiter,
+		maxUploadSize:       o.MaxUploadSize,
+		uploadDir:           o.UploadDir,
+		instanceCache:       o.InstanceCache,
+		instanceCacheTTL:    o.InstanceCacheTTL,
+		relationshipCache:   o.RelationshipCache,
 	}
 }
 
-func (s *service) authenticate(c *client, sid string, csrf string, ref string, t int) (err error) {
+func (s *service) authenticate(c *client, sid string, ref string, t int) (err error) {
 	var sett *model.Settings
 	defer func() {
 		if sett == nil {
 			sett = model.NewSettings()
 		}
+		// Times are shown in UTC unless a zone is set
+		loc := time.UTC
+		if l, err := time.LoadLocation(sett.Timezone); err == nil {
+			loc = l
+		}
+		theme := sett.Theme
+		// The dark theme used to be a checkbox
+		if len(theme) < 1 && sett.DarkMode {
+			theme = "dark"
+		}
 		c.rctx = &renderer.Context{
-			HideAttachments:  sett.HideAttachments,
-			MaskNSFW:         sett.MaskNSFW,
-			ThreadInNewTab:   sett.ThreadInNewTab,
-			FluorideMode:     sett.FluorideMode,
-			DarkMode:         sett.DarkMode,
-			CSRFToken:        c.s.CSRFToken,
-			UserID:           c.s.UserID,
-			AntiDopamineMode: sett.AntiDopamineMode,
-			UserCSS:          sett.CSS,
-			Referrer:         ref,
+			HideAttachments:      sett.HideAttachments,
+			MaskNSFW:             sett.MaskNSFW,
+			ThreadInNewTab:       sett.ThreadInNewTab,
+			FluorideMode:         sett.FluorideMode,
+			InfiniteScroll:       sett.InfiniteScroll,
+			DesktopNotifications: sett.DesktopNotifications,
+			NotificationSound:    sett.NotificationSound,
+			FaviconBadge:         sett.FaviconBadge,
+			Theme:                theme,
+			CSRFToken:            util.CSRFToken(c.s.CSRFToken, time.Now()),
+			UserID:               c.s.UserID,
+			AntiDopamineMode:     sett.AntiDopamineMode,
+			UserCSS:              model.ComposeCSS(sett.CSSSnippets, sett.CSS),
+			Referrer:             ref,
+			Capabilities:         capabilities(c.s.InstanceVersion),
+			Location:             loc,
+			TwelveHourClock:      sett.TwelveHourClock,
+			AbsoluteTime:         sett.AbsoluteTime,
 		}
 	}()
 	if t < SESSION {
@@ -73,12 +282,14 @@ func (s *service) authenticate(c *client, sid string, csrf string, ref string, t
 	if len(sid) < 1 {
 		return errInvalidSession
 	}
-	c.s, err = s.sessionRepo.Get(sid)
+	c.s, err = s.loadSession(sid)
 	if err != nil {
 		return errInvalidSession
 	}
+	s.refreshSession(c)
+	s.loadAccountSettings(&c.s)
 	sett = &c.s.Settings
-	app, err := s.appRepo.Get(c.s.InstanceDomain)
+	app, err := s.sessionApp(c.s)
 	if err != nil {
 		return err
 	}
@@ -87,13 +298,278 @@ func (s *service) authenticate(c *client, sid string, csrf string, ref string, t
 		ClientID:     app.ClientID,
 		ClientSecret: app.ClientSecret,
 		AccessToken:  c.s.AccessToken,
+		HTTPClient:   s.httpClient,
 	})
-	if t >= CSRF && (len(csrf) < 1 || csrf != c.s.CSRFToken) {
-		return errInvalidCSRFToken
+	if t >= CSRF {
+		if !s.sameOrigin(c.r) {
+			return errCrossOrigin
+		}
+		err = s.parseForm(c)
+		if err != nil {
+			return
+		}
+		csrf := c.r.FormValue("csrf_token")
+		if !util.ValidCSRFToken(c.s.CSRFToken, csrf, time.Now()) {
+			return errInvalidCSRFToken
+		}
+		if !s.allowWrite(c) {
+			return errRateLimited
+		}
+	}
+	return
+}
+
+// Memory to keep the files of a form in, larger ones are kept in temporary
+// files rather than taking up memory until they're sent to the instance.
+const maxFormMemory = 1 << 20
+
+// Besides the attachments, the form of a post is given uploadFormSize bytes.
+const uploadFormSize = 1 << 20
+
+// instanceUploadLimit returns the size of the largest post with attachments
+// accepted by the instance, or 0 if it's unknown.
+func instanceUploadLimit(instance *mastodon.Instance) int64 {
+	size, count := instance.MediaLimits()
+	if size < 1 {
+		return 0
+	}
+	return size*count + uploadFormSize
+}
+
+// parseForm parses the form of c. The body is limited to the upload limit of
+// the instance of the session and to maxUploadSize, so that larger uploads
+// are refused before they're buffered.
+func (s *service) parseForm(c *client) error {
+	limit := s.uploadLimit(c)
+	var body *limitedBody
+	if limit > 0 {
+		if c.r.ContentLength > limit {
+			return uploadTooLarge(c, limit)
+		}
+		body = &limitedBody{ReadCloser: c.r.Body, left: limit}
+		c.r.Body = body
+	}
+	err := c.r.ParseMultipartForm(maxFormMemory)
+	if body != nil && body.exceeded {
+		return uploadTooLarge(c, limit)
+	}
+	if err != nil && err != http.ErrNotMultipart {
+		return errInvalidArgument
+	}
+	return nil
+}
+
+// uploadLimit returns the size of the largest upload of the session of c, 0
+// if there's no limit.
+func (s *service) uploadLimit(c *client) int64 {
+	limit := s.maxUploadSize
+	if l := c.s.UploadLimit; l > 0 && (limit < 1 || l < limit) {
+		limit = l
+	}
+	return limit
+}
+
+// uploadTooLarge returns the error of an upload larger than limit. The
+// connection is closed, rather than reading the rest of the upload.
+func uploadTooLarge(c *client, limit int64) error {
+	c.w.Header().Set("Connection", "close")
+	return fmt.Errorf("%w, the limit is %dMB", errUploadTooLarge, limit>>20)
+}
+
+// limitedBody fails the reads once more than left bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	if b.exceeded {
+		return 0, errUploadTooLarge
+	}
+	// One byte more than left tells if the body is too large
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err = b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		b.exceeded = true
+		return n - 1, errUploadTooLarge
+	}
+	return
+}
+
+// sameOrigin reports whether the request comes from a page of bloat, going
+// by the Origin header, or by the Referer header without one. Requests with
+// neither are let through, as some browsers and extensions leave both out,
+// and the CSRF token still has to match.
+func (s *service) sameOrigin(r *http.Request) bool {
+	src := r.Header.Get("Origin")
+	if len(src) < 1 {
+		src = r.Referer()
+	}
+	if len(src) < 1 {
+		return true
+	}
+	// Sandboxed pages and some redirects have the "null" origin
+	u, err := url.Parse(src)
+	if err != nil || len(u.Host) < 1 {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	w, err := url.Parse(s.cwebsite)
+	return err == nil && u.Scheme == w.Scheme && u.Host == w.Host
+}
+
+// refreshSession records the use of the session. Sessions without an expiry
+// get one, and sliding sessions have their expiry pushed back. The session is
+// written at most once per sessionRefreshInterval, so that it isn't written
+// on every request.
+func (s *service) refreshSession(c *client) {
+	now := time.Now()
+	if !c.s.Expires.IsZero() &&
+		now.Sub(c.s.LastUsed) < sessionRefreshInterval {
+		return
+	}
+	// Feed readers authenticate with the feed token and must not get the
+	// session cookie
+	cookie, _ := c.r.Cookie("session_id")
+	browser := cookie != nil && cookie.Value == c.s.ID
+	c.s.LastUsed = now
+	if browser {
+		c.s.UserAgent = c.r.UserAgent()
+	}
+	if c.s.Expires.IsZero() || s.slidingExp {
+		c.s.Expires = now.Add(s.sessionExp)
+	}
+	if s.saveSession(c, &c.s) == nil && browser && s.slidingExp &&
+		s.sealer == nil {
+		s.setSessionCookie(c, c.s.ID, s.sessionExp)
+	}
+}
+
+// accountSettingsKey returns the key of the account settings of the account
+// signed in to sess. The ID is used as the username may change.
+func accountSettingsKey(sess model.Session) string {
+	return sess.UserID + "@" + sess.InstanceDomain
+}
+
+// loadAccountSettings replaces the account wide settings of sess with the
+// ones stored for the account, which may have been changed from another
+// browser. Sealed sessions keep all of their settings, as the database isn't
+// shared by the bloat servers then.
+func (s *service) loadAccountSettings(sess *model.Session) {
+	if s.sealer != nil || !sess.IsLoggedIn() {
+		return
+	}
+	a, err := s.accountSettingsRepo.Get(accountSettingsKey(*sess))
+	if err == nil {
+		sess.Settings.SetAccountSettings(a)
+	}
+}
+
+// The longest session cookie that browsers are sure to keep
+const maxSessionCookie = 4000
+
+// loadSession returns the session with the ID. Sealed sessions are their own
+// ID.
+func (s *service) loadSession(id string) (sess model.Session, err error) {
+	if s.sealer == nil {
+		return s.sessionRepo.Get(id)
+	}
+	data, err := s.sealer.Open(id)
+	if err != nil {
+		return sess, model.ErrSessionNotFound
+	}
+	err = json.Unmarshal(data, &sess)
+	if err != nil {
+		return
+	}
+	if sess.IsExpired() {
+		return sess, model.ErrSessionNotFound
+	}
+	sess.ID = id
+	return
+}
+
+// saveSession stores sess. A sealed session gets a new ID, and the session
+// cookie is replaced if it's the session of the request.
+func (s *service) saveSession(c *client, sess *model.Session) (err error) {
+	if s.sealer == nil {
+		return s.sessionRepo.Add(*sess)
+	}
+	id := sess.ID
+	current := len(id) > 0 && id == c.s.ID
+	if len(sess.Key) < 1 {
+		sess.Key, err = util.NewRandID(16)
+		if err != nil {
+			return
+		}
+	}
+	sealed := *sess
+	sealed.ID = ""
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return
+	}
+	v, err := s.sealer.Seal(data)
+	if err != nil {
+		return
+	}
+	if len(v) > maxSessionCookie {
+		return errSessionTooLarge
+	}
+	sess.ID = v
+	if current {
+		c.s.ID = v
+		c.s.Key = sess.Key
+		s.setSessionCookie(c, v, s.sessionExp)
+	}
+	return
+}
+
+// sessionApp returns the app of the instance of the session. Sealed sessions
+// carry the app, so that any bloat server with the same secret can serve
+// them.
+func (s *service) sessionApp(sess model.Session) (model.App, error) {
+	if sess.App != nil {
+		return *sess.App, nil
+	}
+	return s.appRepo.Get(sess.InstanceDomain)
+}
+
+// authenticateFeed authenticates the requests of feed readers, which come
+// with the feed token of the session instead of the session cookie.
+func (s *service) authenticateFeed(c *client, token string) (err error) {
+	if len(token) < 1 {
+		return errInvalidSession
+	}
+	f, err := s.feedRepo.Get(token)
+	if err != nil {
+		return errInvalidSession
+	}
+	err = s.authenticate(c, f.SessionID, "", SESSION)
+	if err != nil {
+		return
+	}
+	// The token may have been replaced since
+	if c.s.FeedToken != token {
+		return errInvalidSession
 	}
 	return
 }
 
+// render writes the page, or its data as JSON if the client asked for JSON.
+func (s *service) render(c *client, page string, data interface{}) error {
+	if c.wantJSON {
+		return writeJson(c, data)
+	}
+	return s.renderer.Render(c.rctx, c.w, page, data)
+}
+
 func (s *service) cdata(c *client, title string, count int, rinterval int,
 	target string) (data *renderer.CommonData) {
 	data = &renderer.CommonData{
@@ -104,7 +580,7 @@ func (s *service) cdata(c *client, title string, count int, rinterval int,
 		Target:          target,
 	}
 	if c != nil && c.s.IsLoggedIn() {
-		data.CSRFToken = c.s.CSRFToken
+		data.CSRFToken = util.CSRFToken(c.s.CSRFToken, time.Now())
 	}
 	return
 }
@@ -124,26 +600,63 @@ func (s *service) ErrorPage(c *client, err error, retry bool) error {
 		Err:        errStr,
 		Retry:      retry,
 		SessionErr: sessionErr,
+		RequestID:  util.RequestID(c.ctx),
 	}
 	return s.renderer.Render(c.rctx, c.w, renderer.ErrorPage, data)
 }
 
-func (s *service) SigninPage(c *client) (err error) {
+func (s *service) SigninPage(c *client, expired bool) (err error) {
 	cdata := s.cdata(nil, "signin", 0, 0, "")
 	data := &renderer.SigninData{
 		CommonData: cdata,
+		Expired:    expired,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.SigninPage, data)
+	return s.render(c, renderer.SigninPage, data)
 }
 
 func (s *service) RootPage(c *client) (err error) {
 	data := &renderer.RootData{
 		Title: s.cname,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.RootPage, data)
+	return s.render(c, renderer.RootPage, data)
+}
+
+// OtherSessions returns the signed in sessions with the given IDs, which
+// are the other accounts signed in from the same browser.
+func (s *service) OtherSessions(ids []string) (sessions []model.Session) {
+	// Sealed sessions are too large to keep several of them in a cookie,
+	// see keepSession
+	if s.sealer != nil {
+		return
+	}
+	for _, id := range ids {
+		sess, err := s.loadSession(id)
+		if err == nil && sess.IsLoggedIn() {
+			sessions = append(sessions, sess)
+		}
+	}
+	return
+}
+
+// instancePostFormats returns the configured post formats accepted by the
+// instance of the user. All of them are returned if the instance is unknown,
+// e.g. for sessions created by older versions of bloat.
+func (s *service) instancePostFormats(c *client) (formats []model.PostFormat) {
+	if len(c.s.InstanceVersion) < 1 {
+		return s.postFormats
+	}
+	for _, f := range s.postFormats {
+		for _, t := range c.s.PostFormats {
+			if f.Type == t {
+				formats = append(formats, f)
+				break
+			}
+		}
+	}
+	return
 }
 
-func (s *service) NavPage(c *client) (err error) {
+func (s *service) NavPage(c *client, sessionIDs []string) (err error) {
 	u, err := c.GetAccountCurrentUser(c.ctx)
 	if err != nil {
 		return
@@ -151,49 +664,72 @@ func (s *service) NavPage(c *client) (err error) {
 	pctx := model.PostContext{
 		DefaultVisibility: c.s.Settings.DefaultVisibility,
 		DefaultFormat:     c.s.Settings.DefaultFormat,
-		Formats:           s.postFormats,
+		Formats:           s.instancePostFormats(c),
+	}
+	var whatsNew string
+	if s.showWhatsNew && c.s.SeenVersion != s.version {
+		whatsNew = s.version
 	}
 	cdata := s.cdata(c, "nav", 0, 0, "main")
-	data := &renderer.NavData{
-		User:        u,
-		CommonData:  cdata,
-		PostContext: pctx,
+	var pollInterval int
+	if c.s.Settings.FluorideMode {
+		pollInterval = c.s.Settings.NotificationInterval
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.NavPage, data)
+	var accounts []string
+	for _, sess := range s.OtherSessions(sessionIDs) {
+		accounts = append(accounts, sess.Acct)
+	}
+	data := &renderer.NavData{
+		User:         u,
+		CommonData:   cdata,
+		PostContext:  pctx,
+		WhatsNew:     whatsNew,
+		PollInterval: pollInterval,
+		Accounts:     accounts,
+		MultiAccount: s.sealer == nil,
+	}
+	return s.render(c, renderer.NavPage, data)
 }
 
-func (s *service) TimelinePage(c *client, tType string, instance string,
-	maxID string, minID string) (err error) {
-
-	var nextLink, prevLink, title string
-	var statuses []*mastodon.Status
-	var pg = mastodon.Pagination{
-		MaxID: maxID,
-		MinID: minID,
-		Limit: 20,
-	}
+func (s *service) timeline(c *client, tType string, instance string,
+	pg *mastodon.Pagination) (statuses []*mastodon.Status, title string,
+	err error) {
 
 	switch tType {
 	default:
-		return errInvalidArgument
+		return nil, "", errInvalidArgument
 	case "home":
-		statuses, err = c.GetTimelineHome(c.ctx, &pg)
+		statuses, err = c.GetTimelineHome(c.ctx, pg)
 		title = "Timeline"
 	case "direct":
-		statuses, err = c.GetTimelineDirect(c.ctx, &pg)
+		statuses, err = c.GetTimelineDirect(c.ctx, pg)
 		title = "Direct Timeline"
 	case "local":
-		statuses, err = c.GetTimelinePublic(c.ctx, true, "", &pg)
+		statuses, err = c.GetTimelinePublic(c.ctx, true, "", pg)
 		title = "Local Timeline"
 	case "remote":
 		if len(instance) > 0 {
-			statuses, err = c.GetTimelinePublic(c.ctx, false, instance, &pg)
+			statuses, err = c.GetTimelinePublic(c.ctx, false, instance, pg)
 		}
 		title = "Remote Timeline"
 	case "twkn":
-		statuses, err = c.GetTimelinePublic(c.ctx, false, "", &pg)
+		statuses, err = c.GetTimelinePublic(c.ctx, false, "", pg)
 		title = "The Whole Known Network"
 	}
+	return
+}
+
+func (s *service) TimelinePage(c *client, tType string, instance string,
+	maxID string, minID string) (err error) {
+
+	var req = mastodon.Pagination{
+		MaxID: maxID,
+		MinID: minID,
+		Limit: 20,
+	}
+	pg := req
+
+	statuses, title, err := s.timeline(c, tType, instance, &pg)
 	if err != nil {
 		return err
 	}
@@ -204,22 +740,17 @@ func (s *service) TimelinePage(c *client, tType string, instance string,
 		}
 	}
 
-	if (len(maxID) > 0 || len(minID) > 0) && len(statuses) > 0 {
-		v := make(url.Values)
-		v.Set("min_id", statuses[0].ID)
-		if len(instance) > 0 {
-			v.Set("instance", instance)
-		}
-		prevLink = "/timeline/" + tType + "?" + v.Encode()
+	var v url.Values
+	if len(instance) > 0 {
+		v = url.Values{"instance": {instance}}
 	}
+	prevLink, nextLink := pageLinks("/timeline/"+tType, v, req, pg,
+		len(statuses))
 
-	if len(minID) > 0 || (len(pg.MaxID) > 0 && len(statuses) == 20) {
-		v := make(url.Values)
-		v.Set("max_id", pg.MaxID)
-		if len(instance) > 0 {
-			v.Set("instance", instance)
-		}
-		nextLink = "/timeline/" + tType + "?" + v.Encode()
+	var readID string
+	if tType == "home" {
+		readID = s.updateHomeMarker(c, statuses,
+			len(maxID) < 1 && len(minID) < 1)
 	}
 
 	cdata := s.cdata(c, tType+" timeline ", 0, 0, "")
@@ -230,9 +761,131 @@ func (s *service) TimelinePage(c *client, tType string, instance string,
 		Statuses:   statuses,
 		NextLink:   nextLink,
 		PrevLink:   prevLink,
+		ReadID:     readID,
 		CommonData: cdata,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.TimelinePage, data)
+	return s.render(c, renderer.TimelinePage, data)
+}
+
+// pageLinks returns the links to the items newer and older than the ones
+// fetched with the pagination req, as given by the Link header of the
+// response in res. n is the number of fetched items. The link to newer items
+// is left out on the first page, and the one to older items after a page
+// that isn't full.
+func pageLinks(path string, v url.Values, req mastodon.Pagination,
+	res mastodon.Pagination, n int) (prevLink string, nextLink string) {
+
+	link := func(key string, id string) string {
+		q := make(url.Values)
+		for k, vs := range v {
+			q[k] = vs
+		}
+		q.Set(key, id)
+		return path + "?" + q.Encode()
+	}
+	r := res.Result
+	if r == nil {
+		return
+	}
+	if p := r.Prev; p != nil && n > 0 &&
+		(len(req.MaxID) > 0 || len(req.MinID) > 0) {
+		// Older instances only give since_id for the newer items
+		newer := p.MinID
+		if len(newer) < 1 {
+			newer = p.SinceID
+		}
+		if len(newer) > 0 {
+			prevLink = link("min_id", newer)
+		}
+	}
+	if p := r.Next; p != nil && len(p.MaxID) > 0 &&
+		(len(req.MinID) > 0 || int64(n) >= req.Limit) {
+		nextLink = link("max_id", p.MaxID)
+	}
+	return
+}
+
+// TimelineStatuses returns the rendered statuses of the timeline page after
+// maxID and the link to the page after them, for appending the page to an
+// already loaded timeline.
+func (s *service) TimelineStatuses(c *client, tType string, instance string,
+	maxID string) (content string, nextLink string, err error) {
+
+	var req = mastodon.Pagination{
+		MaxID: maxID,
+		Limit: 20,
+	}
+	pg := req
+
+	statuses, _, err := s.timeline(c, tType, instance, &pg)
+	if err != nil {
+		return
+	}
+
+	for i := range statuses {
+		if statuses[i].Reblog != nil {
+			statuses[i].Reblog.RetweetedByID = statuses[i].ID
+		}
+	}
+
+	var v url.Values
+	if len(instance) > 0 {
+		v = url.Values{"instance": {instance}}
+	}
+	_, nextLink = pageLinks("/timeline/"+tType, v, req, pg, len(statuses))
+
+	data := &renderer.TimelineData{
+		Type:     tType,
+		Instance: instance,
+		Statuses: statuses,
+	}
+	var buf bytes.Buffer
+	err = s.renderer.Render(c.rctx, &buf, renderer.TimelineStatusesPage, data)
+	if err != nil {
+		return
+	}
+	return buf.String(), nextLink, nil
+}
+
+// isNewer reports whether the ID a is newer than the ID b. IDs are compared
+// by length first, as they're numeric strings on Mastodon.
+func isNewer(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// updateHomeMarker returns the ID of the first of the statuses which was
+// already read when the home timeline was last seen, if some statuses are
+// newer than it. If latest is set, the marker is moved to the newest status.
+// Markers are shared with other clients, errors are ignored as not all
+// instances support them.
+func (s *service) updateHomeMarker(c *client, statuses []*mastodon.Status,
+	latest bool) (readID string) {
+
+	markers, err := c.GetMarkers(c.ctx, []string{"home"})
+	if err != nil {
+		return
+	}
+	var lastReadID string
+	if m, ok := markers["home"]; ok && m != nil {
+		lastReadID = m.LastReadID
+	}
+	if len(lastReadID) > 0 {
+		for i, st := range statuses {
+			if !isNewer(st.ID, lastReadID) {
+				if i > 0 {
+					readID = st.ID
+				}
+				break
+			}
+		}
+	}
+	if latest && len(statuses) > 0 && isNewer(statuses[0].ID, lastReadID) {
+		c.SetMarker(c.ctx, "home", statuses[0].ID)
+	}
+	return
 }
 
 func addToReplyMap(m map[string][]mastodon.ReplyInfo, key interface{},
@@ -248,55 +901,77 @@ func addToReplyMap(m map[string][]mastodon.ReplyInfo, key interface{},
 	if !ok {
 		m[keyStr] = []mastodon.ReplyInfo{}
 	}
-	m[keyStr] = append(m[keyStr], mastodon.ReplyInfo{val, number})
+	m[keyStr] = append(m[keyStr], mastodon.ReplyInfo{ID: val, Number: number})
 }
 
-func (s *service) ThreadPage(c *client, id string, reply bool) (err error) {
-	var pctx model.PostContext
+// replyPostContext returns the context of the post form for replying to
+// status, with the mentions and the visibility of the user's settings.
+func (s *service) replyPostContext(c *client,
+	status *mastodon.Status) model.PostContext {
 
-	status, err := c.GetStatus(c.ctx, id)
-	if err != nil {
-		return
+	var content string
+	var visibility string
+	sett := &c.s.Settings
+	if c.s.UserID != status.Account.ID || sett.ReplyMentionSelf {
+		content += "@" + status.Account.Acct + " "
 	}
-
-	if reply {
-		var content string
-		var visibility string
-		if c.s.UserID != status.Account.ID {
-			content += "@" + status.Account.Acct + " "
-		}
+	if !sett.ReplyOnlyAuthor {
 		for i := range status.Mentions {
-			if status.Mentions[i].ID != c.s.UserID &&
+			if (status.Mentions[i].ID != c.s.UserID ||
+				sett.ReplyMentionSelf) &&
 				status.Mentions[i].ID != status.Account.ID {
 				content += "@" + status.Mentions[i].Acct + " "
 			}
 		}
+	}
+	if sett.ReplyMentionsAtEnd && len(content) > 0 {
+		// Leave room for the reply above the mentions
+		content = "\n\n" + strings.TrimSpace(content)
+	}
 
-		isDirect := status.Visibility == "direct"
-		if isDirect || c.s.Settings.CopyScope {
-			visibility = status.Visibility
-		} else {
-			visibility = c.s.Settings.DefaultVisibility
-		}
+	isDirect := status.Visibility == "direct"
+	if isDirect || c.s.Settings.CopyScope {
+		visibility = status.Visibility
+	} else {
+		visibility = c.s.Settings.DefaultVisibility
+	}
 
-		pctx = model.PostContext{
-			DefaultVisibility: visibility,
-			DefaultFormat:     c.s.Settings.DefaultFormat,
-			Formats:           s.postFormats,
-			ReplyContext: &model.ReplyContext{
-				InReplyToID:     id,
-				InReplyToName:   status.Account.Acct,
-				ReplyContent:    content,
-				ForceVisibility: isDirect,
-			},
-		}
+	return model.PostContext{
+		DefaultVisibility: visibility,
+		DefaultFormat:     c.s.Settings.DefaultFormat,
+		Formats:           s.instancePostFormats(c),
+		ReplyContext: &model.ReplyContext{
+			InReplyToID:     status.ID,
+			InReplyToName:   status.Account.Acct,
+			ReplyContent:    content,
+			ForceVisibility: isDirect,
+		},
 	}
+}
+
+func (s *service) ThreadPage(c *client, id string, reply bool) (err error) {
+	var pctx model.PostContext
+	var status *mastodon.Status
+	var context *mastodon.Context
 
-	context, err := c.GetStatusContext(c.ctx, id)
+	g, gc := errGroup(c)
+	g.Go(func() (err error) {
+		status, err = gc.GetStatus(gc.ctx, id)
+		return
+	})
+	g.Go(func() (err error) {
+		context, err = gc.GetStatusContext(gc.ctx, id)
+		return
+	})
+	err = g.Wait()
 	if err != nil {
 		return
 	}
 
+	if reply {
+		pctx = s.replyPostContext(c, status)
+	}
+
 	statuses := append(append(context.Ancestors, status), context.Descendants...)
 	replies := make(map[string][]mastodon.ReplyInfo)
 	idNumbers := make(map[string]int)
@@ -312,13 +987,14 @@ func (s *service) ThreadPage(c *client, id string, reply bool) (err error) {
 	}
 
 	cdata := s.cdata(c, "post by "+status.Account.DisplayName, 0, 0, "")
+	cdata.Meta = s.statusMeta(status)
 	data := &renderer.ThreadData{
 		Statuses:    statuses,
 		PostContext: pctx,
 		ReplyMap:    replies,
 		CommonData:  cdata,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.ThreadPage, data)
+	return s.render(c, renderer.ThreadPage, data)
 }
 
 func (s *service) LikedByPage(c *client, id string) (err error) {
@@ -331,7 +1007,7 @@ func (s *service) LikedByPage(c *client, id string) (err error) {
 		CommonData: cdata,
 		Users:      likers,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.LikedByPage, data)
+	return s.render(c, renderer.LikedByPage, data)
 }
 
 func (s *service) RetweetedByPage(c *client, id string) (err error) {
@@ -344,174 +1020,390 @@ func (s *service) RetweetedByPage(c *client, id string) (err error) {
 		CommonData: cdata,
 		Users:      retweeters,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.RetweetedByPage, data)
+	return s.render(c, renderer.RetweetedByPage, data)
 }
 
 func (s *service) NotificationPage(c *client, maxID string,
 	minID string) (err error) {
 
-	var nextLink string
 	var unreadCount int
 	var readID string
-	var excludes []string
-	var pg = mastodon.Pagination{
+	var req = mastodon.Pagination{
 		MaxID: maxID,
 		MinID: minID,
 		Limit: 20,
 	}
+	pg := req
 
-	if c.s.Settings.AntiDopamineMode {
-		excludes = []string{"follow", "favourite", "reblog"}
-	}
-
-	notifications, err := c.GetNotifications(c.ctx, &pg, excludes)
+	notifications, err := c.GetNotifications(c.ctx, &pg,
+		notificationExcludes(c))
 	if err != nil {
 		return
 	}
 
-	for i := range notifications {
-		if notifications[i].Pleroma != nil && !notifications[i].Pleroma.IsSeen {
-			unreadCount++
-		}
-	}
+	unreadCount = s.markUnread(c, notifications)
 
 	if unreadCount > 0 {
 		readID = notifications[0].ID
 	}
-	if len(notifications) == 20 && len(pg.MaxID) > 0 {
-		nextLink = "/notifications?max_id=" + pg.MaxID
+	prevLink, nextLink := pageLinks("/notifications", nil, req, pg,
+		len(notifications))
+	notifications = groupNotifications(notifications)
+
+	// In fluoride mode the page polls the unread count and only reloads
+	// when it changes.
+	rinterval := c.s.Settings.NotificationInterval
+	var pollInterval int
+	if c.s.Settings.FluorideMode {
+		rinterval, pollInterval = 0, rinterval
 	}
+	notices := s.notices(c)
 
-	cdata := s.cdata(c, "notifications", unreadCount,
-		c.s.Settings.NotificationInterval, "main")
+	cdata := s.cdata(c, "notifications", unreadCount, rinterval, "main")
 	data := &renderer.NotificationData{
 		Notifications: notifications,
 		UnreadCount:   unreadCount,
 		ReadID:        readID,
 		NextLink:      nextLink,
+		PrevLink:      prevLink,
+		PollInterval:  pollInterval,
+		Notices:       notices,
 		CommonData:    cdata,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.NotificationPage, data)
+	return s.render(c, renderer.NotificationPage, data)
 }
 
-func (s *service) UserPage(c *client, id string, pageType string,
-	maxID string, minID string) (err error) {
+// Failures of things that happen outside of the page the user is looking at
+// are kept as notices, which are shown on the notifications page. The notices
+// of an account are kept for noticeDuration after the last one, up to
+// maxNotices of them.
+const (
+	noticeDuration = 7 * 24 * time.Hour
+	maxNotices     = 20
+)
 
-	var nextLink string
-	var statuses []*mastodon.Status
-	var users []*mastodon.Account
-	var pg = mastodon.Pagination{
-		MaxID: maxID,
-		MinID: minID,
-		Limit: 20,
-	}
+func noticesKey(c *client) string {
+	return "notices-" + rateLimitKey(c)
+}
 
-	user, err := c.GetAccount(c.ctx, id)
+// notices returns the notices of the account of c, the oldest first.
+func (s *service) notices(c *client) (notices []renderer.Notice) {
+	data, err := s.cacheRepo.Get(noticesKey(c))
 	if err != nil {
 		return
 	}
-	isCurrent := c.s.UserID == user.ID
+	json.Unmarshal(data, &notices)
+	return
+}
 
-	switch pageType {
-	case "":
-		statuses, err = c.GetAccountStatuses(c.ctx, id, false, &pg)
-		if err != nil {
-			return
+// addNotice adds a notice with text to the account of c.
+func (s *service) addNotice(c *client, text string) (err error) {
+	notices := append(s.notices(c), renderer.Notice{
+		Time: time.Now(),
+		Text: text,
+	})
+	if len(notices) > maxNotices {
+		notices = notices[len(notices)-maxNotices:]
+	}
+	data, err := json.Marshal(notices)
+	if err != nil {
+		return
+	}
+	return s.cacheRepo.Set(noticesKey(c), data, noticeDuration)
+}
+
+// DismissNotices removes the notices of the account of c.
+func (s *service) DismissNotices(c *client) (err error) {
+	s.cacheRepo.Remove(noticesKey(c))
+	return
+}
+
+// markUnread sets the read state of the notifications and returns the number
+// of unread ones. Pleroma tracks the read state of each notification, on
+// other instances the notifications marker is used.
+func (s *service) markUnread(c *client,
+	notifications []*mastodon.Notification) (count int) {
+
+	var lastReadID string
+	markers, err := c.GetMarkers(c.ctx, []string{"notifications"})
+	if err == nil {
+		if m, ok := markers["notifications"]; ok && m != nil {
+			lastReadID = m.LastReadID
+		}
+	}
+	for _, n := range notifications {
+		if n.Pleroma == nil && len(lastReadID) > 0 {
+			n.Pleroma = &mastodon.NotificationPleroma{
+				IsSeen: !isNewer(n.ID, lastReadID),
+			}
 		}
-		if len(statuses) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s?max_id=%s", id,
-				pg.MaxID)
+		if n.Pleroma != nil && !n.Pleroma.IsSeen {
+			count++
 		}
-	case "following":
-		users, err = c.GetAccountFollowing(c.ctx, id, &pg)
-		if err != nil {
-			return
+	}
+	return
+}
+
+func notificationExcludes(c *client) []string {
+	if c.s.Settings.AntiDopamineMode {
+		return []string{"follow", "favourite", "reblog"}
+	}
+	return nil
+}
+
+// UnreadNotificationCount returns the number of unread notifications among
+// the latest ones, as shown on the notifications page.
+func (s *service) UnreadNotificationCount(c *client) (count int, err error) {
+	err = s.rateLimited(c)
+	if err != nil {
+		return
+	}
+	pg := mastodon.Pagination{Limit: 20}
+	notifications, err := c.GetNotifications(c.ctx, &pg,
+		notificationExcludes(c))
+	if err != nil {
+		return
+	}
+	return s.markUnread(c, notifications), nil
+}
+
+// MentionAlert is a new mention, as shown in a desktop notification.
+type MentionAlert struct {
+	ID     string `json:"id"`
+	Author string `json:"author"`
+	Text   string `json:"text"`
+	Link   string `json:"link"`
+}
+
+// NewMentions returns the mentions that came after the notification sinceID,
+// along with the ID of the latest notification to pass as sinceID next time.
+// Without sinceID, only the latest ID is returned, so that the mentions from
+// before the page was opened aren't shown.
+func (s *service) NewMentions(c *client, sinceID string) (
+	alerts []*MentionAlert, latestID string, err error) {
+
+	err = s.rateLimited(c)
+	if err != nil {
+		return
+	}
+	pg := mastodon.Pagination{SinceID: sinceID, Limit: 20}
+	notifications, err := c.GetNotifications(c.ctx, &pg, nil)
+	if err != nil {
+		return
+	}
+	latestID = sinceID
+	if len(notifications) > 0 {
+		latestID = notifications[0].ID
+	}
+	if len(sinceID) < 1 {
+		return nil, latestID, nil
+	}
+	for _, n := range notifications {
+		if n.Type != "mention" || n.Status == nil {
+			continue
 		}
-		if len(users) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/following?max_id=%s",
-				id, pg.MaxID)
+		author := n.Account.DisplayName
+		if len(author) < 1 {
+			author = n.Account.Username
 		}
-	case "followers":
-		users, err = c.GetAccountFollowers(c.ctx, id, &pg)
-		if err != nil {
-			return
+		text := htmlToText(n.Status.Content)
+		if len(n.Status.SpoilerText) > 0 {
+			text = "CW: " + n.Status.SpoilerText
 		}
-		if len(users) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/followers?max_id=%s",
-				id, pg.MaxID)
+		if r := []rune(text); len(r) > 140 {
+			text = string(r[:139]) + "…"
 		}
-	case "media":
-		statuses, err = c.GetAccountStatuses(c.ctx, id, true, &pg)
-		if err != nil {
-			return
+		alerts = append(alerts, &MentionAlert{
+			ID:     n.ID,
+			Author: author + " (@" + n.Account.Acct + ")",
+			Text:   text,
+			Link:   "/thread/" + n.Status.ID + "#status-" + n.Status.ID,
+		})
+	}
+	return
+}
+
+// groupNotifications collapses the likes and retweets of the same status,
+// and the follows, into the most recent notification of each group. The
+// accounts of the collapsed notifications are added to its Others field.
+func groupNotifications(notifications []*mastodon.Notification) []*mastodon.Notification {
+	var res []*mastodon.Notification
+	groups := make(map[string]*mastodon.Notification)
+	for _, n := range notifications {
+		var key string
+		switch n.Type {
+		case "favourite", "reblog":
+			if n.Status != nil {
+				key = n.Type + ":" + n.Status.ID
+			}
+		case "follow":
+			key = n.Type
+		}
+		if len(key) < 1 {
+			res = append(res, n)
+			continue
 		}
-		if len(statuses) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/media?max_id=%s",
-				id, pg.MaxID)
+		g, ok := groups[key]
+		if !ok {
+			groups[key] = n
+			res = append(res, n)
+			continue
+		}
+		g.Others = append(g.Others, n.Account)
+		g.OtherIDs = append(g.OtherIDs, n.ID)
+		if n.Pleroma != nil && !n.Pleroma.IsSeen {
+			g.Pleroma = n.Pleroma
+		}
+	}
+	return res
+}
+
+func (s *service) NotificationRequestsPage(c *client, maxID string,
+	minID string) (err error) {
+
+	var req = mastodon.Pagination{
+		MaxID: maxID,
+		MinID: minID,
+		Limit: 20,
+	}
+	pg := req
+
+	requests, err := c.GetNotificationRequests(c.ctx, &pg)
+	if err != nil {
+		return
+	}
+	prevLink, nextLink := pageLinks("/notifications/requests", nil, req, pg,
+		len(requests))
+
+	policy, err := c.GetNotificationPolicy(c.ctx)
+	if err != nil {
+		return
+	}
+
+	cdata := s.cdata(c, "notification requests", 0, 0, "")
+	data := &renderer.NotificationRequestsData{
+		CommonData: cdata,
+		Requests:   requests,
+		Policy:     policy,
+		NextLink:   nextLink,
+		PrevLink:   prevLink,
+	}
+	return s.render(c, renderer.NotificationRequestsPage, data)
+}
+
+func (s *service) UserPage(c *client, id string, pageType string,
+	maxID string, minID string) (err error) {
+
+	var pinned []*mastodon.Status
+	var statuses []*mastodon.Status
+	var users []*mastodon.Account
+	var req = mastodon.Pagination{
+		MaxID: maxID,
+		MinID: minID,
+		Limit: 20,
+	}
+	pg := req
+	// The account is the one of id, so the page can be checked before
+	// it's fetched
+	isCurrent := c.s.UserID == id
+
+	// The account is fetched along with the page of the type
+	g, gc := errGroup(c)
+	var user *mastodon.Account
+	fetches := []func() error{func() (err error) {
+		user, err = s.account(gc, id)
+		return
+	}}
+	fetch := func(f func() error) {
+		fetches = append(fetches, f)
+	}
+	switch pageType {
+	case "":
+		fetch(func() (err error) {
+			statuses, err = gc.GetAccountStatuses(gc.ctx, id, false, &pg)
+			return
+		})
+		if len(maxID) < 1 && len(minID) < 1 {
+			fetch(func() (err error) {
+				pinned, err = gc.GetAccountPinnedStatuses(gc.ctx, id)
+				return
+			})
 		}
+	case "following":
+		fetch(func() (err error) {
+			users, err = gc.GetAccountFollowing(gc.ctx, id, &pg)
+			return
+		})
+	case "followers":
+		fetch(func() (err error) {
+			users, err = gc.GetAccountFollowers(gc.ctx, id, &pg)
+			return
+		})
+	case "media":
+		fetch(func() (err error) {
+			statuses, err = gc.GetAccountStatuses(gc.ctx, id, true, &pg)
+			return
+		})
 	case "bookmarks":
 		if !isCurrent {
 			return errInvalidArgument
 		}
-		statuses, err = c.GetBookmarks(c.ctx, &pg)
-		if err != nil {
+		fetch(func() (err error) {
+			statuses, err = gc.GetBookmarks(gc.ctx, &pg)
 			return
-		}
-		if len(statuses) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/bookmarks?max_id=%s",
-				id, pg.MaxID)
-		}
+		})
 	case "mutes":
 		if !isCurrent {
 			return errInvalidArgument
 		}
-		users, err = c.GetMutes(c.ctx, &pg)
-		if err != nil {
+		fetch(func() (err error) {
+			users, err = gc.GetMutes(gc.ctx, &pg)
 			return
-		}
-		if len(users) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/mutes?max_id=%s",
-				id, pg.MaxID)
-		}
+		})
 	case "blocks":
 		if !isCurrent {
 			return errInvalidArgument
 		}
-		users, err = c.GetBlocks(c.ctx, &pg)
-		if err != nil {
+		fetch(func() (err error) {
+			users, err = gc.GetBlocks(gc.ctx, &pg)
 			return
-		}
-		if len(users) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/blocks?max_id=%s",
-				id, pg.MaxID)
-		}
+		})
 	case "likes":
 		if !isCurrent {
 			return errInvalidArgument
 		}
-		statuses, err = c.GetFavourites(c.ctx, &pg)
-		if err != nil {
+		fetch(func() (err error) {
+			statuses, err = gc.GetFavourites(gc.ctx, &pg)
 			return
-		}
-		if len(statuses) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/likes?max_id=%s",
-				id, pg.MaxID)
-		}
+		})
 	case "requests":
 		if !isCurrent {
 			return errInvalidArgument
 		}
-		users, err = c.GetFollowRequests(c.ctx, &pg)
-		if err != nil {
+		fetch(func() (err error) {
+			users, err = gc.GetFollowRequests(gc.ctx, &pg)
 			return
-		}
-		if len(users) == 20 && len(pg.MaxID) > 0 {
-			nextLink = fmt.Sprintf("/user/%s/requests?max_id=%s",
-				id, pg.MaxID)
-		}
+		})
 	default:
 		return errInvalidArgument
 	}
+	for _, f := range fetches {
+		g.Go(f)
+	}
+	err = g.Wait()
+	if err != nil {
+		return
+	}
+
+	path := "/user/" + id
+	if len(pageType) > 0 {
+		path += "/" + pageType
+	}
+	prevLink, nextLink := pageLinks(path, nil, req, pg,
+		len(statuses)+len(users))
+	if len(pinned) > 0 {
+		statuses = withoutPinned(statuses, pinned)
+	}
 
 	for i := range statuses {
 		if statuses[i].Reblog != nil {
@@ -525,11 +1417,34 @@ func (s *service) UserPage(c *client, id string, pageType string,
 		IsCurrent:  isCurrent,
 		Type:       pageType,
 		Users:      users,
+		Pinned:     pinned,
 		Statuses:   statuses,
 		NextLink:   nextLink,
+		PrevLink:   prevLink,
 		CommonData: cdata,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.UserPage, data)
+	return s.render(c, renderer.UserPage, data)
+}
+
+// withoutPinned removes the pinned statuses from statuses, so that they're
+// only shown once in the pinned section.
+func withoutPinned(statuses []*mastodon.Status,
+	pinned []*mastodon.Status) []*mastodon.Status {
+
+	if len(pinned) < 1 {
+		return statuses
+	}
+	ids := make(map[string]bool, len(pinned))
+	for _, p := range pinned {
+		ids[p.ID] = true
+	}
+	var res []*mastodon.Status
+	for _, st := range statuses {
+		if !ids[st.ID] {
+			res = append(res, st)
+		}
+	}
+	return res
 }
 
 func (s *service) UserSearchPage(c *client,
@@ -537,20 +1452,24 @@ func (s *service) UserSearchPage(c *client,
 
 	var nextLink string
 	var title = "search"
+	var user *mastodon.Account
+	var results = &mastodon.Results{}
 
-	user, err := c.GetAccount(c.ctx, id)
-	if err != nil {
+	g, gc := errGroup(c)
+	g.Go(func() (err error) {
+		user, err = s.account(gc, id)
 		return
-	}
-
-	var results *mastodon.Results
+	})
 	if len(q) > 0 {
-		results, err = c.Search(c.ctx, q, "statuses", 20, true, offset, id)
-		if err != nil {
-			return err
-		}
-	} else {
-		results = &mastodon.Results{}
+		g.Go(func() (err error) {
+			results, err = gc.Search(gc.ctx, q, "statuses", 20, true,
+				offset, id)
+			return
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return
 	}
 
 	if len(results.Statuses) == 20 {
@@ -571,221 +1490,1998 @@ func (s *service) UserSearchPage(c *client,
 		Statuses:   results.Statuses,
 		NextLink:   nextLink,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.UserSearchPage, data)
+	return s.render(c, renderer.UserSearchPage, data)
 }
 
 func (s *service) AboutPage(c *client) (err error) {
+	var instance *mastodon.Instance
+	var instanceV2 *mastodon.InstanceV2
+	g, gc := errGroup(c)
+	g.Go(func() (err error) {
+		instance, err = s.instanceInfo(gc)
+		return
+	})
+	g.Go(func() error {
+		// The v2 API is not available on older Mastodon versions and
+		// on Pleroma, the page falls back to the v1 information in that
+		// case.
+		instanceV2, _ = s.instanceInfoV2(gc)
+		return nil
+	})
+	err = g.Wait()
+	if err != nil {
+		return
+	}
 	cdata := s.cdata(c, "about", 0, 0, "")
 	data := &renderer.AboutData{
 		CommonData: cdata,
+		Instance:   instance,
+		InstanceV2: instanceV2,
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.AboutPage, data)
+	return s.render(c, renderer.AboutPage, data)
 }
 
-func (s *service) EmojiPage(c *client) (err error) {
-	emojis, err := c.GetInstanceEmojis(c.ctx)
-	if err != nil {
+// errGroup returns a group for requests to the instance that don't depend on
+// each other, to make them at the same time, so that a page waits for the
+// slowest of them rather than for all of them in turn. The requests are made
+// with the returned copy of c, so that the others are cancelled once one of
+// them fails.
+func errGroup(c *client) (*errgroup.Group, *client) {
+	g, ctx := errgroup.WithContext(c.ctx)
+	gc := *c
+	gc.ctx = ctx
+	return g, &gc
+}
+
+// parseVersion returns the major and minor Mastodon version from the version
+// string of the instance, and whether the instance is running Pleroma or its
+// fork Akkoma, which report versions like "2.7.2 (compatible; Pleroma 2.5.0)".
+func parseVersion(v string) (major int, minor int, pleroma bool) {
+	pleroma = strings.Contains(v, "Pleroma") || strings.Contains(v, "Akkoma")
+	words := strings.Fields(v)
+	if len(words) < 1 {
 		return
 	}
-	cdata := s.cdata(c, "emojis", 0, 0, "")
-	data := &renderer.EmojiData{
-		Emojis:     emojis,
-		CommonData: cdata,
+	fields := strings.SplitN(words[0], ".", 3)
+	major, _ = strconv.Atoi(fields[0])
+	if len(fields) > 1 {
+		minor, _ = strconv.Atoi(fields[1])
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.EmojiPage, data)
+	return
 }
 
-func (s *service) SearchPage(c *client,
-	q string, qType string, offset int) (err error) {
+// isGoToSocial reports whether v is the version of a GoToSocial instance,
+// which adds the commit it was built from, e.g. "0.16.0 git-b3e29a4".
+// GoToSocial is still at 0.x, so its features can't be told apart from the
+// ones of old Mastodon versions by the version number.
+func isGoToSocial(v string) bool {
+	return strings.Contains(v, "git-")
+}
 
-	var nextLink string
-	var title = "search"
+// capabilities returns the optional features supported by an instance
+// running the given version. When the version is unknown, e.g. for sessions
+// created by older versions of bloat, the features that were always shown
+// are assumed to be supported.
+func capabilities(version string) renderer.Capabilities {
+	if len(version) < 1 {
+		return renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			NotificationRequests: true,
+			LocalVisibility:      false,
+		}
+	}
+	major, minor, pleroma := parseVersion(version)
+	gotosocial := isGoToSocial(version)
+	atLeast := func(ma, mi int) bool {
+		return !pleroma && !gotosocial &&
+			(major > ma || (major == ma && minor >= mi))
+	}
+	return renderer.Capabilities{
+		Bookmarks:            pleroma || gotosocial || atLeast(3, 1),
+		DismissNotifications: pleroma || gotosocial || atLeast(3, 1),
+		NotificationRequests: atLeast(4, 3),
+		LocalVisibility:      pleroma || gotosocial,
+	}
+}
 
-	var results *mastodon.Results
-	if len(q) > 0 {
-		results, err = c.Search(c.ctx, q, qType, 20, true, offset, "")
+func (s *service) VersionPage(c *client) (err error) {
+	instance, err := s.instanceInfo(c)
+	if err != nil {
+		return
+	}
+
+	major, minor, pleroma := parseVersion(instance.Version)
+	atLeast := func(ma, mi int) bool {
+		return !pleroma && (major > ma || (major == ma && minor >= mi))
+	}
+	caps := capabilities(instance.Version)
+	features := []renderer.CompatFeature{
+		{Name: "Bookmarks", Supported: caps.Bookmarks},
+		{Name: "Dismissing notifications", Supported: caps.DismissNotifications},
+		{Name: "Notification read state", Supported: pleroma},
+		{Name: "Read markers", Supported: pleroma || atLeast(3, 0)},
+		{Name: "Instance rules and contact", Supported: atLeast(4, 0)},
+		{Name: "Notification requests", Supported: caps.NotificationRequests},
+		{Name: "Local only posts", Supported: caps.LocalVisibility},
+	}
+
+	// The instance version is also refreshed here, as the instance may
+	// have been upgraded since signing in.
+	if c.s.SeenVersion != s.version ||
+		c.s.InstanceVersion != instance.Version {
+		var sess model.Session
+		sess, err = s.loadSession(c.s.ID)
 		if err != nil {
-			return err
+			return
+		}
+		sess.SeenVersion = s.version
+		sess.InstanceVersion = instance.Version
+		sess.PostFormats = instance.PostFormats()
+		sess.UploadLimit = instanceUploadLimit(instance)
+		err = s.saveSession(c, &sess)
+		if err != nil {
+			return
 		}
-	} else {
-		results = &mastodon.Results{}
 	}
 
-	if (qType == "accounts" && len(results.Accounts) == 20) ||
-		(qType == "statuses" && len(results.Statuses) == 20) {
-		offset += 20
-		nextLink = fmt.Sprintf("/search?q=%s&type=%s&offset=%d",
-			url.QueryEscape(q), qType, offset)
+	cdata := s.cdata(c, "version", 0, 0, "")
+	data := &renderer.VersionData{
+		CommonData:      cdata,
+		Version:         s.version,
+		InstanceVersion: instance.Version,
+		Features:        features,
 	}
+	return s.render(c, renderer.VersionPage, data)
+}
 
-	if len(q) > 0 {
-		title += " \"" + q + "\""
+func (s *service) ArchivePage(c *client) (err error) {
+	cdata := s.cdata(c, "archive", 0, 0, "")
+	data := &renderer.ArchiveData{
+		CommonData: cdata,
 	}
+	return s.render(c, renderer.ArchivePage, data)
+}
 
-	cdata := s.cdata(c, title, 0, 0, "")
-	data := &renderer.SearchData{
-		CommonData: cdata,
-		Q:          q,
-		Type:       qType,
-		Users:      results.Accounts,
-		Statuses:   results.Statuses,
-		NextLink:   nextLink,
+// Archive writes a zip file containing a static HTML page with all the
+// statuses of the current user as the response. If media is set, the
+// attachments are downloaded into the zip file too, the ones that fail to
+// download are linked to instead.
+func (s *service) Archive(c *client, media bool) (err error) {
+	c, cancel := exportClient(c)
+	defer cancel()
+	u, err := c.GetAccountCurrentUser(c.ctx)
+	if err != nil {
+		return
+	}
+
+	var statuses []*mastodon.Status
+	err = s.exportPages(c, 40, func(pg *mastodon.Pagination) (int, error) {
+		sts, err := c.GetAccountStatuses(c.ctx, u.ID, false, pg)
+		statuses = append(statuses, sts...)
+		return len(sts), err
+	})
+	if err != nil {
+		return
+	}
+
+	// The archive is built in a file first, so that errors can still be
+	// reported instead of ending up in the middle of the zip file.
+	f, err := ioutil.TempFile(s.uploadDir, "archive-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	left := int64(archiveMaxMediaSize)
+	if media {
+		for _, st := range statuses {
+			if st.Reblog != nil {
+				st = st.Reblog
+			}
+			for i := range st.MediaAttachments {
+				a := &st.MediaAttachments[i]
+				var ext string
+				if mu, err := url.Parse(a.URL); err == nil {
+					ext = path.Ext(mu.Path)
+				}
+				name := "media/" + a.ID + ext
+				n, err := s.archiveMedia(c, zw, name, a.URL, left)
+				left -= n
+				if err == nil {
+					a.URL = name
+				}
+			}
+		}
+	}
+
+	index, err := zw.Create("index.html")
+	if err != nil {
+		return
+	}
+	data := &renderer.ArchiveExportData{
+		User:     u,
+		Statuses: statuses,
+		Date:     time.Now(),
+	}
+	err = s.renderer.Render(c.rctx, index, renderer.ArchiveExportPage, data)
+	if err != nil {
+		return
+	}
+	err = zw.Close()
+	if err != nil {
+		return
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	c.w.Header().Set("Content-Type", "application/zip")
+	c.w.Header().Set("Content-Disposition",
+		"attachment; filename=\"bloat-archive.zip\"")
+	c.w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	// The response can't be turned into an error page anymore.
+	io.Copy(c.w, f)
+	return nil
+}
+
+// The attachments in the archive are limited to archiveMediaMaxSize bytes
+// each and archiveMaxMediaSize bytes in all, the rest are linked to.
+const (
+	archiveMediaMaxSize = 100 << 20
+	archiveMaxMediaSize = 2 << 30
+)
+
+// archiveMedia writes the media at u to the file name of zw, if it's not
+// larger than left bytes, and returns the number of bytes written.
+func (s *service) archiveMedia(c *client, zw *zip.Writer, name string,
+	u string, left int64) (n int64, err error) {
+
+	limit := int64(archiveMediaMaxSize)
+	if left < limit {
+		limit = left
+	}
+	if limit < 1 {
+		return 0, errArchiveTooLarge
+	}
+	body, size, err := s.fetcher.Open(c.ctx, u)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if size > limit {
+		return 0, errArchiveTooLarge
+	}
+	f, err := zw.Create(name)
+	if err != nil {
+		return
+	}
+	// The size isn't always known beforehand, such media that turns out
+	// to be too large is cut off and linked to
+	n, err = io.Copy(f, io.LimitReader(body, limit+1))
+	if err == nil && n > limit {
+		err = errArchiveTooLarge
+	}
+	return
+}
+
+// Exports go through all the pages of a list within one request, so they're
+// given up to exportTimeout and exportMaxPages pages.
+const (
+	exportTimeout  = 10 * time.Minute
+	exportMaxPages = 1000
+)
+
+// exportClient returns a copy of c for an export, whose requests fail after
+// exportTimeout.
+func exportClient(c *client) (*client, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(c.ctx, exportTimeout)
+	ec := *c
+	ec.ctx = ctx
+	return &ec, cancel
+}
+
+// exportPages calls get with each page of a list, of limit items, until get
+// returns no items. It stops at the first error, e.g. once the instance
+// limits the rate, so that the error is shown instead of a partial export.
+func (s *service) exportPages(c *client, limit int64,
+	get func(pg *mastodon.Pagination) (int, error)) error {
+
+	err := s.rateLimited(c)
+	if err != nil {
+		return err
+	}
+	pg := mastodon.Pagination{Limit: limit}
+	for i := 0; i < exportMaxPages; i++ {
+		n, err := get(&pg)
+		if err != nil {
+			return err
+		}
+		if n < 1 || len(pg.MaxID) < 1 {
+			return nil
+		}
+		pg = mastodon.Pagination{MaxID: pg.MaxID, Limit: limit}
+	}
+	return errExportTooLarge
+}
+
+// instanceData reads the data named name of the instance of the user into
+// v. The data rarely changes, e.g. the info and the custom emojis, so it's
+// kept in instanceCache after fetch gets it, and shared by the sessions of
+// the instance.
+func (s *service) instanceData(c *client, name string, v interface{},
+	fetch func() (interface{}, error)) error {
+
+	key := name + "-" + c.s.InstanceDomain
+	if len(c.s.InstanceDomain) > 0 {
+		data, err := s.instanceCache.Get(key)
+		if err == nil && json.Unmarshal(data, v) == nil {
+			return nil
+		}
+	}
+	res, err := fetch()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if len(c.s.InstanceDomain) > 0 {
+		s.instanceCache.Set(key, data, s.instanceCacheTTL)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// instanceInfo returns the info of the instance of the user, which includes
+// its version and its limits.
+func (s *service) instanceInfo(c *client) (instance *mastodon.Instance,
+	err error) {
+	err = s.instanceData(c, "instance", &instance,
+		func() (interface{}, error) {
+			return c.GetInstance(c.ctx)
+		})
+	return
+}
+
+func (s *service) instanceInfoV2(c *client) (instance *mastodon.InstanceV2,
+	err error) {
+	err = s.instanceData(c, "instance_v2", &instance,
+		func() (interface{}, error) {
+			return c.GetInstanceV2(c.ctx)
+		})
+	return
+}
+
+// Relationships are cached for relationshipCacheDuration, so that paging
+// through the statuses of an account doesn't fetch it again for every page.
+// The actions on an account, like following it, update the cached one.
+const relationshipCacheDuration = 2 * time.Minute
+
+// relationshipKey returns the key of the relationship to the account id,
+// which is shared by the sessions of the account of the user, so that an
+// action in one of them shows up in the others.
+func relationshipKey(c *client, id string) string {
+	return "relationship-" + rateLimitKey(c) + "-" + id
+}
+
+// account returns the account id along with its relationship to the user,
+// which Pleroma includes in the account, and which is fetched otherwise.
+func (s *service) account(c *client, id string) (a *mastodon.Account,
+	err error) {
+	a, err = c.GetAccount(c.ctx, id)
+	if err != nil {
+		return
+	}
+	if a.Pleroma != nil && len(a.Pleroma.Relationship.ID) > 0 {
+		return
+	}
+	rel, err := s.relationship(c, id)
+	if err != nil {
+		return nil, err
+	}
+	if rel != nil {
+		a.Pleroma = &mastodon.AccountPleroma{Relationship: *rel}
+	}
+	return
+}
+
+// relationship returns the relationship of the user to the account id, or
+// nil if the instance doesn't tell.
+func (s *service) relationship(c *client, id string) (
+	rel *mastodon.Relationship, err error) {
+	key := relationshipKey(c, id)
+	data, err := s.relationshipCache.Get(key)
+	if err == nil && json.Unmarshal(data, &rel) == nil {
+		return rel, nil
+	}
+	rs, err := c.GetAccountRelationships(c.ctx, []string{id})
+	if err != nil || len(rs) < 1 {
+		return
+	}
+	s.cacheRelationship(c, id, rs[0])
+	return rs[0], nil
+}
+
+// cacheRelationship keeps rel as the relationship to the account id, as
+// returned by an action on it, or removes the cached one if rel is nil.
+func (s *service) cacheRelationship(c *client, id string,
+	rel *mastodon.Relationship) {
+	key := relationshipKey(c, id)
+	if rel == nil {
+		s.relationshipCache.Remove(key)
+		return
+	}
+	data, err := json.Marshal(rel)
+	if err != nil {
+		s.relationshipCache.Remove(key)
+		return
+	}
+	s.relationshipCache.Set(key, data, relationshipCacheDuration)
+}
+
+// Emojis returns the custom emojis of the instance of the user.
+func (s *service) Emojis(c *client) (emojis []*mastodon.Emoji, err error) {
+	err = s.instanceData(c, "emojis", &emojis,
+		func() (interface{}, error) {
+			return c.GetInstanceEmojis(c.ctx)
+		})
+	return
+}
+
+// EmojiImage writes the emoji image whose URL is encoded in encoded, as
+// returned by util.EmojiPath.
+func (s *service) EmojiImage(c *client, encoded string) (err error) {
+	if s.emojiFetcher == nil {
+		return errInvalidArgument
+	}
+	u, err := util.ProxyURL(encoded)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(u))
+	key := "emoji-" + hex.EncodeToString(sum[:])
+	data, err := s.cacheRepo.Get(key)
+	if err != nil {
+		data, err = s.emojiFetcher.Fetch(c.ctx, u, emojiImageMaxSize)
+		if err != nil {
+			return
+		}
+		if _, ok := util.ImageType(data); !ok {
+			return errUnsupportedMedia
+		}
+		err = s.cacheRepo.Set(key, data, emojiImageCacheDuration)
+		if err != nil {
+			return
+		}
+	}
+	// The images are served from bloat's origin, so anything that could
+	// run in it, like HTML or SVG, is refused
+	ct, ok := util.ImageType(data)
+	if !ok {
+		return errUnsupportedMedia
+	}
+	header := c.w.Header()
+	header.Set("Content-Type", ct)
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Cache-Control", "private, max-age=604800")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	_, err = c.w.Write(data)
+	return
+}
+
+// allow takes n tokens from the bucket of key in l. Once it's empty, it sets
+// the Retry-After header of the response to c and returns false.
+func allow(c *client, l *util.Limiter, key string, n float64) bool {
+	ok, retry := l.AllowN(key, n)
+	if !ok {
+		c.w.Header().Set("Retry-After",
+			strconv.Itoa(int(retry.Seconds())))
+	}
+	return ok
+}
+
+// allowWrite takes a token from the buckets of the session and the address
+// of c. Once either is empty, it returns false, so that runaway scripts are
+// stopped before they reach the instance.
+func (s *service) allowWrite(c *client) bool {
+	cost := 1.0
+	if s.isUploadChunk(c) {
+		cost = uploadChunkCost
+	}
+	return allow(c, s.writeLimiter, c.s.Handle(), cost) &&
+		allow(c, s.writeIPLimiter, clientIP(c.r), cost)
+}
+
+// uploadChunkCost is the share of a write that a chunk of an upload counts
+// as, so that uploading large files doesn't use up the limit of writes.
+const uploadChunkCost = 0.05
+
+// isUploadChunk reports whether c continues an upload of the account.
+func (s *service) isUploadChunk(c *client) bool {
+	id := c.r.FormValue("id")
+	if c.r.URL.Path != "/fluoride/upload" || len(id) < 1 {
+		return false
+	}
+	p, err := s.uploadPath(c, id)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// The instances throttle the requests of each account. Once a request is
+// throttled, the background requests of the account, such as the polling of
+// the notification count, aren't sent until the limit resets.
+func rateLimitKey(c *client) string {
+	return c.s.InstanceDomain + ":" + c.s.UserID
+}
+
+// NoteRateLimit remembers the rate limit if err is a rate limit error of the
+// instance.
+func (s *service) NoteRateLimit(c *client, err error) {
+	var rerr *mastodon.RateLimitError
+	if len(c.s.InstanceDomain) < 1 || !errors.As(err, &rerr) {
+		return
+	}
+	if rerr.Reset.IsZero() {
+		rerr = &mastodon.RateLimitError{
+			Reset: time.Now().Add(rerr.RetryAfter()),
+		}
+	}
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+	s.rateLimits[rateLimitKey(c)] = rerr
+}
+
+// rateLimited returns the rate limit error of the account if the instance
+// still throttles it.
+func (s *service) rateLimited(c *client) error {
+	now := time.Now()
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+	for k, rerr := range s.rateLimits {
+		if now.After(rerr.Reset) {
+			delete(s.rateLimits, k)
+		}
+	}
+	if rerr, ok := s.rateLimits[rateLimitKey(c)]; ok {
+		return rerr
+	}
+	return nil
+}
+
+// SuggestAccounts returns the accounts matching q, for mention suggestions.
+func (s *service) SuggestAccounts(c *client, q string) (
+	accounts []*mastodon.Account, err error) {
+
+	if !allow(c, s.suggestLimiter, c.s.Handle(), 1) {
+		return nil, errRateLimited
+	}
+	return c.AccountsSearch(c.ctx, q, 10)
+}
+
+// SuggestHashtags returns the hashtags matching q, for hashtag suggestions.
+func (s *service) SuggestHashtags(c *client, q string) (
+	tags []*mastodon.Tag, err error) {
+
+	if !allow(c, s.suggestLimiter, c.s.Handle(), 1) {
+		return nil, errRateLimited
+	}
+	results, err := c.Search(c.ctx, q, "hashtags", 10, false, 0, "")
+	if err != nil {
+		return
+	}
+	return results.Hashtags, nil
+}
+
+// ProxyMedia writes the remote media whose URL is encoded in encoded, as
+// returned by util.ProxyPath.
+func (s *service) ProxyMedia(c *client, encoded string) (err error) {
+	if s.mediaProxy == nil {
+		return errInvalidArgument
+	}
+	u, err := util.ProxyURL(encoded)
+	if err != nil {
+		return
+	}
+	return s.mediaProxy.Serve(c.w, c.r, u)
+}
+
+// Avatar writes the avatar whose URL is encoded in encoded, as returned by
+// util.AvatarPath, scaled to size.
+func (s *service) Avatar(c *client, size int, encoded string) (err error) {
+	if s.avatarCache == nil || !util.AvatarSizes[size] {
+		return errInvalidArgument
+	}
+	u, err := util.ProxyURL(encoded)
+	if err != nil {
+		return
+	}
+	ok, err := s.avatarCache.Serve(c.w, c.r, u, size)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return errAvatarNotFound
+	}
+	return
+}
+
+func (s *service) EmojiPage(c *client) (err error) {
+	emojis, err := s.Emojis(c)
+	if err != nil {
+		return
+	}
+	cdata := s.cdata(c, "emojis", 0, 0, "")
+	data := &renderer.EmojiData{
+		Emojis:     emojis,
+		CommonData: cdata,
+	}
+	return s.render(c, renderer.EmojiPage, data)
+}
+
+func (s *service) SearchPage(c *client,
+	q string, qType string, from string, offset int) (err error) {
+
+	var nextLink string
+	var title = "search"
+
+	var accountID string
+	from = strings.TrimPrefix(strings.TrimSpace(from), "@")
+	if len(from) > 0 && qType == "statuses" {
+		accountID, err = s.lookupAccountID(c, from)
+		if err != nil {
+			return
+		}
+	}
+
+	var results *mastodon.Results
+	if len(q) > 0 {
+		// Resolving makes the instance fetch remote statuses and
+		// accounts by URL, it's only needed for the first page.
+		results, err = c.Search(c.ctx, q, qType, 20, offset == 0, offset,
+			accountID)
+		if err != nil {
+			return err
+		}
+	} else {
+		results = &mastodon.Results{}
+	}
+
+	if (qType == "accounts" && len(results.Accounts) == 20) ||
+		(qType == "statuses" && len(results.Statuses) == 20) ||
+		(qType == "hashtags" && len(results.Hashtags) == 20) {
+		offset += 20
+		nextLink = fmt.Sprintf("/search?q=%s&type=%s&from=%s&offset=%d",
+			url.QueryEscape(q), qType, url.QueryEscape(from), offset)
+	}
+
+	if len(q) > 0 {
+		title += " \"" + q + "\""
+	}
+
+	cdata := s.cdata(c, title, 0, 0, "")
+	data := &renderer.SearchData{
+		CommonData: cdata,
+		Q:          q,
+		Type:       qType,
+		From:       from,
+		Users:      results.Accounts,
+		Statuses:   results.Statuses,
+		Hashtags:   results.Hashtags,
+		NextLink:   nextLink,
+	}
+	return s.render(c, renderer.SearchPage, data)
+}
+
+// lookupAccountID returns the ID of the account with the given acct, which
+// is either "user" for local accounts or "user@domain" for remote ones.
+func (s *service) lookupAccountID(c *client, acct string) (string, error) {
+	accounts, err := c.AccountsSearch(c.ctx, acct, 5)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range accounts {
+		if strings.EqualFold(a.Acct, acct) {
+			return a.ID, nil
+		}
+	}
+	return "", errAccountNotFound
+}
+
+// resolveAccountID returns the ID of the account with the given address,
+// making the instance fetch it if it doesn't know it yet. Local accounts
+// may have the domain of the instance in the address too.
+func (s *service) resolveAccountID(c *client, acct string,
+	localDomain string) (string, error) {
+	results, err := c.Search(c.ctx, acct, "accounts", 5, true, 0, "")
+	if err != nil {
+		return "", err
+	}
+	for _, a := range results.Accounts {
+		if strings.EqualFold(a.Acct, acct) ||
+			strings.EqualFold(a.Acct+"@"+localDomain, acct) {
+			return a.ID, nil
+		}
+	}
+	return "", errAccountNotFound
+}
+
+// localDomain returns the domain in the addresses of the local accounts,
+// which may differ from the domain of the instance.
+func (s *service) localDomain(c *client) string {
+	instance, err := s.instanceInfo(c)
+	if err == nil && len(instance.URI) > 0 {
+		uri := instance.URI
+		// Pleroma sends the URL of the instance
+		if u, err := url.Parse(uri); err == nil && len(u.Host) > 0 {
+			uri = u.Host
+		}
+		return uri
+	}
+	return c.s.InstanceDomain
+}
+
+// accountList is a list of accounts that can be exported and imported as a
+// CSV file. The files are in the format of the exports of Mastodon, so that
+// they can be moved between bloat and Mastodon. The address of the account
+// is the first field of each row.
+type accountList struct {
+	// file is the name of the export
+	file   string
+	header []string
+	// get returns a page of the list
+	get func(c *client, pg *mastodon.Pagination) ([]*mastodon.Account, error)
+	// fields returns the fields of the row of an account after the address,
+	// if the list has any
+	fields func(r *mastodon.Relationship) []string
+	// add adds the account with the ID to the list, with the fields of its
+	// row after the address
+	add func(c *client, id string, fields []string) error
+}
+
+// csvBool returns the boolean field i of fields, or def if it's missing or
+// invalid.
+func csvBool(fields []string, i int, def bool) bool {
+	if i < len(fields) {
+		v, err := strconv.ParseBool(strings.TrimSpace(fields[i]))
+		if err == nil {
+			return v
+		}
+	}
+	return def
+}
+
+var accountLists = map[string]*accountList{
+	"follows": {
+		file: "following_accounts.csv",
+		header: []string{"Account address", "Show boosts",
+			"Notify on new posts", "Languages"},
+		get: func(c *client, pg *mastodon.Pagination) ([]*mastodon.Account, error) {
+			return c.GetAccountFollowing(c.ctx, c.s.UserID, pg)
+		},
+		fields: func(r *mastodon.Relationship) []string {
+			return []string{strconv.FormatBool(r.ShowingReblogs),
+				strconv.FormatBool(r.Notifying), ""}
+		},
+		add: func(c *client, id string, fields []string) error {
+			reblogs, notify := csvBool(fields, 0, true), csvBool(fields, 1, false)
+			_, err := c.AccountFollow(c.ctx, id, &reblogs, &notify)
+			return err
+		},
+	},
+	"blocks": {
+		file: "blocked_accounts.csv",
+		get: func(c *client, pg *mastodon.Pagination) ([]*mastodon.Account, error) {
+			return c.GetBlocks(c.ctx, pg)
+		},
+		add: func(c *client, id string, fields []string) error {
+			_, err := c.AccountBlock(c.ctx, id)
+			return err
+		},
+	},
+	"mutes": {
+		file:   "muted_accounts.csv",
+		header: []string{"Account address", "Hide notifications"},
+		get: func(c *client, pg *mastodon.Pagination) ([]*mastodon.Account, error) {
+			return c.GetMutes(c.ctx, pg)
+		},
+		fields: func(r *mastodon.Relationship) []string {
+			return []string{strconv.FormatBool(r.MutingNotifications)}
+		},
+		add: func(c *client, id string, fields []string) error {
+			notifications := csvBool(fields, 0, true)
+			_, err := c.AccountMute(c.ctx, id, &notifications)
+			return err
+		},
+	},
+}
+
+// The largest account list accepted for import
+const maxImportSize = 1 << 20
+
+// The accounts of an import are added in batches of importBatch, so that a
+// request doesn't take too long. The accounts left are sent back along with
+// the outcome of the batch, and are submitted again for the next one.
+const importBatch = 50
+
+func (s *service) AccountListsPage(c *client) (err error) {
+	return s.accountListsPage(c, &renderer.AccountListsData{})
+}
+
+func (s *service) accountListsPage(c *client,
+	data *renderer.AccountListsData) (err error) {
+	data.CommonData = s.cdata(c, "account lists", 0, 0, "")
+	return s.render(c, renderer.AccountListsPage, data)
+}
+
+// ExportAccountList sends the accounts of the list as a CSV file.
+func (s *service) ExportAccountList(c *client, list string) (err error) {
+	l, ok := accountLists[list]
+	if !ok {
+		return errInvalidArgument
+	}
+
+	c, cancel := exportClient(c)
+	defer cancel()
+	var accounts []*mastodon.Account
+	err = s.exportPages(c, 80, func(pg *mastodon.Pagination) (int, error) {
+		as, err := l.get(c, pg)
+		accounts = append(accounts, as...)
+		return len(as), err
+	})
+	if err != nil {
+		return
+	}
+
+	rels := make(map[string]*mastodon.Relationship)
+	for i := 0; l.fields != nil && i < len(accounts); i += 40 {
+		end := i + 40
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+		var ids []string
+		for _, a := range accounts[i:end] {
+			ids = append(ids, a.ID)
+		}
+		var rs []*mastodon.Relationship
+		rs, err = c.GetAccountRelationships(c.ctx, ids)
+		if err != nil {
+			return
+		}
+		for _, r := range rs {
+			rels[r.ID] = r
+		}
+	}
+
+	localDomain := s.localDomain(c)
+	c.w.Header().Set("Content-Type", "text/csv")
+	c.w.Header().Set("Content-Disposition",
+		"attachment; filename=\""+l.file+"\"")
+	w := csv.NewWriter(c.w)
+	if l.header != nil {
+		w.Write(l.header)
+	}
+	for _, a := range accounts {
+		acct := a.Acct
+		if !strings.Contains(acct, "@") {
+			acct += "@" + localDomain
+		}
+		row := []string{acct}
+		if l.fields != nil {
+			r, ok := rels[a.ID]
+			if !ok {
+				// The defaults of the instances
+				r = &mastodon.Relationship{ShowingReblogs: true,
+					MutingNotifications: true}
+			}
+			row = append(row, l.fields(r)...)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// readAccountsCSV reads an account list, such as an export of Mastodon, and
+// returns its rows without the header.
+func readAccountsCSV(r io.Reader) (rows [][]string, err error) {
+	cr := csv.NewReader(io.LimitReader(r, maxImportSize))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, errInvalidArgument
+	}
+	for _, rec := range records {
+		acct := strings.TrimPrefix(strings.TrimSpace(rec[0]), "@")
+		// The header, if any, is the only row without an address
+		if !strings.Contains(acct, "@") {
+			continue
+		}
+		rec[0] = acct
+		rows = append(rows, rec)
+	}
+	return
+}
+
+// ImportAccountList adds the accounts of the CSV file r to the list, and
+// shows the outcome for each account. Files with only the addresses, as
+// older versions of Mastodon export them, are accepted too. A batch stops
+// early once the instance throttles the requests, and the next one can be
+// submitted once the limit resets. Adding an account to a list again doesn't
+// change anything, so a file can simply be imported again too.
+func (s *service) ImportAccountList(c *client, list string,
+	r io.Reader) (err error) {
+	l, ok := accountLists[list]
+	if !ok {
+		return errInvalidArgument
+	}
+	rows, err := readAccountsCSV(r)
+	if err != nil {
+		return
+	}
+	data := &renderer.AccountListsData{List: list, Imported: true}
+	if err := s.rateLimited(c); err != nil {
+		data.Error = err.Error()
+	} else {
+		localDomain := s.localDomain(c)
+		for len(rows) > 0 && len(data.Results) < importBatch {
+			row := rows[0]
+			err := s.importAccount(c, l, row, localDomain)
+			var rerr *mastodon.RateLimitError
+			if errors.As(err, &rerr) {
+				s.NoteRateLimit(c, err)
+				data.Error = err.Error()
+				break
+			}
+			res := renderer.ImportResult{Acct: row[0]}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			data.Results = append(data.Results, res)
+			rows = rows[1:]
+		}
+	}
+	var failed []string
+	for _, res := range data.Results {
+		if len(res.Error) > 0 {
+			failed = append(failed, res.Acct)
+		}
+	}
+	if len(failed) > 0 {
+		s.addNotice(c, fmt.Sprintf("Importing into the %s failed for %s",
+			list, strings.Join(failed, ", ")))
+	}
+	if len(rows) > 0 {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		err = w.WriteAll(rows)
+		if err != nil {
+			return
+		}
+		data.Rest = b.String()
+		data.Left = len(rows)
+		if len(data.Error) > 0 {
+			s.addNotice(c, fmt.Sprintf("Importing into the %s stopped "+
+				"before the end of the file: %s", list, data.Error))
+		}
+	}
+	return s.accountListsPage(c, data)
+}
+
+// ExportBookmarks sends the addresses of the bookmarked statuses as a CSV
+// file, like the bookmarks export of Mastodon, which can import it.
+func (s *service) ExportBookmarks(c *client) (err error) {
+	c, cancel := exportClient(c)
+	defer cancel()
+	var statuses []*mastodon.Status
+	err = s.exportPages(c, 40, func(pg *mastodon.Pagination) (int, error) {
+		sts, err := c.GetBookmarks(c.ctx, pg)
+		statuses = append(statuses, sts...)
+		return len(sts), err
+	})
+	if err != nil {
+		return
+	}
+
+	c.w.Header().Set("Content-Type", "text/csv")
+	c.w.Header().Set("Content-Disposition",
+		"attachment; filename=\"bookmarks.csv\"")
+	w := csv.NewWriter(c.w)
+	for _, st := range statuses {
+		u := st.URI
+		// The URIs of statuses from some servers aren't URLs
+		if !strings.HasPrefix(u, "http") {
+			u = st.URL
+		}
+		w.Write([]string{u})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (s *service) importAccount(c *client, l *accountList, row []string,
+	localDomain string) (err error) {
+	id, err := s.resolveAccountID(c, row[0], localDomain)
+	if err != nil {
+		return
+	}
+	err = l.add(c, id, row[1:])
+	s.cacheRelationship(c, id, nil)
+	return
+}
+
+func (s *service) SettingsPage(c *client) (err error) {
+	cdata := s.cdata(c, "settings", 0, 0, "")
+	enabled := make(map[string]bool)
+	for _, id := range c.s.Settings.CSSSnippets {
+		enabled[id] = true
+	}
+	data := &renderer.SettingsData{
+		CommonData:         cdata,
+		Settings:           &c.s.Settings,
+		PostFormats:        s.instancePostFormats(c),
+		CSSSnippets:        model.CSSSnippets,
+		Themes:             s.themes,
+		Website:            s.cwebsite,
+		FeedToken:          c.s.FeedToken,
+		EnabledCSSSnippets: enabled,
+	}
+	return s.render(c, renderer.SettingsPage, data)
+}
+
+func (svc *service) FiltersPage(c *client) (err error) {
+	filters, err := c.GetFilters(c.ctx)
+	if err != nil {
+		return
+	}
+	cdata := svc.cdata(c, "filters", 0, 0, "")
+	data := &renderer.FiltersData{
+		CommonData: cdata,
+		Filters:    filters,
+	}
+	return svc.render(c, renderer.FiltersPage, data)
+}
+
+// resolveStatus returns the status with the given URL, making the instance
+// fetch it first if it's from a remote server.
+func (s *service) resolveStatus(c *client, u string) (*mastodon.Status, error) {
+	results, err := c.Search(c.ctx, u, "statuses", 1, true, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(results.Statuses) < 1 {
+		return nil, errStatusNotFound
+	}
+	return results.Statuses[0], nil
+}
+
+func isDoAction(action string) bool {
+	switch action {
+	case "like", "retweet", "bookmark":
+		return true
+	}
+	return false
+}
+
+func (s *service) DoActionPage(c *client, action string, u string) (err error) {
+	if !isDoAction(action) || len(u) < 1 {
+		return errInvalidArgument
+	}
+	status, err := s.resolveStatus(c, u)
+	if err != nil {
+		return
+	}
+	cdata := s.cdata(c, action, 0, 0, "")
+	data := &renderer.DoActionData{
+		CommonData: cdata,
+		Action:     action,
+		URL:        u,
+		Status:     status,
+	}
+	return s.render(c, renderer.DoActionPage, data)
+}
+
+// DoAction resolves the status with the given URL and performs the action
+// on it. It returns the local ID of the status.
+func (s *service) DoAction(c *client, action string, u string) (id string, err error) {
+	if !isDoAction(action) || len(u) < 1 {
+		return "", errInvalidArgument
+	}
+	status, err := s.resolveStatus(c, u)
+	if err != nil {
+		return
+	}
+	id = status.ID
+	switch action {
+	case "like":
+		_, err = s.Like(c, id)
+	case "retweet":
+		_, err = s.Retweet(c, id)
+	case "bookmark":
+		err = s.Bookmark(c, id)
+	}
+	return
+}
+
+func (s *service) SingleInstance() (instance string, ok bool) {
+	if len(s.instance) > 0 {
+		instance = s.instance
+		ok = true
+	}
+	return
+}
+
+// instanceAddress returns the domain and the URL of the instance entered by
+// the user. The app is registered once for each instance, so different
+// spellings of the same instance must share it.
+func instanceAddress(instance string) (domain string, instanceURL string) {
+	domain = strings.ToLower(strings.TrimSpace(instance))
+	domain = strings.TrimRight(domain, "/")
+	if strings.HasPrefix(domain, "https://") {
+		instanceURL = domain
+		domain = strings.TrimPrefix(domain, "https://")
+	} else {
+		instanceURL = "https://" + domain
+	}
+	return
+}
+
+// instanceApp returns the app registered with the instance, registering it
+// first if there's none yet. Registrations are serialized so that concurrent
+// sign ins to a new instance don't register it more than once.
+func (s *service) instanceApp(c *client, instance string,
+	instanceURL string) (app model.App, err error) {
+	app, err = s.appRepo.Get(instance)
+	if err != model.ErrAppNotFound {
+		return
+	}
+	s.appMu.Lock()
+	defer s.appMu.Unlock()
+	app, err = s.appRepo.Get(instance)
+	if err != model.ErrAppNotFound {
+		return
+	}
+	mastoApp, err := mastodon.RegisterApp(c.ctx, &mastodon.AppConfig{
+		Client:       *s.httpClient,
+		Server:       instanceURL,
+		ClientName:   s.cname,
+		Scopes:       s.cscope,
+		Website:      s.cappwebsite,
+		RedirectURIs: s.cwebsite + "/oauth_callback",
+	})
+	if err != nil {
+		return
+	}
+	app = model.App{
+		InstanceDomain: instance,
+		InstanceURL:    instanceURL,
+		ClientID:       mastoApp.ClientID,
+		ClientSecret:   mastoApp.ClientSecret,
+	}
+	err = s.appRepo.Add(app)
+	return
+}
+
+func (s *service) NewSession(c *client, instance string) (rurl string, sid string, err error) {
+	if !allow(c, s.signinLimiter, clientIP(c.r), 1) {
+		err = errRateLimited
+		return
+	}
+	instance, instanceURL := instanceAddress(instance)
+
+	sid, err = util.NewSessionID()
+	if err != nil {
+		return
+	}
+	csrf, err := util.NewCSRFToken()
+	if err != nil {
+		return
+	}
+
+	sess := model.Session{
+		ID:             sid,
+		InstanceDomain: instance,
+		CSRFToken:      csrf,
+		Settings:       *model.NewSettings(),
+		Expires:        time.Now().Add(s.sessionExp),
+		Created:        time.Now(),
+		LastUsed:       time.Now(),
+		UserAgent:      c.r.UserAgent(),
+	}
+
+	app, err := s.instanceApp(c, instance, instanceURL)
+	if err != nil {
+		return
+	}
+	if s.sealer != nil {
+		sess.App = &app
+	}
+	err = s.saveSession(c, &sess)
+	if err != nil {
+		return
+	}
+	sid = sess.ID
+
+	u, err := url.Parse("/oauth/authorize")
+	if err != nil {
+		return
+	}
+
+	q := make(url.Values)
+	q.Set("scope", "read write follow")
+	q.Set("client_id", app.ClientID)
+	q.Set("response_type", "code")
+	q.Set("redirect_uri", s.cwebsite+"/oauth_callback")
+	u.RawQuery = q.Encode()
+
+	rurl = instanceURL + u.String()
+	return
+}
+
+func (s *service) Signin(c *client, code string) (err error) {
+	if len(code) < 1 {
+		err = errInvalidArgument
+		return
+	}
+	if !allow(c, s.signinLimiter, clientIP(c.r), 1) {
+		err = errRateLimited
+		return
+	}
+	err = c.AuthenticateToken(c.ctx, code, s.cwebsite+"/oauth_callback")
+	if err != nil {
+		return
+	}
+	return s.addSignedInSession(c)
+}
+
+// TokenSignin creates a signed in session with an access token obtained
+// elsewhere, e.g. from the settings of the instance, skipping the OAuth
+// authorization.
+func (s *service) TokenSignin(c *client, instance string,
+	token string) (sid string, err error) {
+	if len(instance) < 1 || len(token) < 1 {
+		err = errInvalidArgument
+		return
+	}
+	if !allow(c, s.signinLimiter, clientIP(c.r), 1) {
+		err = errRateLimited
+		return
+	}
+	instance, instanceURL := instanceAddress(instance)
+	app, err := s.instanceApp(c, instance, instanceURL)
+	if err != nil {
+		return
+	}
+	sid, err = util.NewSessionID()
+	if err != nil {
+		return
+	}
+	csrf, err := util.NewCSRFToken()
+	if err != nil {
+		return
+	}
+	c.s = model.Session{
+		ID:             sid,
+		InstanceDomain: instance,
+		CSRFToken:      csrf,
+		Settings:       *model.NewSettings(),
+		Expires:        time.Now().Add(s.sessionExp),
+		Created:        time.Now(),
+		LastUsed:       time.Now(),
+		UserAgent:      c.r.UserAgent(),
+	}
+	if s.sealer != nil {
+		c.s.App = &app
+	}
+	c.Client = mastodon.NewClient(&mastodon.Config{
+		Server:       app.InstanceURL,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+		AccessToken:  token,
+		HTTPClient:   s.httpClient,
+	})
+	err = s.addSignedInSession(c)
+	if err != nil {
+		return
+	}
+	sid = c.s.ID
+	return
+}
+
+// addSignedInSession stores the session of c after the access token of the
+// client is obtained, along with the account and the instance it's for.
+func (s *service) addSignedInSession(c *client) (err error) {
+	u, err := c.GetAccountCurrentUser(c.ctx)
+	if err != nil {
+		return
+	}
+	c.s.AccessToken = c.GetAccessToken(c.ctx)
+	c.s.UserID = u.ID
+	c.s.Acct = u.Acct + "@" + c.s.InstanceDomain
+	instance, err := s.instanceInfo(c)
+	if err == nil {
+		c.s.InstanceVersion = instance.Version
+		c.s.PostFormats = instance.PostFormats()
+		c.s.UploadLimit = instanceUploadLimit(instance)
+	}
+	s.loadAccountSettings(&c.s)
+	return s.saveSession(c, &c.s)
+}
+
+// ResetFeedToken replaces the feed token of the session with a new one, so
+// that the feed URLs with the old one stop working. With revoke set, the
+// feeds are disabled instead.
+func (s *service) ResetFeedToken(c *client, revoke bool) (err error) {
+	// Feed readers don't have the session cookie
+	if s.sealer != nil {
+		return errNoFeeds
+	}
+	sess, err := s.sessionRepo.Get(c.s.ID)
+	if err != nil {
+		return
+	}
+	if len(sess.FeedToken) > 0 {
+		s.feedRepo.Remove(sess.FeedToken)
+		sess.FeedToken = ""
+	}
+	if !revoke {
+		var token string
+		token, err = util.NewFeedToken()
+		if err != nil {
+			return
+		}
+		err = s.feedRepo.Add(model.Feed{
+			Token:     token,
+			SessionID: sess.ID,
+		})
+		if err != nil {
+			return
+		}
+		sess.FeedToken = token
+	}
+	return s.sessionRepo.Add(sess)
+}
+
+func (s *service) FeedTimeline(c *client, tType string,
+	instance string) (err error) {
+
+	pg := mastodon.Pagination{Limit: 40}
+	statuses, title, err := s.timeline(c, tType, instance, &pg)
+	if err != nil {
+		return
+	}
+	link := "/timeline/" + tType
+	if len(instance) > 0 {
+		link += "?instance=" + url.QueryEscape(instance)
+	}
+	return s.feed(c, title, link, statuses)
+}
+
+func (s *service) FeedUser(c *client, id string) (err error) {
+	user, err := c.GetAccount(c.ctx, id)
+	if err != nil {
+		return
+	}
+	pg := mastodon.Pagination{Limit: 40}
+	statuses, err := c.GetAccountStatuses(c.ctx, id, false, &pg)
+	if err != nil {
+		return
+	}
+	return s.feed(c, "@"+user.Acct, "/user/"+id, statuses)
+}
+
+func (s *service) feed(c *client, title string, link string,
+	statuses []*mastodon.Status) (err error) {
+
+	updated := time.Now()
+	if len(statuses) > 0 {
+		updated = statuses[0].CreatedAt
+	}
+	data := &renderer.FeedData{
+		Title:    title + " - " + s.cname,
+		Website:  s.cwebsite,
+		Link:     link,
+		Updated:  updated,
+		Statuses: statuses,
+	}
+	c.w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return s.renderer.Render(c.rctx, c.w, renderer.FeedPage, data)
+}
+
+// Signout revokes the access token of the session and removes the session.
+func (s *service) Signout(c *client) (err error) {
+	s.revokeSession(c, c.s)
+	return
+}
+
+// revokeSession revokes the access token of sess and removes it. The
+// session is removed even if the instance fails to revoke the token, as the
+// user can't do anything about it.
+func (s *service) revokeSession(c *client, sess model.Session) {
+	if len(sess.AccessToken) > 0 {
+		app, err := s.sessionApp(sess)
+		if err == nil {
+			mastodon.NewClient(&mastodon.Config{
+				Server:       app.InstanceURL,
+				ClientID:     app.ClientID,
+				ClientSecret: app.ClientSecret,
+				AccessToken:  sess.AccessToken,
+				HTTPClient:   s.httpClient,
+			}).RevokeToken(c.ctx)
+		}
+	}
+	s.removeSession(sess)
+}
+
+// RemoveSession removes the session along with its feed token, e.g. after
+// the instance rejected the access token of the session.
+func (s *service) RemoveSession(c *client) {
+	s.removeSession(c.s)
+}
+
+func (s *service) removeSession(sess model.Session) {
+	// Sealed sessions go away with the cookie
+	if s.sealer != nil {
+		return
+	}
+	if len(sess.FeedToken) > 0 {
+		s.feedRepo.Remove(sess.FeedToken)
+	}
+	s.sessionRepo.Remove(sess.ID)
+}
+
+// sessionHandle returns the identifier of the session shown on the sessions
+// page. The session ID itself isn't shown, as it signs in whoever has it.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// accountSessions returns the signed in sessions of the account of c, from
+// any browser.
+func (s *service) accountSessions(c *client) (sessions []model.Session,
+	err error) {
+	// Sealed sessions are only known to the browsers that have them
+	if s.sealer != nil {
+		return []model.Session{c.s}, nil
+	}
+	all, err := s.sessionRepo.List()
+	if err != nil {
+		return
+	}
+	for _, sess := range all {
+		if sess.IsLoggedIn() && sess.UserID == c.s.UserID &&
+			sess.InstanceDomain == c.s.InstanceDomain {
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+	return
+}
+
+func (s *service) SessionsPage(c *client) (err error) {
+	sessions, err := s.accountSessions(c)
+	if err != nil {
+		return
+	}
+	var infos []renderer.SessionInfo
+	for _, sess := range sessions {
+		infos = append(infos, renderer.SessionInfo{
+			ID:        sessionHandle(sess.ID),
+			Created:   sess.Created,
+			LastUsed:  sess.LastUsed,
+			UserAgent: sess.UserAgent,
+			Current:   sess.ID == c.s.ID,
+		})
+	}
+	cdata := s.cdata(c, "sessions", 0, 0, "")
+	data := &renderer.SessionsData{
+		CommonData: cdata,
+		Sessions:   infos,
+		Sealed:     s.sealer != nil,
+	}
+	return s.render(c, renderer.SessionsPage, data)
+}
+
+// RevokeSession signs out the session of the account with the handle id,
+// which must not be the current session.
+func (s *service) RevokeSession(c *client, id string) (err error) {
+	sessions, err := s.accountSessions(c)
+	if err != nil {
+		return
+	}
+	for _, sess := range sessions {
+		if sessionHandle(sess.ID) == id && sess.ID != c.s.ID {
+			s.revokeSession(c, sess)
+			return
+		}
+	}
+	return errInvalidArgument
+}
+
+// SignoutEverywhere signs out all the sessions of the account, including the
+// current one.
+func (s *service) SignoutEverywhere(c *client) (err error) {
+	sessions, err := s.accountSessions(c)
+	if err != nil {
+		return
+	}
+	for _, sess := range sessions {
+		if sess.ID != c.s.ID {
+			s.revokeSession(c, sess)
+		}
+	}
+	return s.Signout(c)
+}
+
+func (s *service) Post(c *client, content string, replyToID string,
+	format string, visibility string, isNSFW bool,
+	files []*multipart.FileHeader, mediaIDs []string) (id string, err error) {
+
+	for _, f := range files {
+		a, err := c.UploadMediaFromMultipartFileHeader(c.ctx, f)
+		if err != nil {
+			return "", err
+		}
+		mediaIDs = append(mediaIDs, a.ID)
+	}
+
+	tweet := &mastodon.Toot{
+		Status:      content,
+		InReplyToID: replyToID,
+		MediaIDs:    mediaIDs,
+		ContentType: format,
+		Visibility:  visibility,
+		Sensitive:   isNSFW,
+	}
+	// GoToSocial has no local visibility, its local only posts are public
+	// posts that aren't federated
+	if visibility == "local" && isGoToSocial(c.s.InstanceVersion) {
+		tweet.Visibility = "public"
+		tweet.LocalOnly = true
+	}
+	st, err := c.PostStatus(c.ctx, tweet)
+	if err != nil {
+		return
 	}
-	return s.renderer.Render(c.rctx, c.w, renderer.SearchPage, data)
+	return st.ID, nil
 }
 
-func (s *service) SettingsPage(c *client) (err error) {
-	cdata := s.cdata(c, "settings", 0, 0, "")
-	data := &renderer.SettingsData{
-		CommonData:  cdata,
-		Settings:    &c.s.Settings,
-		PostFormats: s.postFormats,
-	}
-	return s.renderer.Render(c.rctx, c.w, renderer.SettingsPage, data)
+// Attachments are uploaded in chunks in fluoride mode, so that an upload that
+// fails midway, e.g. on a mobile connection, can be resumed where it stopped.
+// The chunks are appended to a file in uploadDir, which is sent to the
+// instance once it's complete. Uploads left unfinished are removed after
+// uploadMaxAge.
+const uploadMaxAge = 24 * time.Hour
+
+// UploadState is the progress of an upload. MediaID is the ID of the
+// attachment once the upload is complete.
+type UploadState struct {
+	ID      string `json:"id"`
+	Offset  int64  `json:"offset"`
+	MediaID string `json:"media_id,omitempty"`
 }
 
-func (svc *service) FiltersPage(c *client) (err error) {
-	filters, err := c.GetFilters(c.ctx)
-	if err != nil {
-		return
+// uploadPath returns the path of the upload id of the account of c. The
+// uploads of other accounts can't be reached with their IDs. The uploads
+// aren't kept by session, as the ID of sealed sessions changes whenever
+// they're saved.
+func (s *service) uploadPath(c *client, id string) (string, error) {
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9') {
+			return "", errInvalidArgument
+		}
 	}
-	cdata := svc.cdata(c, "filters", 0, 0, "")
-	data := &renderer.FiltersData{
-		CommonData: cdata,
-		Filters:    filters,
+	if len(id) < 1 {
+		return "", errInvalidArgument
 	}
-	return svc.renderer.Render(c.rctx, c.w, renderer.FiltersPage, data)
+	owner := sessionHandle(rateLimitKey(c))
+	return filepath.Join(s.uploadDir, owner+"-"+id), nil
 }
 
-func (s *service) SingleInstance() (instance string, ok bool) {
-	if len(s.instance) > 0 {
-		instance = s.instance
-		ok = true
+// CleanUploads removes the uploads that weren't continued for uploadMaxAge.
+func (s *service) CleanUploads() (err error) {
+	files, err := ioutil.ReadDir(s.uploadDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && time.Since(fi.ModTime()) > uploadMaxAge {
+			os.Remove(filepath.Join(s.uploadDir, fi.Name()))
+		}
 	}
 	return
 }
 
-func (s *service) NewSession(c *client, instance string) (rurl string, sid string, err error) {
-	var instanceURL string
-	if strings.HasPrefix(instance, "https://") {
-		instanceURL = instance
-		instance = strings.TrimPrefix(instance, "https://")
-	} else {
-		instanceURL = "https://" + instance
+// UploadChunk appends chunk at offset to the upload id of the file name,
+// which is size bytes large, starting a new upload if id is empty. A chunk
+// at another offset than the end of the upload is ignored, and the offset to
+// go on from is returned instead, e.g. after the response to the previous
+// chunk got lost.
+func (s *service) UploadChunk(c *client, id string, offset int64,
+	size int64, name string, chunk io.Reader) (st *UploadState, err error) {
+
+	limit := s.uploadLimit(c)
+	if limit > 0 && size > limit {
+		return nil, uploadTooLarge(c, limit)
+	}
+	if size < 1 || offset < 0 || offset > size {
+		return nil, errInvalidArgument
+	}
+	flags := os.O_WRONLY | os.O_APPEND
+	if len(id) < 1 {
+		if offset > 0 {
+			return nil, errUploadNotFound
+		}
+		id, err = util.NewRandID(24)
+		if err != nil {
+			return
+		}
+		flags |= os.O_CREATE | os.O_EXCL
 	}
-
-	sid, err = util.NewSessionID()
+	p, err := s.uploadPath(c, id)
 	if err != nil {
 		return
 	}
-	csrf, err := util.NewCSRFToken()
+	f, err := os.OpenFile(p, flags, 0600)
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
 	if err != nil {
 		return
 	}
+	st = &UploadState{ID: id, Offset: fi.Size()}
+	if offset != st.Offset {
+		return st, nil
+	}
+	n, err := io.Copy(f, io.LimitReader(chunk, size-offset))
+	st.Offset += n
+	if err != nil || st.Offset < size {
+		return
+	}
 
-	sess := model.Session{
-		ID:             sid,
-		InstanceDomain: instance,
-		CSRFToken:      csrf,
-		Settings:       *model.NewSettings(),
+	// The complete file stays until the instance has it, so that the
+	// last chunk can be sent again if the instance fails
+	rf, err := os.Open(p)
+	if err != nil {
+		return
 	}
-	err = s.sessionRepo.Add(sess)
+	defer rf.Close()
+	fname := filepath.Base(name)
+	a, err := c.UploadMediaFile(c.ctx, &mastodon.Media{
+		Name:        fname,
+		Description: fname,
+		Size:        size,
+		Reader:      rf,
+	})
 	if err != nil {
 		return
 	}
+	os.Remove(p)
+	st.MediaID = a.ID
+	return st, nil
+}
+
+// UploadOffset returns the progress of the upload id, for resuming it.
+func (s *service) UploadOffset(c *client, id string) (st *UploadState,
+	err error) {
 
-	app, err := s.appRepo.Get(instance)
+	p, err := s.uploadPath(c, id)
 	if err != nil {
-		if err != model.ErrAppNotFound {
-			return
-		}
-		mastoApp, err := mastodon.RegisterApp(c.ctx, &mastodon.AppConfig{
-			Server:       instanceURL,
-			ClientName:   s.cname,
-			Scopes:       s.cscope,
-			Website:      s.cwebsite,
-			RedirectURIs: s.cwebsite + "/oauth_callback",
-		})
-		if err != nil {
-			return "", "", err
-		}
-		app = model.App{
-			InstanceDomain: instance,
-			InstanceURL:    instanceURL,
-			ClientID:       mastoApp.ClientID,
-			ClientSecret:   mastoApp.ClientSecret,
-		}
-		err = s.appRepo.Add(app)
-		if err != nil {
-			return "", "", err
-		}
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, errUploadNotFound
 	}
+	return &UploadState{ID: id, Offset: fi.Size()}, nil
+}
 
-	u, err := url.Parse("/oauth/authorize")
+// ReplyForm returns the rendered post form for replying to the status id,
+// for showing it inline below the status.
+func (s *service) ReplyForm(c *client, id string) (content string, err error) {
+	status, err := c.GetStatus(c.ctx, id)
 	if err != nil {
 		return
 	}
+	pctx := s.replyPostContext(c, status)
+	var buf bytes.Buffer
+	err = s.renderer.Render(c.rctx, &buf, renderer.PostFormPage, &pctx)
+	if err != nil {
+		return
+	}
+	return buf.String(), nil
+}
 
-	q := make(url.Values)
-	q.Set("scope", "read write follow")
-	q.Set("client_id", app.ClientID)
-	q.Set("response_type", "code")
-	q.Set("redirect_uri", s.cwebsite+"/oauth_callback")
-	u.RawQuery = q.Encode()
+// StatusFragment returns the rendered status id, for inserting it into an
+// already loaded page.
+func (s *service) StatusFragment(c *client, id string) (content string,
+	err error) {
 
-	rurl = instanceURL + u.String()
-	return
+	status, err := c.GetStatus(c.ctx, id)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	err = s.renderer.Render(c.rctx, &buf, renderer.StatusPage, status)
+	if err != nil {
+		return
+	}
+	return buf.String(), nil
 }
 
-func (s *service) Signin(c *client, code string) (err error) {
-	if len(code) < 1 {
-		err = errInvalidArgument
-		return
+var (
+	htmlBreakRE = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	htmlTagRE   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlToText returns the text of the HTML content of a status, with the
+// whitespace collapsed.
+func htmlToText(content string) string {
+	content = htmlBreakRE.ReplaceAllString(content, " ")
+	content = htmlTagRE.ReplaceAllString(content, "")
+	return strings.Join(strings.Fields(html.UnescapeString(content)), " ")
+}
+
+// statusMeta returns the metadata for previews of links to the thread of
+// status. The content behind a content warning isn't shown, neither are
+// sensitive images.
+func (s *service) statusMeta(status *mastodon.Status) *renderer.Meta {
+	name := status.Account.DisplayName
+	if len(name) < 1 {
+		name = status.Account.Username
+	}
+	desc := htmlToText(status.Content)
+	if len(status.SpoilerText) > 0 {
+		desc = "CW: " + status.SpoilerText
+	}
+	if r := []rune(desc); len(r) > 300 {
+		desc = string(r[:299]) + "…"
+	}
+	image := status.Account.Avatar
+	if !status.Sensitive {
+		for _, a := range status.MediaAttachments {
+			if a.Type == "image" {
+				image = a.PreviewURL
+				break
+			}
+		}
 	}
-	err = c.AuthenticateToken(c.ctx, code, s.cwebsite+"/oauth_callback")
+	return &renderer.Meta{
+		SiteName:    s.cname,
+		Title:       name + " (@" + status.Account.Acct + ")",
+		Description: desc,
+		Image:       image,
+		URL:         s.cwebsite + "/status/" + status.ID,
+	}
+}
+
+// Manifest writes the web app manifest, which lets browsers install bloat
+// as an app.
+func (s *service) Manifest(c *client) (err error) {
+	c.w.Header().Set("Content-Type", "application/manifest+json")
+	return json.NewEncoder(c.w).Encode(map[string]interface{}{
+		"name":             s.cname,
+		"short_name":       s.cname,
+		"start_url":        s.basePath + "/",
+		"scope":            s.basePath + "/",
+		"display":          "standalone",
+		"background_color": "#d2d2d2",
+		"theme_color":      "#d2d2d2",
+		"icons": []map[string]string{
+			{
+				"src":   s.basePath + "/static/icon-192.png",
+				"sizes": "192x192",
+				"type":  "image/png",
+			},
+			{
+				"src":   s.basePath + "/static/icon-512.png",
+				"sizes": "512x512",
+				"type":  "image/png",
+			},
+		},
+	})
+}
+
+// PermalinkPage shows a single status, without the rest of its thread, for
+// sharing it.
+func (s *service) PermalinkPage(c *client, id string) (err error) {
+	status, err := c.GetStatus(c.ctx, id)
 	if err != nil {
 		return
 	}
-	u, err := c.GetAccountCurrentUser(c.ctx)
+	cdata := s.cdata(c, "post by "+status.Account.DisplayName, 0, 0, "")
+	cdata.Meta = s.statusMeta(status)
+	data := &renderer.PermalinkData{
+		CommonData: cdata,
+		Status:     status,
+	}
+	return s.render(c, renderer.PermalinkPage, data)
+}
+
+// PublicStatusPage shows a public status of the instance of single instance
+// mode to visitors who aren't signed in. The status is fetched without an
+// access token, with the client config of the app registered with the
+// single_instance, so only the ones visible to everyone are shown.
+func (s *service) PublicStatusPage(c *client, id string) (err error) {
+	domain, _ := instanceAddress(s.instance)
+	app, err := s.appRepo.Get(domain)
+	if err != nil {
+		return errInvalidSession
+	}
+	c.Client = mastodon.NewClient(&mastodon.Config{
+		Server:       app.InstanceURL,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+		HTTPClient:   s.httpClient,
+	})
+	status, err := c.GetStatus(c.ctx, id)
 	if err != nil {
 		return
 	}
-	c.s.AccessToken = c.GetAccessToken(c.ctx)
-	c.s.UserID = u.ID
-	return s.sessionRepo.Add(c.s)
+	if status.Visibility != "public" && status.Visibility != "unlisted" {
+		return errInvalidSession
+	}
+	cdata := s.cdata(c, "post by "+status.Account.DisplayName, 0, 0, "")
+	cdata.Meta = s.statusMeta(status)
+	data := &renderer.PublicStatusData{
+		CommonData: cdata,
+		Status:     status,
+	}
+	return s.render(c, renderer.PublicStatusPage, data)
 }
 
-func (s *service) Signout(c *client) (err error) {
-	s.sessionRepo.Remove(c.s.ID)
-	return
+// renderPlainText formats plain text content the way Mastodon does, with
+// paragraphs separated by blank lines. Links, mentions and hashtags are left
+// as is.
+func renderPlainText(content string) string {
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	var b strings.Builder
+	for _, p := range strings.Split(content, "\n\n") {
+		p = strings.TrimSpace(p)
+		if len(p) < 1 {
+			continue
+		}
+		p = html.EscapeString(p)
+		b.WriteString("<p>")
+		b.WriteString(strings.Replace(p, "\n", "<br>", -1))
+		b.WriteString("</p>")
+	}
+	return b.String()
 }
 
-func (s *service) Post(c *client, content string, replyToID string,
-	format string, visibility string, isNSFW bool,
-	files []*multipart.FileHeader) (id string, err error) {
+var (
+	markdownCode   = regexp.MustCompile("`([^`]+)`")
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s()]+)\)`)
+	markdownBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic = regexp.MustCompile(`\*([^*]+)\*`)
+)
 
-	var mediaIDs []string
-	for _, f := range files {
-		a, err := c.UploadMediaFromMultipartFileHeader(c.ctx, f)
-		if err != nil {
-			return "", err
+// renderMarkdown formats markdown content for the preview, like
+// renderPlainText with the common inline syntax: code, links, bold and
+// italics. The rest, e.g. lists and headings, is shown as is.
+func renderMarkdown(content string) string {
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	var b strings.Builder
+	for _, p := range strings.Split(content, "\n\n") {
+		p = strings.TrimSpace(p)
+		if len(p) < 1 {
+			continue
 		}
-		mediaIDs = append(mediaIDs, a.ID)
+		b.WriteString("<p>")
+		for i, line := range strings.Split(p, "\n") {
+			if i > 0 {
+				b.WriteString("<br>")
+			}
+			// Code spans are kept as is, the text around them
+			// is formatted
+			last := 0
+			for _, m := range markdownCode.FindAllStringSubmatchIndex(line, -1) {
+				b.WriteString(renderMarkdownText(line[last:m[0]]))
+				b.WriteString("<code>")
+				b.WriteString(html.EscapeString(line[m[2]:m[3]]))
+				b.WriteString("</code>")
+				last = m[1]
+			}
+			b.WriteString(renderMarkdownText(line[last:]))
+		}
+		b.WriteString("</p>")
 	}
+	return b.String()
+}
 
-	tweet := &mastodon.Toot{
-		Status:      content,
-		InReplyToID: replyToID,
-		MediaIDs:    mediaIDs,
-		ContentType: format,
-		Visibility:  visibility,
-		Sensitive:   isNSFW,
+func renderMarkdownText(s string) string {
+	s = html.EscapeString(s)
+	s = markdownLink.ReplaceAllString(s,
+		`<a href="$2" rel="nofollow noopener noreferrer" target="_blank">$1</a>`)
+	s = markdownBold.ReplaceAllString(s, "<strong>$1</strong>")
+	return markdownItalic.ReplaceAllString(s, "<em>$1</em>")
+}
+
+// PreviewPage shows how the content would look once posted, along with the
+// post form to edit or post it. Pleroma renders the preview itself, for other
+// instances only plain text and markdown are rendered locally.
+func (s *service) PreviewPage(c *client, content string, replyToID string,
+	format string, visibility string, isNSFW bool, hadAttachments bool,
+	referrer string) (err error) {
+
+	var st *mastodon.Status
+	_, _, pleroma := parseVersion(c.s.InstanceVersion)
+	if pleroma {
+		st, err = c.PreviewStatus(c.ctx, &mastodon.Toot{
+			Status:      content,
+			InReplyToID: replyToID,
+			ContentType: format,
+			Visibility:  visibility,
+			Sensitive:   isNSFW,
+		})
+		if err == mastodon.ErrPreviewUnsupported {
+			pleroma, err = false, nil
+		} else if err != nil {
+			return
+		}
 	}
-	st, err := c.PostStatus(c.ctx, tweet)
-	if err != nil {
-		return
+	if !pleroma {
+		st = &mastodon.Status{
+			Content:   renderPlainText(content),
+			Sensitive: isNSFW,
+		}
+		if format == "text/markdown" {
+			st.Content = renderMarkdown(content)
+		}
 	}
-	return st.ID, nil
+
+	pctx := model.PostContext{
+		DefaultVisibility: visibility,
+		DefaultFormat:     format,
+		Formats:           s.instancePostFormats(c),
+		Content:           content,
+	}
+	if len(replyToID) > 0 {
+		var status *mastodon.Status
+		status, err = c.GetStatus(c.ctx, replyToID)
+		if err != nil {
+			return
+		}
+		pctx.ReplyContext = &model.ReplyContext{
+			InReplyToID:     replyToID,
+			InReplyToName:   status.Account.Acct,
+			ForceVisibility: status.Visibility == "direct",
+		}
+	}
+
+	// Posting from the preview goes back to where the post form was
+	c.rctx.Referrer = referrer
+
+	cdata := s.cdata(c, "preview", 0, 0, "")
+	data := &renderer.PreviewData{
+		CommonData:     cdata,
+		Status:         st,
+		PostContext:    pctx,
+		HadAttachments: hadAttachments,
+		Unformatted: !pleroma && len(format) > 0 &&
+			format != "text/plain" && format != "text/markdown",
+	}
+	return s.render(c, renderer.PreviewPage, data)
 }
 
 func (s *service) Like(c *client, id string) (count int64, err error) {
@@ -832,51 +3528,85 @@ func (s *service) Vote(c *client, id string, choices []string) (err error) {
 	return
 }
 
-func (s *service) Follow(c *client, id string, reblogs *bool) (err error) {
-	_, err = c.AccountFollow(c.ctx, id, reblogs)
+func (s *service) Follow(c *client, id string, reblogs *bool) (
+	rel *mastodon.Relationship, err error) {
+	rel, err = c.AccountFollow(c.ctx, id, reblogs, nil)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
-func (s *service) UnFollow(c *client, id string) (err error) {
-	_, err = c.AccountUnfollow(c.ctx, id)
+func (s *service) UnFollow(c *client, id string) (
+	rel *mastodon.Relationship, err error) {
+	rel, err = c.AccountUnfollow(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
+// Accept and Reject don't return the relationship, which changes along
+// with the follow request, so the cached one is removed.
 func (s *service) Accept(c *client, id string) (err error) {
-	return c.FollowRequestAuthorize(c.ctx, id)
+	err = c.FollowRequestAuthorize(c.ctx, id)
+	s.cacheRelationship(c, id, nil)
+	return
 }
 
 func (s *service) Reject(c *client, id string) (err error) {
-	return c.FollowRequestReject(c.ctx, id)
+	err = c.FollowRequestReject(c.ctx, id)
+	s.cacheRelationship(c, id, nil)
+	return
 }
 
-func (s *service) Mute(c *client, id string) (err error) {
-	_, err = c.AccountMute(c.ctx, id)
+func (s *service) Mute(c *client, id string) (
+	rel *mastodon.Relationship, err error) {
+	rel, err = c.AccountMute(c.ctx, id, nil)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
-func (s *service) UnMute(c *client, id string) (err error) {
-	_, err = c.AccountUnmute(c.ctx, id)
+func (s *service) UnMute(c *client, id string) (
+	rel *mastodon.Relationship, err error) {
+	rel, err = c.AccountUnmute(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
 func (s *service) Block(c *client, id string) (err error) {
-	_, err = c.AccountBlock(c.ctx, id)
+	rel, err := c.AccountBlock(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
 func (s *service) UnBlock(c *client, id string) (err error) {
-	_, err = c.AccountUnblock(c.ctx, id)
+	rel, err := c.AccountUnblock(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
 func (s *service) Subscribe(c *client, id string) (err error) {
-	_, err = c.Subscribe(c.ctx, id)
+	rel, err := c.Subscribe(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
 func (s *service) UnSubscribe(c *client, id string) (err error) {
-	_, err = c.UnSubscribe(c.ctx, id)
+	rel, err := c.UnSubscribe(c.ctx, id)
+	if err == nil {
+		s.cacheRelationship(c, id, rel)
+	}
 	return
 }
 
@@ -889,12 +3619,116 @@ func (s *service) SaveSettings(c *client, settings *model.Settings) (err error)
 	if len(settings.CSS) > 1<<20 {
 		return errInvalidArgument
 	}
-	sess, err := s.sessionRepo.Get(c.s.ID)
+	if _, err = time.LoadLocation(settings.Timezone); err != nil {
+		return errInvalidArgument
+	}
+	if len(settings.Theme) > 0 && settings.Theme != model.ThemeAuto &&
+		!s.isTheme(settings.Theme) {
+		return errInvalidArgument
+	}
+	sess, err := s.loadSession(c.s.ID)
 	if err != nil {
 		return
 	}
 	sess.Settings = *settings
-	return s.sessionRepo.Add(sess)
+	if s.sealer == nil && sess.IsLoggedIn() {
+		err = s.accountSettingsRepo.Add(accountSettingsKey(sess),
+			settings.AccountSettings())
+		if err != nil {
+			return
+		}
+	}
+	return s.saveSession(c, &sess)
+}
+
+// settingsExport is the file of a settings export, which can be imported on
+// any bloat server.
+type settingsExport struct {
+	Settings model.Settings     `json:"settings"`
+	Filters  []*mastodon.Filter `json:"filters"`
+}
+
+// The largest settings file accepted, which leaves room for the largest
+// custom CSS
+const maxSettingsImport = 2 << 20
+
+// ExportSettings sends the settings of the session, along with the filters
+// of the account, as a JSON file.
+func (s *service) ExportSettings(c *client) (err error) {
+	filters, err := c.GetFilters(c.ctx)
+	if err != nil {
+		return
+	}
+	c.w.Header().Set("Content-Type", "application/json")
+	c.w.Header().Set("Content-Disposition",
+		"attachment; filename=\"bloat-settings.json\"")
+	enc := json.NewEncoder(c.w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(settingsExport{c.s.Settings, filters})
+}
+
+// ImportSettings replaces the settings with the ones of an export, and adds
+// the filters of the export whose phrase isn't filtered yet. Settings
+// missing from the export get their default value, a theme that this server
+// doesn't have is reset to the default one, and expired filters are skipped.
+func (s *service) ImportSettings(c *client, r io.Reader) (err error) {
+	e := settingsExport{Settings: *model.NewSettings()}
+	err = json.NewDecoder(io.LimitReader(r, maxSettingsImport)).Decode(&e)
+	if err != nil {
+		return errInvalidArgument
+	}
+	sett := &e.Settings
+	if len(sett.Theme) > 0 && sett.Theme != model.ThemeAuto &&
+		!s.isTheme(sett.Theme) {
+		sett.Theme = ""
+	}
+	var cssSnippets []string
+	for _, id := range sett.CSSSnippets {
+		if model.IsCSSSnippet(id) {
+			cssSnippets = append(cssSnippets, id)
+		}
+	}
+	sett.CSSSnippets = cssSnippets
+	err = s.SaveSettings(c, sett)
+	if err != nil {
+		return
+	}
+
+	filters, err := c.GetFilters(c.ctx)
+	if err != nil {
+		return
+	}
+	filtered := make(map[string]bool)
+	for _, f := range filters {
+		filtered[f.Phrase] = true
+	}
+	for _, f := range e.Filters {
+		if f == nil || len(f.Phrase) < 1 || filtered[f.Phrase] {
+			continue
+		}
+		var expiresIn int
+		if f.ExpiresAt != nil {
+			expiresIn = int(time.Until(*f.ExpiresAt).Seconds())
+			if expiresIn < 1 {
+				continue
+			}
+		}
+		err = s.Filter(c, f.Phrase, f.WholeWord, f.Context, expiresIn)
+		if err != nil {
+			return
+		}
+		filtered[f.Phrase] = true
+	}
+	return
+}
+
+func (s *service) isTheme(name string) bool {
+	for _, t := range s.themes {
+		if t == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *service) MuteConversation(c *client, id string) (err error) {
@@ -912,7 +3746,42 @@ func (s *service) Delete(c *client, id string) (err error) {
 }
 
 func (s *service) ReadNotifications(c *client, maxID string) (err error) {
-	return c.ReadNotifications(c.ctx, maxID)
+	// Either of the two is enough, markers are not supported by older
+	// instances and the read endpoint only exists on Pleroma.
+	merr := c.SetMarker(c.ctx, "notifications", maxID)
+	err = c.ReadNotifications(c.ctx, maxID)
+	if merr == nil {
+		err = nil
+	}
+	return
+}
+
+func (s *service) DismissNotifications(c *client, ids []string) (err error) {
+	for _, id := range ids {
+		err = c.DismissNotification(c.ctx, id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *service) ClearNotifications(c *client) (err error) {
+	return c.ClearNotifications(c.ctx)
+}
+
+func (s *service) AcceptNotificationRequest(c *client, id string) (err error) {
+	return c.AcceptNotificationRequest(c.ctx, id)
+}
+
+func (s *service) DismissNotificationRequest(c *client, id string) (err error) {
+	return c.DismissNotificationRequest(c.ctx, id)
+}
+
+func (s *service) SaveNotificationPolicy(c *client,
+	policy *mastodon.NotificationPolicy) (err error) {
+	_, err = c.UpdateNotificationPolicy(c.ctx, policy)
+	return
 }
 
 func (s *service) Bookmark(c *client, id string) (err error) {
@@ -925,9 +3794,27 @@ func (s *service) UnBookmark(c *client, id string) (err error) {
 	return
 }
 
-func (svc *service) Filter(c *client, phrase string, wholeWord bool) (err error) {
-	fctx := []string{"home", "notifications", "public", "thread"}
-	return c.AddFilter(c.ctx, phrase, fctx, true, wholeWord, nil)
+var filterContexts = []string{"home", "notifications", "public", "thread"}
+
+func (svc *service) Filter(c *client, phrase string, wholeWord bool,
+	fctx []string, expiresIn int) (err error) {
+
+	if len(fctx) < 1 || expiresIn < 0 {
+		return errInvalidArgument
+	}
+	for _, ctx := range fctx {
+		valid := false
+		for _, fc := range filterContexts {
+			if ctx == fc {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errInvalidArgument
+		}
+	}
+	return c.AddFilter(c.ctx, phrase, fctx, true, wholeWord, expiresIn)
 }
 
 func (svc *service) UnFilter(c *client, id string) (err error) {
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"testing"
+
+	"bloat/renderer"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		major   int
+		minor   int
+		pleroma bool
+	}{
+		{"4.3.1", 4, 3, false},
+		{"4.2.0+glitch", 4, 2, false},
+		{"4.4.0-beta.1", 4, 4, false},
+		{"3.0.1 (compatible; Hometown 1.0.6)", 3, 0, false},
+		{"2.7.2 (compatible; Pleroma 2.5.0)", 2, 7, true},
+		{"2.7.2 (compatible; Akkoma 3.10.4)", 2, 7, true},
+		{"0.16.0 git-b3e29a4", 0, 16, false},
+		{"0.17.3+git-2f3d4bb", 0, 17, false},
+		{"4", 4, 0, false},
+		{"unknown", 0, 0, false},
+		{"", 0, 0, false},
+		{" ", 0, 0, false},
+	}
+	for _, test := range tests {
+		major, minor, pleroma := parseVersion(test.version)
+		if major != test.major || minor != test.minor ||
+			pleroma != test.pleroma {
+			t.Errorf("parseVersion(%q) = %d, %d, %v, want %d, %d, %v",
+				test.version, major, minor, pleroma,
+				test.major, test.minor, test.pleroma)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		caps    renderer.Capabilities
+	}{
+		{"unknown", "", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			NotificationRequests: true,
+		}},
+		{"unparsable", "unknown", renderer.Capabilities{}},
+		{"mastodon 3.0", "3.0.2", renderer.Capabilities{}},
+		{"mastodon 3.1", "3.1.0", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+		}},
+		{"mastodon 4.2", "4.2.10", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+		}},
+		{"mastodon 4.3", "4.3.0", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			NotificationRequests: true,
+		}},
+		{"mastodon 5", "5.0.0", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			NotificationRequests: true,
+		}},
+		{"pleroma", "2.7.2 (compatible; Pleroma 2.5.0)", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			LocalVisibility:      true,
+		}},
+		{"akkoma", "2.7.2 (compatible; Akkoma 3.10.4)", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			LocalVisibility:      true,
+		}},
+		{"gotosocial", "0.16.0 git-b3e29a4", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			LocalVisibility:      true,
+		}},
+		{"gotosocial+git", "0.17.3+git-2f3d4bb", renderer.Capabilities{
+			Bookmarks:            true,
+			DismissNotifications: true,
+			LocalVisibility:      true,
+		}},
+	}
+	for _, test := range tests {
+		caps := capabilities(test.version)
+		if caps != test.caps {
+			t.Errorf("%s: capabilities(%q) = %+v, want %+v", test.name,
+				test.version, caps, test.caps)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		content string
+		html    string
+	}{
+		{"plain", "<p>plain</p>"},
+		{"**bold** and *italic*", "<p><strong>bold</strong> and <em>italic</em></p>"},
+		{"`**code**` <b>", "<p><code>**code**</code> &lt;b&gt;</p>"},
+		{"[a link](https://example.com/?a=1&b=2)",
+			`<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener noreferrer" target="_blank">a link</a></p>`},
+		{"[no](javascript:alert(1))", "<p>[no](javascript:alert(1))</p>"},
+		{"one\r\ntwo\r\n\r\nthree", "<p>one<br>two</p><p>three</p>"},
+	}
+	for _, test := range tests {
+		html := renderMarkdown(test.content)
+		if html != test.html {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", test.content,
+				html, test.html)
+		}
+	}
+}
@@ -3,22 +3,23 @@ package service
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"bloat/mastodon"
 	"bloat/model"
 	"bloat/renderer"
+	"bloat/util"
 
 	"github.com/gorilla/mux"
 )
 
-const (
-	sessionExp = 365 * 24 * time.Hour
-)
-
 const (
 	HTML int = iota
 	JSON
@@ -38,39 +39,227 @@ type client struct {
 	csrf string
 	ctx  context.Context
 	rctx *renderer.Context
+	// wantJSON is set if the data of the page is to be written as JSON
+	wantJSON bool
+	// base is the path bloat is served under
+	base string
 }
 
-func setSessionCookie(w http.ResponseWriter, sid string, exp time.Duration) {
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_id",
-		Value:   sid,
-		Expires: time.Now().Add(exp),
+// setCookie sets a cookie for all the pages of bloat. The cookies are only
+// for bloat itself, so scripts can't read them, and they aren't sent along
+// with requests that other sites make, except for following links, which
+// the OAuth callback needs.
+func (s *service) setCookie(c *client, name string, value string,
+	exp time.Duration) {
+	http.SetCookie(c.w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.basePath + "/",
+		Expires:  time.Now().Add(exp),
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: s.cookieSameSite,
 	})
 }
 
+func (s *service) setSessionCookie(c *client, sid string,
+	exp time.Duration) {
+	s.setCookie(c, "session_id", sid, exp)
+}
+
+// The IDs of the sessions of the other accounts signed in from the browser
+// are kept in the session_ids cookie.
+func getSessionIDs(r *http.Request) (ids []string) {
+	cookie, _ := r.Cookie("session_ids")
+	if cookie == nil {
+		return
+	}
+	for _, id := range strings.Split(cookie.Value, ",") {
+		if len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+func (s *service) setSessionIDsCookie(c *client, ids []string,
+	exp time.Duration) {
+	s.setCookie(c, "session_ids", strings.Join(ids, ","), exp)
+}
+
+// keepSession moves the current session to the session_ids cookie, so that
+// it's still available after signing in with another account. Sealed
+// sessions are a few KB each, so several of them don't fit into the cookie,
+// and signing in replaces the session instead.
+func (s *service) keepSession(c *client, exp time.Duration) {
+	if s.sealer != nil {
+		return
+	}
+	cookie, _ := c.r.Cookie("session_id")
+	if cookie == nil || len(cookie.Value) < 1 {
+		return
+	}
+	ids := getSessionIDs(c.r)
+	for _, id := range ids {
+		if id == cookie.Value {
+			return
+		}
+	}
+	s.setSessionIDsCookie(c, append(ids, cookie.Value), exp)
+}
+
+// wantsJSON reports whether the request prefers JSON to HTML, so that pages
+// can be used by scripts and other frontends.
+func wantsJSON(r *http.Request) bool {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		t = strings.TrimSpace(t)
+		if i := strings.IndexByte(t, ';'); i >= 0 {
+			t = strings.TrimSpace(t[:i])
+		}
+		switch t {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
 func writeJson(c *client, data interface{}) error {
 	return json.NewEncoder(c.w).Encode(map[string]interface{}{
 		"data": data,
 	})
 }
 
+// clientIP returns the address of the browser. Requests that come from the
+// local machine, e.g. through a reverse proxy or a unix socket, are taken to
+// be forwarded, so the address added by the proxy is used for them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+		return host
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+		addrs := strings.Split(fwd, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	if ip := r.Header.Get("X-Real-IP"); len(ip) > 0 {
+		return ip
+	}
+	return host
+}
+
+// redirect redirects to url, which is under the base path if it's a path.
 func redirect(c *client, url string) {
+	if strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//") {
+		url = c.base + url
+	}
 	c.w.Header().Add("Location", url)
 	c.w.WriteHeader(http.StatusFound)
 }
 
-func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
+// stripBasePath serves the requests under base with h, with base removed
+// from their path. The base path itself is redirected to the root page.
+func stripBasePath(base string, h http.Handler) http.Handler {
+	strip := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// routeTemplate returns the path template of the route of req, e.g.
+// "/user/{id}".
+func routeTemplate(req *http.Request) string {
+	t, err := mux.CurrentRoute(req).GetPathTemplate()
+	if err != nil {
+		return "other"
+	}
+	return t
+}
+
+func NewHandler(s *service, logger *util.Logger, staticFS http.FileSystem,
+	staticHashes map[string]string, metrics *util.Metrics,
+	accessLog *util.AccessLog) http.Handler {
 	r := mux.NewRouter()
+	// Requests are counted by the path template of their route, to keep
+	// the number of series small
+	r.Use(metrics.Middleware(routeTemplate))
+
+	// switchSession switches to the next signed in account after the
+	// current session is gone, or clears the session cookies if there's
+	// none.
+	switchSession := func(c *client) {
+		ids := getSessionIDs(c.r)
+		sessions := s.OtherSessions(ids)
+		if len(sessions) > 0 {
+			var rest []string
+			for _, sess := range sessions[1:] {
+				rest = append(rest, sess.ID)
+			}
+			s.setSessionIDsCookie(c, rest, s.sessionExp)
+			s.setSessionCookie(c, sessions[0].ID, s.sessionExp)
+		} else {
+			s.setSessionCookie(c, "", 0)
+			if len(ids) > 0 {
+				s.setSessionIDsCookie(c, nil, s.sessionExp)
+			}
+		}
+	}
 
 	writeError := func(c *client, err error, t int, retry bool) {
+		// The access token was revoked or has expired, so the session
+		// is useless and the user has to sign in again
+		if errors.Is(err, mastodon.ErrUnauthorized) && len(c.s.ID) > 0 {
+			s.RemoveSession(c)
+			switchSession(c)
+			if t == HTML {
+				redirect(c, "/signin?expired=true")
+				return
+			}
+			c.w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(c.w).Encode(map[string]string{
+				"error":      err.Error(),
+				"request_id": util.RequestID(c.ctx),
+			})
+			return
+		}
+		status := http.StatusInternalServerError
+		var rerr *mastodon.RateLimitError
+		if err == errRateLimited {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, errUploadTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		} else if err == errUploadNotFound || err == errAvatarNotFound {
+			status = http.StatusNotFound
+		} else if err == errUnsupportedMedia {
+			status = http.StatusUnsupportedMediaType
+		} else if errors.As(err, &rerr) {
+			s.NoteRateLimit(c, err)
+			status = http.StatusTooManyRequests
+			c.w.Header().Set("Retry-After",
+				strconv.Itoa(int(rerr.RetryAfter().Seconds())))
+		}
 		switch t {
 		case HTML:
-			c.w.WriteHeader(http.StatusInternalServerError)
+			c.w.WriteHeader(status)
 			s.ErrorPage(c, err, retry)
 		case JSON:
-			c.w.WriteHeader(http.StatusInternalServerError)
+			c.w.WriteHeader(status)
 			json.NewEncoder(c.w).Encode(map[string]string{
-				"error": err.Error(),
+				"error":      err.Error(),
+				"request_id": util.RequestID(c.ctx),
 			})
 		}
 	}
@@ -80,25 +269,51 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		if cookie, _ := c.r.Cookie("session_id"); cookie != nil {
 			sid = cookie.Value
 		}
-		csrf := c.r.FormValue("csrf_token")
 		ref := c.r.URL.RequestURI()
-		return s.authenticate(c, sid, csrf, ref, t)
+		return s.authenticate(c, sid, ref, t)
 	}
 
 	handle := func(f func(c *client) error, at int, rt int) http.HandlerFunc {
 		return func(w http.ResponseWriter, req *http.Request) {
 			var err error
 			c := &client{
-				ctx: req.Context(),
-				w:   w,
-				r:   req,
+				ctx:  req.Context(),
+				w:    w,
+				r:    req,
+				base: s.basePath,
 			}
 
 			defer func(begin time.Time) {
-				logger.Printf("path=%s, err=%v, took=%v\n",
-					req.URL.Path, err, time.Since(begin))
+				// Every request is in the access log, so only the
+				// failed ones are logged above the debug level
+				level := util.LevelDebug
+				if err != nil {
+					level = util.LevelError
+				}
+				fields := []interface{}{"request_id",
+					util.RequestID(req.Context()), "method", req.Method,
+					"path", req.URL.Path, "route", routeTemplate(req)}
+				if len(c.s.ID) > 0 {
+					fields = append(fields, "session",
+						sessionHandle(c.s.Handle()))
+				}
+				if len(c.s.InstanceDomain) > 0 {
+					fields = append(fields, "instance", c.s.InstanceDomain)
+				}
+				if err != nil {
+					fields = append(fields, "err", err)
+				}
+				fields = append(fields, "took", time.Since(begin))
+				logger.Log(level, "request", fields...)
 			}(time.Now())
 
+			// rt is shared by all the requests of the handler
+			rt := rt
+			if rt == HTML && wantsJSON(req) {
+				rt = JSON
+				c.wantJSON = true
+			}
+
 			var ct string
 			switch rt {
 			case HTML:
@@ -139,19 +354,20 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 	}, NOAUTH, HTML)
 
 	navPage := handle(func(c *client) error {
-		return s.NavPage(c)
+		return s.NavPage(c, getSessionIDs(c.r))
 	}, SESSION, HTML)
 
 	signinPage := handle(func(c *client) error {
 		instance, ok := s.SingleInstance()
 		if !ok {
-			return s.SigninPage(c)
+			return s.SigninPage(c, c.r.FormValue("expired") == "true")
 		}
 		url, sid, err := s.NewSession(c, instance)
 		if err != nil {
 			return err
 		}
-		setSessionCookie(c.w, sid, sessionExp)
+		s.keepSession(c, s.sessionExp)
+		s.setSessionCookie(c, sid, s.sessionExp)
 		redirect(c, url)
 		return nil
 	}, NOAUTH, HTML)
@@ -172,10 +388,33 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 
 	threadPage := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
+		err := authenticate(c, SESSION)
+		if err == errInvalidSession && s.publicThread {
+			return s.PublicStatusPage(c, id)
+		}
+		if err != nil {
+			return err
+		}
 		q := c.r.URL.Query()
 		reply := q.Get("reply")
 		return s.ThreadPage(c, id, len(reply) > 1)
-	}, SESSION, HTML)
+	}, NOAUTH, HTML)
+
+	manifest := handle(func(c *client) error {
+		return s.Manifest(c)
+	}, NOAUTH, JSON)
+
+	permalinkPage := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := authenticate(c, SESSION)
+		if err == errInvalidSession && s.publicThread {
+			return s.PublicStatusPage(c, id)
+		}
+		if err != nil {
+			return err
+		}
+		return s.PermalinkPage(c, id)
+	}, NOAUTH, HTML)
 
 	likedByPage := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
@@ -194,6 +433,13 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return s.NotificationPage(c, maxID, minID)
 	}, SESSION, HTML)
 
+	notificationRequestsPage := handle(func(c *client) error {
+		q := c.r.URL.Query()
+		maxID := q.Get("max_id")
+		minID := q.Get("min_id")
+		return s.NotificationRequestsPage(c, maxID, minID)
+	}, SESSION, HTML)
+
 	userPage := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
 		pageType, _ := mux.Vars(c.r)["type"]
@@ -215,6 +461,48 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return s.AboutPage(c)
 	}, SESSION, HTML)
 
+	versionPage := handle(func(c *client) error {
+		return s.VersionPage(c)
+	}, SESSION, HTML)
+
+	archivePage := handle(func(c *client) error {
+		return s.ArchivePage(c)
+	}, SESSION, HTML)
+
+	archive := handle(func(c *client) error {
+		media := c.r.FormValue("media") == "true"
+		return s.Archive(c, media)
+	}, CSRF, HTML)
+
+	accountListsPage := handle(func(c *client) error {
+		return s.AccountListsPage(c)
+	}, SESSION, HTML)
+
+	exportAccountList := handle(func(c *client) error {
+		list, _ := mux.Vars(c.r)["list"]
+		return s.ExportAccountList(c, list)
+	}, CSRF, HTML)
+
+	importAccountList := handle(func(c *client) error {
+		list, _ := mux.Vars(c.r)["list"]
+		// The next batches of an import come with the accounts left
+		// instead of the file
+		if rest, ok := c.r.Form["rest"]; ok {
+			return s.ImportAccountList(c, list,
+				strings.NewReader(strings.Join(rest, "")))
+		}
+		f, _, err := c.r.FormFile("file")
+		if err != nil {
+			return errInvalidArgument
+		}
+		defer f.Close()
+		return s.ImportAccountList(c, list, f)
+	}, CSRF, HTML)
+
+	exportBookmarks := handle(func(c *client) error {
+		return s.ExportBookmarks(c)
+	}, CSRF, HTML)
+
 	emojisPage := handle(func(c *client) error {
 		return s.EmojiPage(c)
 	}, SESSION, HTML)
@@ -223,14 +511,21 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		q := c.r.URL.Query()
 		sq := q.Get("q")
 		qType := q.Get("type")
+		from := q.Get("from")
 		offset, _ := strconv.Atoi(q.Get("offset"))
-		return s.SearchPage(c, sq, qType, offset)
+		return s.SearchPage(c, sq, qType, from, offset)
 	}, SESSION, HTML)
 
 	settingsPage := handle(func(c *client) error {
 		return s.SettingsPage(c)
 	}, SESSION, HTML)
 
+	doActionPage := handle(func(c *client) error {
+		action, _ := mux.Vars(c.r)["action"]
+		u := c.r.URL.Query().Get("url")
+		return s.DoActionPage(c, action, u)
+	}, SESSION, HTML)
+
 	filtersPage := handle(func(c *client) error {
 		return s.FiltersPage(c)
 	}, SESSION, HTML)
@@ -241,11 +536,28 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		if err != nil {
 			return err
 		}
-		setSessionCookie(c.w, sid, sessionExp)
+		s.keepSession(c, s.sessionExp)
+		s.setSessionCookie(c, sid, s.sessionExp)
 		redirect(c, url)
 		return nil
 	}, NOAUTH, HTML)
 
+	tokenSignin := handle(func(c *client) error {
+		instance, ok := s.SingleInstance()
+		if !ok {
+			instance = c.r.FormValue("instance")
+		}
+		token := strings.TrimSpace(c.r.FormValue("access_token"))
+		sid, err := s.TokenSignin(c, instance, token)
+		if err != nil {
+			return err
+		}
+		s.keepSession(c, s.sessionExp)
+		s.setSessionCookie(c, sid, s.sessionExp)
+		redirect(c, "/")
+		return nil
+	}, NOAUTH, HTML)
+
 	oauthCallback := handle(func(c *client) error {
 		q := c.r.URL.Query()
 		token := q.Get("code")
@@ -263,9 +575,13 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		format := c.r.FormValue("format")
 		visibility := c.r.FormValue("visibility")
 		isNSFW := c.r.FormValue("is_nsfw") == "true"
-		files := c.r.MultipartForm.File["attachments"]
+		var files []*multipart.FileHeader
+		if c.r.MultipartForm != nil {
+			files = c.r.MultipartForm.File["attachments"]
+		}
 
-		id, err := s.Post(c, content, replyToID, format, visibility, isNSFW, files)
+		id, err := s.Post(c, content, replyToID, format, visibility, isNSFW,
+			files, nil)
 		if err != nil {
 			return err
 		}
@@ -278,6 +594,21 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return nil
 	}, CSRF, HTML)
 
+	preview := handle(func(c *client) error {
+		content := c.r.FormValue("content")
+		replyToID := c.r.FormValue("reply_to_id")
+		format := c.r.FormValue("format")
+		visibility := c.r.FormValue("visibility")
+		isNSFW := c.r.FormValue("is_nsfw") == "true"
+		var files []*multipart.FileHeader
+		if c.r.MultipartForm != nil {
+			files = c.r.MultipartForm.File["attachments"]
+		}
+		referrer := c.r.FormValue("referrer")
+		return s.PreviewPage(c, content, replyToID, format, visibility,
+			isNSFW, len(files) > 0, referrer)
+	}, CSRF, HTML)
+
 	like := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
 		rid := c.r.FormValue("retweeted_by_id")
@@ -354,7 +685,7 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 			reblogs = new(bool)
 			*reblogs = r[0] == "true"
 		}
-		err := s.Follow(c, id, reblogs)
+		_, err := s.Follow(c, id, reblogs)
 		if err != nil {
 			return err
 		}
@@ -364,7 +695,7 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 
 	unfollow := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
-		err := s.UnFollow(c, id)
+		_, err := s.UnFollow(c, id)
 		if err != nil {
 			return err
 		}
@@ -394,7 +725,7 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 
 	mute := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
-		err := s.Mute(c, id)
+		_, err := s.Mute(c, id)
 		if err != nil {
 			return err
 		}
@@ -404,7 +735,7 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 
 	unMute := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
-		err := s.UnMute(c, id)
+		_, err := s.UnMute(c, id)
 		if err != nil {
 			return err
 		}
@@ -456,27 +787,54 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		visibility := c.r.FormValue("visibility")
 		format := c.r.FormValue("format")
 		copyScope := c.r.FormValue("copy_scope") == "true"
+		replyOnlyAuthor := c.r.FormValue("reply_only_author") == "true"
+		replyMentionSelf := c.r.FormValue("reply_mention_self") == "true"
+		replyMentionsAtEnd := c.r.FormValue("reply_mentions_at_end") == "true"
 		threadInNewTab := c.r.FormValue("thread_in_new_tab") == "true"
 		hideAttachments := c.r.FormValue("hide_attachments") == "true"
 		maskNSFW := c.r.FormValue("mask_nsfw") == "true"
 		ni, _ := strconv.Atoi(c.r.FormValue("notification_interval"))
 		fluorideMode := c.r.FormValue("fluoride_mode") == "true"
-		darkMode := c.r.FormValue("dark_mode") == "true"
+		infiniteScroll := c.r.FormValue("infinite_scroll") == "true"
+		desktopNotifications := c.r.FormValue("desktop_notifications") == "true"
+		notificationSound := c.r.FormValue("notification_sound") == "true"
+		faviconBadge := c.r.FormValue("favicon_badge") == "true"
+		theme := c.r.FormValue("theme")
 		antiDopamineMode := c.r.FormValue("anti_dopamine_mode") == "true"
+		timezone := strings.TrimSpace(c.r.FormValue("timezone"))
+		twelveHourClock := c.r.FormValue("twelve_hour_clock") == "true"
+		absoluteTime := c.r.FormValue("absolute_time") == "true"
 		css := c.r.FormValue("css")
+		var cssSnippets []string
+		for _, id := range c.r.Form["css_snippet"] {
+			if model.IsCSSSnippet(id) {
+				cssSnippets = append(cssSnippets, id)
+			}
+		}
 
 		settings := &model.Settings{
 			DefaultVisibility:    visibility,
 			DefaultFormat:        format,
 			CopyScope:            copyScope,
+			ReplyOnlyAuthor:      replyOnlyAuthor,
+			ReplyMentionSelf:     replyMentionSelf,
+			ReplyMentionsAtEnd:   replyMentionsAtEnd,
 			ThreadInNewTab:       threadInNewTab,
 			HideAttachments:      hideAttachments,
 			MaskNSFW:             maskNSFW,
 			NotificationInterval: ni,
 			FluorideMode:         fluorideMode,
-			DarkMode:             darkMode,
+			InfiniteScroll:       infiniteScroll,
+			DesktopNotifications: desktopNotifications,
+			NotificationSound:    notificationSound,
+			FaviconBadge:         faviconBadge,
+			Theme:                theme,
 			AntiDopamineMode:     antiDopamineMode,
+			Timezone:             timezone,
+			TwelveHourClock:      twelveHourClock,
+			AbsoluteTime:         absoluteTime,
 			CSS:                  css,
+			CSSSnippets:          cssSnippets,
 		}
 
 		err := s.SaveSettings(c, settings)
@@ -487,6 +845,76 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return nil
 	}, CSRF, HTML)
 
+	exportSettings := handle(func(c *client) error {
+		return s.ExportSettings(c)
+	}, CSRF, HTML)
+
+	importSettings := handle(func(c *client) error {
+		f, _, err := c.r.FormFile("file")
+		if err != nil {
+			return errInvalidArgument
+		}
+		defer f.Close()
+		err = s.ImportSettings(c, f)
+		if err != nil {
+			return err
+		}
+		redirect(c, "/settings")
+		return nil
+	}, CSRF, HTML)
+
+	feedToken := handle(func(c *client) error {
+		revoke := c.r.FormValue("revoke") == "true"
+		err := s.ResetFeedToken(c, revoke)
+		if err != nil {
+			return err
+		}
+		redirect(c, "/settings#feeds")
+		return nil
+	}, CSRF, HTML)
+
+	sessionsPage := handle(func(c *client) error {
+		return s.SessionsPage(c)
+	}, SESSION, HTML)
+
+	revokeSession := handle(func(c *client) error {
+		err := s.RevokeSession(c, c.r.FormValue("id"))
+		if err != nil {
+			return err
+		}
+		redirect(c, "/sessions")
+		return nil
+	}, CSRF, HTML)
+
+	signoutEverywhere := handle(func(c *client) error {
+		err := s.SignoutEverywhere(c)
+		if err != nil {
+			return err
+		}
+		switchSession(c)
+		redirect(c, "/")
+		return nil
+	}, CSRF, HTML)
+
+	feedTimeline := handle(func(c *client) error {
+		err := s.authenticateFeed(c, c.r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		tType, _ := mux.Vars(c.r)["type"]
+		instance := c.r.FormValue("instance")
+		return s.FeedTimeline(c, tType, instance)
+	}, NOAUTH, HTML)
+
+	feedUser := handle(func(c *client) error {
+		err := s.authenticateFeed(c, c.r.FormValue("token"))
+		if err != nil {
+			return err
+		}
+		id, _ := mux.Vars(c.r)["id"]
+		return s.FeedUser(c, id)
+	}, NOAUTH, HTML)
+
 	muteConversation := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
 		err := s.MuteConversation(c, id)
@@ -528,6 +956,72 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return nil
 	}, CSRF, HTML)
 
+	dismissNotification := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		c.r.ParseForm()
+		ids := append([]string{id}, c.r.PostForm["other_id"]...)
+		err := s.DismissNotifications(c, ids)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
+	clearNotifications := handle(func(c *client) error {
+		err := s.ClearNotifications(c)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
+	dismissNotices := handle(func(c *client) error {
+		err := s.DismissNotices(c)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
+	acceptNotificationRequest := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := s.AcceptNotificationRequest(c, id)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
+	dismissNotificationRequest := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := s.DismissNotificationRequest(c, id)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
+	notificationPolicy := handle(func(c *client) error {
+		policy := &mastodon.NotificationPolicy{
+			ForNotFollowing:    c.r.FormValue("for_not_following"),
+			ForNotFollowers:    c.r.FormValue("for_not_followers"),
+			ForNewAccounts:     c.r.FormValue("for_new_accounts"),
+			ForPrivateMentions: c.r.FormValue("for_private_mentions"),
+			ForLimitedAccounts: c.r.FormValue("for_limited_accounts"),
+		}
+		err := s.SaveNotificationPolicy(c, policy)
+		if err != nil {
+			return err
+		}
+		redirect(c, c.r.FormValue("referrer"))
+		return nil
+	}, CSRF, HTML)
+
 	bookmark := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
 		rid := c.r.FormValue("retweeted_by_id")
@@ -559,7 +1053,12 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 	filter := handle(func(c *client) error {
 		phrase := c.r.FormValue("phrase")
 		wholeWord := c.r.FormValue("whole_word") == "true"
-		err := s.Filter(c, phrase, wholeWord)
+		expiresIn, err := strconv.Atoi(c.r.FormValue("expires_in"))
+		if err != nil {
+			return errInvalidArgument
+		}
+		fctx := c.r.Form["context"]
+		err = s.Filter(c, phrase, wholeWord, fctx, expiresIn)
 		if err != nil {
 			return err
 		}
@@ -577,9 +1076,42 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return nil
 	}, CSRF, HTML)
 
+	doAction := handle(func(c *client) error {
+		action, _ := mux.Vars(c.r)["action"]
+		u := c.r.FormValue("url")
+		id, err := s.DoAction(c, action, u)
+		if err != nil {
+			return err
+		}
+		redirect(c, "/thread/"+id+"#status-"+id)
+		return nil
+	}, CSRF, HTML)
+
 	signout := handle(func(c *client) error {
 		s.Signout(c)
-		setSessionCookie(c.w, "", 0)
+		// Switch to the next signed in account, if there's one
+		switchSession(c)
+		redirect(c, "/")
+		return nil
+	}, CSRF, HTML)
+
+	switchAccount := handle(func(c *client) error {
+		index, err := strconv.Atoi(c.r.FormValue("index"))
+		if err != nil {
+			return errInvalidArgument
+		}
+		sessions := s.OtherSessions(getSessionIDs(c.r))
+		if index < 0 || index >= len(sessions) {
+			return errInvalidArgument
+		}
+		ids := []string{c.s.ID}
+		for i, sess := range sessions {
+			if i != index {
+				ids = append(ids, sess.ID)
+			}
+		}
+		s.setSessionIDsCookie(c, ids, s.sessionExp)
+		s.setSessionCookie(c, sessions[index].ID, s.sessionExp)
 		redirect(c, "/")
 		return nil
 	}, CSRF, HTML)
@@ -602,6 +1134,239 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 		return writeJson(c, count)
 	}, CSRF, JSON)
 
+	fBookmark := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := s.Bookmark(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, true)
+	}, CSRF, JSON)
+
+	fUnBookmark := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := s.UnBookmark(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, false)
+	}, CSRF, JSON)
+
+	fDelete := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		err := s.Delete(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, id)
+	}, CSRF, JSON)
+
+	fFollow := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		rel, err := s.Follow(c, id, nil)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, rel)
+	}, CSRF, JSON)
+
+	fUnFollow := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		rel, err := s.UnFollow(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, rel)
+	}, CSRF, JSON)
+
+	fMute := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		rel, err := s.Mute(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, rel)
+	}, CSRF, JSON)
+
+	fUnMute := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		rel, err := s.UnMute(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, rel)
+	}, CSRF, JSON)
+
+	fNewMentions := handle(func(c *client) error {
+		sinceID := c.r.URL.Query().Get("since_id")
+		alerts, latestID, err := s.NewMentions(c, sinceID)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, map[string]interface{}{
+			"alerts":    alerts,
+			"latest_id": latestID,
+		})
+	}, SESSION, JSON)
+
+	fVote := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		statusID := c.r.FormValue("status_id")
+		choices, _ := c.r.PostForm["choices"]
+		err := s.Vote(c, id, choices)
+		if err != nil {
+			return err
+		}
+		html, err := s.StatusFragment(c, statusID)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, html)
+	}, CSRF, JSON)
+
+	fNotificationCount := handle(func(c *client) error {
+		count, err := s.UnreadNotificationCount(c)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, count)
+	}, SESSION, JSON)
+
+	proxy := handle(func(c *client) error {
+		encoded, _ := mux.Vars(c.r)["url"]
+		return s.ProxyMedia(c, encoded)
+	}, SESSION, HTML)
+
+	avatar := handle(func(c *client) error {
+		// Visitors of public threads see the avatars too
+		err := authenticate(c, SESSION)
+		if err != nil && !(err == errInvalidSession && s.publicThread) {
+			return err
+		}
+		size, err := strconv.Atoi(mux.Vars(c.r)["size"])
+		if err != nil {
+			return errInvalidArgument
+		}
+		encoded, _ := mux.Vars(c.r)["url"]
+		return s.Avatar(c, size, encoded)
+	}, NOAUTH, HTML)
+
+	emojiImage := handle(func(c *client) error {
+		encoded, _ := mux.Vars(c.r)["url"]
+		return s.EmojiImage(c, encoded)
+	}, SESSION, HTML)
+
+	fEmojis := handle(func(c *client) error {
+		emojis, err := s.Emojis(c)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, emojis)
+	}, SESSION, JSON)
+
+	fTimeline := handle(func(c *client) error {
+		tType, _ := mux.Vars(c.r)["type"]
+		q := c.r.URL.Query()
+		instance := q.Get("instance")
+		maxID := q.Get("max_id")
+		html, nextLink, err := s.TimelineStatuses(c, tType, instance, maxID)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, map[string]string{
+			"html":      html,
+			"next_link": nextLink,
+		})
+	}, SESSION, JSON)
+
+	fReplyForm := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		form, err := s.ReplyForm(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, form)
+	}, SESSION, JSON)
+
+	fPost := handle(func(c *client) error {
+		content := c.r.FormValue("content")
+		replyToID := c.r.FormValue("reply_to_id")
+		format := c.r.FormValue("format")
+		visibility := c.r.FormValue("visibility")
+		isNSFW := c.r.FormValue("is_nsfw") == "true"
+		var files []*multipart.FileHeader
+		if c.r.MultipartForm != nil {
+			files = c.r.MultipartForm.File["attachments"]
+		}
+		// The attachments uploaded with fUpload come as their IDs
+		mediaIDs := c.r.Form["media_ids"]
+
+		id, err := s.Post(c, content, replyToID, format, visibility, isNSFW,
+			files, mediaIDs)
+		if err != nil {
+			return err
+		}
+		html, err := s.StatusFragment(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, map[string]string{
+			"id":   id,
+			"html": html,
+		})
+	}, CSRF, JSON)
+
+	fUpload := handle(func(c *client) error {
+		id := c.r.FormValue("id")
+		offset, err := strconv.ParseInt(c.r.FormValue("offset"), 10, 64)
+		if err != nil {
+			return errInvalidArgument
+		}
+		size, err := strconv.ParseInt(c.r.FormValue("size"), 10, 64)
+		if err != nil {
+			return errInvalidArgument
+		}
+		name := c.r.FormValue("name")
+		// A retry of a complete upload has no chunk left to send
+		var chunk io.Reader = strings.NewReader("")
+		if f, _, err := c.r.FormFile("chunk"); err == nil {
+			defer f.Close()
+			chunk = f
+		}
+		st, err := s.UploadChunk(c, id, offset, size, name, chunk)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, st)
+	}, CSRF, JSON)
+
+	fUploadOffset := handle(func(c *client) error {
+		id, _ := mux.Vars(c.r)["id"]
+		st, err := s.UploadOffset(c, id)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, st)
+	}, SESSION, JSON)
+
+	fAccounts := handle(func(c *client) error {
+		q := c.r.URL.Query().Get("q")
+		accounts, err := s.SuggestAccounts(c, q)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, accounts)
+	}, SESSION, JSON)
+
+	fHashtags := handle(func(c *client) error {
+		q := c.r.URL.Query().Get("q")
+		tags, err := s.SuggestHashtags(c, q)
+		if err != nil {
+			return err
+		}
+		return writeJson(c, tags)
+	}, SESSION, JSON)
+
 	fRetweet := handle(func(c *client) error {
 		id, _ := mux.Vars(c.r)["id"]
 		count, err := s.Retweet(c, id)
@@ -626,20 +1391,32 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 	r.HandleFunc("/timeline/{type}", timelinePage).Methods(http.MethodGet)
 	r.HandleFunc("/timeline", defaultTimelinePage).Methods(http.MethodGet)
 	r.HandleFunc("/thread/{id}", threadPage).Methods(http.MethodGet)
+	r.HandleFunc("/status/{id}", permalinkPage).Methods(http.MethodGet)
 	r.HandleFunc("/likedby/{id}", likedByPage).Methods(http.MethodGet)
 	r.HandleFunc("/retweetedby/{id}", retweetedByPage).Methods(http.MethodGet)
 	r.HandleFunc("/notifications", notificationsPage).Methods(http.MethodGet)
+	r.HandleFunc("/notifications/requests", notificationRequestsPage).Methods(http.MethodGet)
 	r.HandleFunc("/user/{id}", userPage).Methods(http.MethodGet)
 	r.HandleFunc("/user/{id}/{type}", userPage).Methods(http.MethodGet)
 	r.HandleFunc("/usersearch/{id}", userSearchPage).Methods(http.MethodGet)
 	r.HandleFunc("/about", aboutPage).Methods(http.MethodGet)
+	r.HandleFunc("/about/version", versionPage).Methods(http.MethodGet)
+	r.HandleFunc("/archive", archivePage).Methods(http.MethodGet)
+	r.HandleFunc("/archive", archive).Methods(http.MethodPost)
+	r.HandleFunc("/bookmarks/export", exportBookmarks).Methods(http.MethodPost)
+	r.HandleFunc("/accountlists", accountListsPage).Methods(http.MethodGet)
+	r.HandleFunc("/accountlists/{list}/export", exportAccountList).Methods(http.MethodPost)
+	r.HandleFunc("/accountlists/{list}/import", importAccountList).Methods(http.MethodPost)
 	r.HandleFunc("/emojis", emojisPage).Methods(http.MethodGet)
 	r.HandleFunc("/search", searchPage).Methods(http.MethodGet)
 	r.HandleFunc("/settings", settingsPage).Methods(http.MethodGet)
 	r.HandleFunc("/filters", filtersPage).Methods(http.MethodGet)
+	r.HandleFunc("/do/{action}", doActionPage).Methods(http.MethodGet)
 	r.HandleFunc("/signin", signin).Methods(http.MethodPost)
+	r.HandleFunc("/signin/token", tokenSignin).Methods(http.MethodPost)
 	r.HandleFunc("/oauth_callback", oauthCallback).Methods(http.MethodGet)
 	r.HandleFunc("/post", post).Methods(http.MethodPost)
+	r.HandleFunc("/preview", preview).Methods(http.MethodPost)
 	r.HandleFunc("/like/{id}", like).Methods(http.MethodPost)
 	r.HandleFunc("/unlike/{id}", unlike).Methods(http.MethodPost)
 	r.HandleFunc("/retweet/{id}", retweet).Methods(http.MethodPost)
@@ -656,21 +1433,65 @@ func NewHandler(s *service, logger *log.Logger, staticDir string) http.Handler {
 	r.HandleFunc("/subscribe/{id}", subscribe).Methods(http.MethodPost)
 	r.HandleFunc("/unsubscribe/{id}", unSubscribe).Methods(http.MethodPost)
 	r.HandleFunc("/settings", settings).Methods(http.MethodPost)
+	r.HandleFunc("/settings/export", exportSettings).Methods(http.MethodPost)
+	r.HandleFunc("/settings/import", importSettings).Methods(http.MethodPost)
+	r.HandleFunc("/feedtoken", feedToken).Methods(http.MethodPost)
+	r.HandleFunc("/sessions", sessionsPage).Methods(http.MethodGet)
+	r.HandleFunc("/sessions/revoke", revokeSession).Methods(http.MethodPost)
+	r.HandleFunc("/sessions/signout", signoutEverywhere).Methods(http.MethodPost)
+	r.HandleFunc("/feed/timeline/{type}", feedTimeline).Methods(http.MethodGet)
+	r.HandleFunc("/feed/user/{id}", feedUser).Methods(http.MethodGet)
 	r.HandleFunc("/muteconv/{id}", muteConversation).Methods(http.MethodPost)
 	r.HandleFunc("/unmuteconv/{id}", unMuteConversation).Methods(http.MethodPost)
 	r.HandleFunc("/delete/{id}", delete).Methods(http.MethodPost)
 	r.HandleFunc("/notifications/read", readNotifications).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/dismiss/{id}", dismissNotification).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/clear", clearNotifications).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/notices/dismiss", dismissNotices).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/requests/accept/{id}", acceptNotificationRequest).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/requests/dismiss/{id}", dismissNotificationRequest).Methods(http.MethodPost)
+	r.HandleFunc("/notifications/policy", notificationPolicy).Methods(http.MethodPost)
 	r.HandleFunc("/bookmark/{id}", bookmark).Methods(http.MethodPost)
 	r.HandleFunc("/unbookmark/{id}", unBookmark).Methods(http.MethodPost)
 	r.HandleFunc("/filter", filter).Methods(http.MethodPost)
 	r.HandleFunc("/unfilter/{id}", unFilter).Methods(http.MethodPost)
+	r.HandleFunc("/do/{action}", doAction).Methods(http.MethodPost)
 	r.HandleFunc("/signout", signout).Methods(http.MethodPost)
+	r.HandleFunc("/switch", switchAccount).Methods(http.MethodPost)
 	r.HandleFunc("/fluoride/like/{id}", fLike).Methods(http.MethodPost)
 	r.HandleFunc("/fluoride/unlike/{id}", fUnlike).Methods(http.MethodPost)
 	r.HandleFunc("/fluoride/retweet/{id}", fRetweet).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/bookmark/{id}", fBookmark).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/unbookmark/{id}", fUnBookmark).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/delete/{id}", fDelete).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/follow/{id}", fFollow).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/unfollow/{id}", fUnFollow).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/mute/{id}", fMute).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/unmute/{id}", fUnMute).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/vote/{id}", fVote).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/notifications/count", fNotificationCount).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/notifications/mentions", fNewMentions).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/emojis", fEmojis).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/timeline/{type}", fTimeline).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/replyform/{id}", fReplyForm).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/post", fPost).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/upload", fUpload).Methods(http.MethodPost)
+	r.HandleFunc("/fluoride/upload/{id}", fUploadOffset).Methods(http.MethodGet)
+	r.HandleFunc("/proxy/{url}", proxy).Methods(http.MethodGet)
+	r.HandleFunc("/avatar/{size}/{url}", avatar).Methods(http.MethodGet)
+	r.HandleFunc("/emoji/{url}", emojiImage).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/accounts", fAccounts).Methods(http.MethodGet)
+	r.HandleFunc("/fluoride/hashtags", fHashtags).Methods(http.MethodGet)
 	r.HandleFunc("/fluoride/unretweet/{id}", fUnretweet).Methods(http.MethodPost)
+	r.HandleFunc("/manifest.json", manifest).Methods(http.MethodGet)
+	// The scope of a service worker is the path it's served from
+	r.Handle("/sw.js", util.StaticHandler(staticFS, staticHashes))
 	r.PathPrefix("/static").Handler(http.StripPrefix("/static",
-		http.FileServer(http.Dir(staticDir))))
+		util.StaticHandler(staticFS, staticHashes)))
 
-	return r
+	var h http.Handler = r
+	if len(s.basePath) > 0 {
+		h = stripBasePath(s.basePath, r)
+	}
+	return util.RequestIDHandler(accessLog.Handler(h, clientIP))
 }
@@ -0,0 +1,222 @@
+// @license magnet:?xt=urn:btih:90dc5c0be029de84e523b9b3922520e79e0e6f08&dn=cc0.txt CC0
+
+// Suggestions for the post form in fluoride mode. While the word before the
+// cursor starts with the trigger character of a source, the matches returned
+// by the source are listed below the text area. A source is a function
+// taking the rest of the word and a callback to call with the list of
+// suggestions, which are objects with the text to insert, a label and an
+// optional image.
+
+var autocompleteSources = {};
+var autocompleteLimit = 10;
+
+function getJSON(url, success) {
+	var req = new XMLHttpRequest();
+	req.onload = function() {
+		if (this.status === 200)
+			success(JSON.parse(this.responseText).data);
+	};
+	req.open("GET", basePath + url);
+	req.send();
+}
+
+var emojiList = null;
+var emojiCallbacks = [];
+
+function getEmojis(f) {
+	if (emojiList) {
+		f(emojiList);
+		return;
+	}
+	emojiCallbacks.push(f);
+	if (emojiCallbacks.length > 1)
+		return;
+	getJSON("/fluoride/emojis", function(emojis) {
+		emojiList = emojis || [];
+		for (var i = 0; i < emojiCallbacks.length; i++)
+			emojiCallbacks[i](emojiList);
+		emojiCallbacks = [];
+	});
+}
+
+autocompleteSources[":"] = function(q, f) {
+	q = q.toLowerCase();
+	getEmojis(function(emojis) {
+		var prefix = [], other = [];
+		for (var i = 0; i < emojis.length; i++) {
+			var e = emojis[i];
+			if (!e.visible_in_picker)
+				continue;
+			var index = e.shortcode.toLowerCase().indexOf(q);
+			if (index === 0)
+				prefix.push(e);
+			else if (index > 0)
+				other.push(e);
+		}
+		var matches = prefix.concat(other).slice(0, autocompleteLimit);
+		var items = [];
+		for (var i = 0; i < matches.length; i++) {
+			items.push({
+				text: ":" + matches[i].shortcode + ":",
+				label: ":" + matches[i].shortcode + ":",
+				img: matches[i].static_url || matches[i].url
+			});
+		}
+		f(items);
+	});
+};
+
+// Accounts and hashtags are searched on the instance, so the requests are
+// only sent once the user stops typing for a moment.
+var searchTimer = null;
+
+function searchSource(url, toItem) {
+	return function(q, f) {
+		clearTimeout(searchTimer);
+		searchTimer = setTimeout(function() {
+			getJSON(url + "?q=" + encodeURIComponent(q), function(res) {
+				var items = [];
+				for (var i = 0; res && i < res.length; i++)
+					items.push(toItem(res[i]));
+				f(items);
+			});
+		}, 250);
+	};
+}
+
+autocompleteSources["@"] = searchSource("/fluoride/accounts", function(a) {
+	return {
+		text: "@" + a.acct,
+		label: "@" + a.acct + (a.display_name ? " (" + a.display_name + ")" : ""),
+		img: a.avatar_static || a.avatar
+	};
+});
+
+autocompleteSources["#"] = searchSource("/fluoride/hashtags", function(t) {
+	return {
+		text: "#" + t.name,
+		label: "#" + t.name
+	};
+});
+
+function currentWord(textarea) {
+	var end = textarea.selectionStart;
+	if (end !== textarea.selectionEnd)
+		return null;
+	var start = end;
+	while (start > 0 && !/\s/.test(textarea.value[start - 1]))
+		start--;
+	return {start: start, end: end, text: textarea.value.slice(start, end)};
+}
+
+function handleAutocomplete(textarea) {
+	var list = document.createElement("div");
+	list.className = "autocomplete";
+	list.style.display = "none";
+	textarea.parentElement.appendChild(list);
+
+	var items = [], selected = 0, word = null, seq = 0;
+
+	var close = function() {
+		list.style.display = "none";
+		items = [];
+		seq++;
+	};
+
+	var choose = function(item) {
+		var v = textarea.value;
+		var text = item.text + " ";
+		textarea.value = v.slice(0, word.start) + text + v.slice(word.end);
+		var pos = word.start + text.length;
+		textarea.setSelectionRange(pos, pos);
+		textarea.focus();
+		close();
+	};
+
+	var show = function() {
+		list.innerHTML = "";
+		if (items.length < 1) {
+			list.style.display = "none";
+			return;
+		}
+		for (var i = 0; i < items.length; i++) {
+			var el = document.createElement("div");
+			el.className = "autocomplete-item";
+			if (i === selected)
+				el.classList.add("selected");
+			if (items[i].img) {
+				var img = document.createElement("img");
+				img.className = "autocomplete-img";
+				img.src = items[i].img;
+				img.alt = "";
+				el.appendChild(img);
+			}
+			el.appendChild(document.createTextNode(items[i].label));
+			el.onmousedown = (function(item) {
+				return function(event) {
+					event.preventDefault();
+					choose(item);
+				};
+			})(items[i]);
+			list.appendChild(el);
+		}
+		list.style.display = "";
+	};
+
+	textarea.addEventListener("input", function() {
+		word = currentWord(textarea);
+		if (!word || word.text.length < 2) {
+			close();
+			return;
+		}
+		var source = autocompleteSources[word.text[0]];
+		if (!source) {
+			close();
+			return;
+		}
+		// Suggestions of older queries may arrive late
+		var n = ++seq;
+		source(word.text.slice(1), function(res) {
+			if (n !== seq)
+				return;
+			items = res;
+			selected = 0;
+			show();
+		});
+	});
+
+	textarea.addEventListener("keydown", function(event) {
+		if (items.length < 1)
+			return;
+		switch (event.key) {
+		case "ArrowDown":
+			selected = (selected + 1) % items.length;
+			show();
+			break;
+		case "ArrowUp":
+			selected = (selected + items.length - 1) % items.length;
+			show();
+			break;
+		case "Enter":
+		case "Tab":
+			choose(items[selected]);
+			break;
+		case "Escape":
+			close();
+			break;
+		default:
+			return;
+		}
+		event.preventDefault();
+	});
+
+	textarea.addEventListener("blur", close);
+}
+
+document.addEventListener("DOMContentLoaded", function() {
+	var textarea = document.querySelector(".post-content");
+	if (textarea)
+		handleAutocomplete(textarea);
+});
+
+// @license-end
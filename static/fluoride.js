@@ -4,11 +4,35 @@ var reverseActions = {
 	"like": "unlike",
 	"unlike": "like",
 	"retweet": "unretweet",
-	"unretweet": "retweet"
+	"unretweet": "retweet",
+	"bookmark": "unbookmark",
+	"unbookmark": "bookmark",
+	"follow": "unfollow",
+	"unfollow": "follow",
+	"mute": "unmute",
+	"unmute": "mute"
 };
 
+// basePath is the path bloat is served under, e.g. "/bloat", which the
+// paths of the requests start with.
+var basePath = "";
 var csrfToken = "";
 var antiDopamineMode = false;
+var infiniteScroll = false;
+
+function checkBasePath() {
+	var tag = document.querySelector("meta[name='base_path']");
+	if (tag)
+		basePath = tag.getAttribute("content");
+}
+
+// fluoridePath returns the path of the fluoride version of the page at p,
+// as linked in the page.
+function fluoridePath(p) {
+	if (basePath && p.indexOf(basePath + "/") === 0)
+		p = p.substring(basePath.length);
+	return basePath + "/fluoride" + p;
+}
 
 function checkCSRFToken() {
 	var tag = document.querySelector("meta[name='csrf_token']");
@@ -22,28 +46,35 @@ function checkAntiDopamineMode() {
 		antiDopamineMode = tag.getAttribute("content") === "true";
 }
 
+function checkInfiniteScroll() {
+	var tag = document.querySelector("meta[name='infinite_scroll']");
+	if (tag)
+		infiniteScroll = tag.getAttribute("content") === "true";
+}
+
 function http(method, url, body, type, success, error) {
 	var req = new XMLHttpRequest();
 	req.onload = function() {
 		if (this.status === 200 && typeof success === "function") {
 			success(this.responseText, this.responseType);
 		} else if (typeof error === "function") {
-			error(this.responseText);
+			error(this.responseText, this);
 		}
 	};
 	req.onerror = function() {
 		if (typeof error === "function") {
-			error(this.responseText);
+			error(this.responseText, this);
 		}
 	};
 	req.open(method, url);
-	req.setRequestHeader("Content-Type", type);
+	if (type)
+		req.setRequestHeader("Content-Type", type);
 	req.send(body);
 }
 
 function updateActionForm(id, f, action) {
 	f.querySelector("[type='submit']").value = action;
-	f.action = "/" + action + "/" + id;
+	f.action = basePath + "/" + action + "/" + id;
 	f.dataset.action = action;
 }
 
@@ -60,7 +91,7 @@ function handleLikeForm(id, f) {
 
 		var body = "csrf_token=" + encodeURIComponent(csrfToken);
 		var contentType = "application/x-www-form-urlencoded";
-		http("POST", "/fluoride/" + action + "/" + id, 
+		http("POST", basePath + "/fluoride/" + action + "/" + id, 
 			body, contentType, function(res, type) {
 
 			if (antiDopamineMode)
@@ -99,7 +130,7 @@ function handleRetweetForm(id, f) {
 
 		var body = "csrf_token=" + encodeURIComponent(csrfToken);
 		var contentType = "application/x-www-form-urlencoded";
-		http("POST", "/fluoride/" + action + "/" + id, 
+		http("POST", basePath + "/fluoride/" + action + "/" + id, 
 			body, contentType, function(res, type) {
 
 			if (antiDopamineMode)
@@ -125,6 +156,95 @@ function handleRetweetForm(id, f) {
 	}
 }
 
+// handleActionForm submits the action of f, which is one of the forms
+// matching selector, and switches all of them to the reverse action.
+function handleActionForm(id, f, selector, success) {
+	f.onsubmit = function(event) {
+		event.preventDefault();
+
+		var action = f.dataset.action;
+		var forms = document.querySelectorAll(selector);
+		for (var i = 0; i < forms.length; i++) {
+			updateActionForm(id, forms[i], reverseActions[action]);
+		}
+
+		var body = "csrf_token=" + encodeURIComponent(csrfToken);
+		var contentType = "application/x-www-form-urlencoded";
+		http("POST", basePath + "/fluoride/" + action + "/" + id,
+			body, contentType, function(res, type) {
+
+			if (typeof success === "function")
+				success(JSON.parse(res).data, forms);
+		}, function(err) {
+			for (var i = 0; i < forms.length; i++) {
+				updateActionForm(id, forms[i], action);
+			}
+		});
+	}
+}
+
+function handleBookmarkForm(id, f) {
+	handleActionForm(id, f, ".status-"+id+" .status-bookmark");
+}
+
+function handleDeleteForm(id, f) {
+	f.onsubmit = function(event) {
+		event.preventDefault();
+
+		var body = "csrf_token=" + encodeURIComponent(csrfToken);
+		var contentType = "application/x-www-form-urlencoded";
+		http("POST", basePath + "/fluoride/delete/" + id, body, contentType, function() {
+			var statuses = document.querySelectorAll(".status-"+id);
+			for (var i = 0; i < statuses.length; i++) {
+				var s = statuses[i].closest(".status-container-container");
+				if (s)
+					s.parentElement.removeChild(s);
+			}
+		});
+	}
+}
+
+function handleFollowForm(f) {
+	var id = f.dataset.id;
+	handleActionForm(id, f, ".user-follow", function(rel, forms) {
+		// Locked accounts only get a follow request
+		if (rel && rel.requested && !rel.following) {
+			for (var i = 0; i < forms.length; i++) {
+				forms[i].querySelector("[type='submit']").value =
+					"cancel request";
+			}
+		}
+	});
+}
+
+function handleMuteForm(f) {
+	handleActionForm(f.dataset.id, f, ".user-mute");
+}
+
+// handlePollForm submits the vote and replaces the poll with the results.
+function handlePollForm(f) {
+	f.onsubmit = function(event) {
+		event.preventDefault();
+
+		var button = f.querySelector("[type='submit']");
+		if (button)
+			button.disabled = true;
+		var body = new URLSearchParams(new FormData(f)).toString();
+		var contentType = "application/x-www-form-urlencoded";
+		var action = f.getAttribute("action");
+		http("POST", fluoridePath(action), body, contentType, function(res) {
+			var status = document.createElement("div");
+			status.innerHTML = JSON.parse(res).data;
+			var poll = status.querySelector(".poll-form");
+			if (poll)
+				f.parentElement.replaceChild(poll, f);
+		}, function(err) {
+			if (button)
+				button.disabled = false;
+		});
+	}
+}
+
 function isInView(el) {
 	var ract = el.getBoundingClientRect();
 	if (ract.top > 0 && ract.bottom < window.innerHeight)
@@ -205,6 +325,148 @@ function handleStatusLink(a) {
 		a.target = "_blank";
 }
 
+// handleInlineReply shows the reply form below the status instead of going to
+// the thread, and inserts the reply into the page once it's posted.
+function handleInlineReply(id, a) {
+	a.onclick = function(event) {
+		var container = a.closest(".status-container-container");
+		if (!container)
+			return;
+		event.preventDefault();
+
+		var next = container.nextElementSibling;
+		if (next && next.classList.contains("inline-reply")) {
+			next.parentElement.removeChild(next);
+			return;
+		}
+		http("GET", basePath + "/fluoride/replyform/" + id, null, "", function(res) {
+			var reply = document.createElement("div");
+			reply.className = "inline-reply";
+			reply.innerHTML = JSON.parse(res).data;
+			container.parentElement.insertBefore(reply, container.nextSibling);
+			handleInlineReplyForm(reply);
+		}, function(err) {
+			location.href = a.href;
+		});
+	}
+}
+
+function handleInlineReplyForm(reply) {
+	var form = reply.querySelector(".post-form");
+	var textarea = form.querySelector(".post-content");
+	if (typeof handleAutocomplete === "function")
+		handleAutocomplete(textarea);
+	textarea.focus();
+	textarea.selectionStart = textarea.selectionEnd = textarea.value.length;
+
+	form.onsubmit = function(event) {
+		// Previews still go through the preview page
+		if (event.submitter && event.submitter.hasAttribute("formaction"))
+			return;
+		event.preventDefault();
+
+		var buttons = form.querySelectorAll("button");
+		for (var i = 0; i < buttons.length; i++)
+			buttons[i].disabled = true;
+		var fail = function(err) {
+			for (var i = 0; i < buttons.length; i++)
+				buttons[i].disabled = false;
+			var msg = "failed to post";
+			try {
+				msg = JSON.parse(err).error;
+			} catch (e) {}
+			alert(msg);
+		};
+		var body = new FormData(form);
+		// The attachments are uploaded first, and posted as their IDs
+		var files = body.getAll("attachments").filter(function(f) {
+			return f.size > 0;
+		});
+		body.delete("attachments");
+		uploadFiles(files, function(ids) {
+			for (var i = 0; i < ids.length; i++)
+				body.append("media_ids", ids[i]);
+			http("POST", basePath + "/fluoride/post", body, "", function(res) {
+				var data = JSON.parse(res).data;
+				var page = document.createElement("div");
+				page.innerHTML = data.html;
+				handleStatuses(page);
+				while (page.firstChild)
+					reply.parentElement.insertBefore(page.firstChild, reply);
+				reply.parentElement.removeChild(reply);
+			}, fail);
+		}, fail);
+	}
+}
+
+// Attachments are uploaded in chunks of uploadChunkSize bytes. A chunk that
+// fails is tried again up to uploadRetries times, going on from where the
+// upload stopped, so that a flaky connection doesn't start it over.
+var uploadChunkSize = 1 << 20;
+var uploadRetries = 5;
+
+function uploadFile(file, done, fail) {
+	var id = "";
+	var retries = 0;
+	var send = function(offset) {
+		var body = new FormData();
+		body.append("csrf_token", csrfToken);
+		body.append("id", id);
+		body.append("offset", offset);
+		body.append("size", file.size);
+		body.append("name", file.name);
+		if (offset < file.size) {
+			var chunk = file.slice(offset, offset + uploadChunkSize);
+			body.append("chunk", chunk, file.name);
+		}
+		http("POST", basePath + "/fluoride/upload", body, "", function(res) {
+			var st = JSON.parse(res).data;
+			id = st.id;
+			retries = 0;
+			if (st.media_id)
+				done(st.media_id);
+			else
+				send(st.offset);
+		}, retry);
+	};
+	// The server tells where to go on from, as the chunk may have been
+	// received even if the response wasn't
+	var resume = function() {
+		if (!id) {
+			send(0);
+			return;
+		}
+		http("GET", basePath + "/fluoride/upload/" + id, null, "", function(res) {
+			send(JSON.parse(res).data.offset);
+		}, retry);
+	};
+	var retry = function(err, req) {
+		// Only network errors and errors of the server are worth retrying
+		if (req.status > 0 && req.status < 500 && req.status !== 429 ||
+			++retries > uploadRetries) {
+			fail(err);
+			return;
+		}
+		setTimeout(resume, retryDelay(req, retries) * 1000);
+	};
+	send(0);
+}
+
+function uploadFiles(files, done, fail) {
+	var ids = [];
+	var next = function() {
+		if (ids.length === files.length) {
+			done(ids);
+			return;
+		}
+		uploadFile(files[ids.length], function(id) {
+			ids.push(id);
+			next();
+		}, fail);
+	};
+	next();
+}
+
 function setPos(el, cx, cy, mw, mh) {
 	var h = el.clientHeight;
 	var w = el.clientWidth;
@@ -263,11 +525,8 @@ function handleImgPreview(a) {
 	}
 }
 
-document.addEventListener("DOMContentLoaded", function() { 
-	checkCSRFToken();
-	checkAntiDopamineMode();
-
-	var statuses = document.querySelectorAll(".status-container");
+function handleStatuses(root) {
+	var statuses = root.querySelectorAll(".status-container");
 	for (var i = 0; i < statuses.length; i++) {
 		var s = statuses[i];
 		var id = s.dataset.id;
@@ -278,6 +537,22 @@ document.addEventListener("DOMContentLoaded", function() {
 		var retweetForm = s.querySelector(".status-retweet");
 		handleRetweetForm(id, retweetForm);
 
+		var bookmarkForm = s.querySelector(".status-bookmark");
+		if (bookmarkForm)
+			handleBookmarkForm(id, bookmarkForm);
+
+		var deleteForm = s.querySelector(".status-delete");
+		if (deleteForm)
+			handleDeleteForm(id, deleteForm);
+
+		var pollForm = s.querySelector(".poll-form");
+		if (pollForm)
+			handlePollForm(pollForm);
+
+		var replyLink = s.querySelector(".status-reply");
+		if (replyLink)
+			handleInlineReply(id, replyLink);
+
 		var replyToLink = s.querySelector(".status-reply-to-link");
 		handleReplyToLink(replyToLink);
 
@@ -292,15 +567,295 @@ document.addEventListener("DOMContentLoaded", function() {
 		}
 	}
 
+	var links = root.querySelectorAll(".status-media-container .img-link");
+	for (var j = 0; j < links.length; j++) {
+		handleImgPreview(links[j]);
+	}
+}
+
+function isBackNavigation() {
+	if (!window.performance || !performance.getEntriesByType)
+		return false;
+	var nav = performance.getEntriesByType("navigation")[0];
+	return nav && nav.type === "back_forward";
+}
+
+// handleInfiniteScroll appends the page of nextLink to the timeline when
+// the end of the page comes near. The link stays usable without JavaScript
+// and is removed after the last page.
+//
+// The appended pages and the scroll position are kept in the session
+// storage when leaving the page, so that going back to the timeline from a
+// thread doesn't start over from the first page.
+function handleInfiniteScroll(timeline, nextLink) {
+	var key = "timeline:" + location.pathname + location.search;
+	var pages = "";
+
+	var appendPage = function(html, next) {
+		var page = document.createElement("div");
+		page.innerHTML = html;
+		handleStatuses(page);
+		while (page.firstChild)
+			timeline.appendChild(page.firstChild);
+		if (next) {
+			nextLink.href = next;
+		} else if (nextLink.parentElement) {
+			nextLink.parentElement.removeChild(nextLink);
+		}
+		pages += html;
+	};
+
+	var state = null;
+	try {
+		if (isBackNavigation())
+			state = JSON.parse(sessionStorage.getItem(key));
+		sessionStorage.removeItem(key);
+	} catch (e) {}
+	if (state && state.html) {
+		appendPage(state.html, state.next);
+		if ("scrollRestoration" in history)
+			history.scrollRestoration = "manual";
+		window.scrollTo(0, state.scrollY);
+	}
+
+	window.addEventListener("pagehide", function() {
+		if (!pages)
+			return;
+		try {
+			sessionStorage.setItem(key, JSON.stringify({
+				html: pages,
+				next: nextLink.parentElement ? nextLink.getAttribute("href") : "",
+				scrollY: window.scrollY
+			}));
+		} catch (e) {}
+	});
+
+	var loading = false;
+	var load = function() {
+		if (loading || !nextLink.parentElement)
+			return;
+		var rect = nextLink.getBoundingClientRect();
+		if (rect.top > window.innerHeight * 2)
+			return;
+		loading = true;
+		http("GET", fluoridePath(nextLink.getAttribute("href")), null, "",
+			function(res) {
+
+			var data = JSON.parse(res).data;
+			appendPage(data.html,
+				data.next_link ? basePath + data.next_link : "");
+			loading = false;
+		}, function(err) {
+			loading = false;
+		});
+	};
+	window.addEventListener("scroll", load);
+	load();
+}
+
+// retryDelay returns the seconds to wait before polling again, which is
+// longer than interval when the instance is rate limiting the requests.
+function retryDelay(req, interval) {
+	var after = req ? parseInt(req.getResponseHeader("Retry-After"), 10) : 0;
+	return after > interval ? after : interval;
+}
+
+function pollNotificationCount(interval, f) {
+	var poll = function() {
+		http("GET", basePath + "/fluoride/notifications/count", null, "", function(res) {
+			f(JSON.parse(res).data);
+			setTimeout(poll, interval * 1000);
+		}, function(err, req) {
+			setTimeout(poll, retryDelay(req, interval) * 1000);
+		});
+	};
+	poll();
+}
+
+// pollMentions shows the new mentions as desktop notifications, if the
+// browser permits it.
+function pollMentions(interval) {
+	if (!("Notification" in window))
+		return;
+	var icon = document.querySelector("link[rel='icon']");
+	var latestID = "";
+	var poll = function() {
+		if (Notification.permission !== "granted") {
+			setTimeout(poll, interval * 1000);
+			return;
+		}
+		var url = basePath + "/fluoride/notifications/mentions?since_id=" +
+			encodeURIComponent(latestID);
+		http("GET", url, null, "", function(res) {
+			var data = JSON.parse(res).data;
+			latestID = data.latest_id;
+			var alerts = data.alerts || [];
+			for (var i = 0; i < alerts.length; i++) {
+				showMention(alerts[i], icon ? icon.href : "");
+			}
+			setTimeout(poll, interval * 1000);
+		}, function(err, req) {
+			setTimeout(poll, retryDelay(req, interval) * 1000);
+		});
+	};
+	poll();
+}
+
+function showMention(alert, icon) {
+	var n = new Notification(alert.author, {
+		body: alert.text,
+		icon: icon,
+		tag: "mention-" + alert.id
+	});
+	n.onclick = function() {
+		window.focus();
+		window.open(basePath + alert.link, "main");
+		n.close();
+	};
+}
+
+function handleDesktopNotificationsSetting(input) {
+	input.onchange = function() {
+		if (input.checked && "Notification" in window &&
+			Notification.permission === "default")
+			Notification.requestPermission();
+	};
+}
+
+// The nav is a frame, so the title and the icon of the tab are the ones of
+// the top document.
+function topDocument() {
+	try {
+		return window.top.document;
+	} catch (e) {
+		return document;
+	}
+}
+
+function updateTitleCount(count) {
+	var doc = topDocument();
+	var title = doc.title.replace(/^\s*\(\d+\)\s*/, "");
+	doc.title = count > 0 ? "(" + count + ") " + title : title;
+}
+
+var faviconHref = null;
+var faviconCount = 0;
+function updateFaviconBadge(count) {
+	faviconCount = count;
+	var doc = topDocument();
+	var link = doc.querySelector("link[rel='icon']");
+	if (!link)
+		return;
+	if (faviconHref === null)
+		faviconHref = link.href;
+	if (count < 1) {
+		link.href = faviconHref;
+		return;
+	}
+	var img = new Image();
+	img.onload = function() {
+		if (faviconCount < 1)
+			return;
+		var canvas = document.createElement("canvas");
+		canvas.width = canvas.height = 32;
+		var ctx = canvas.getContext("2d");
+		ctx.drawImage(img, 0, 0, 32, 32);
+		ctx.beginPath();
+		ctx.arc(24, 8, 8, 0, 2 * Math.PI);
+		ctx.fillStyle = "#e0245e";
+		ctx.fill();
+		link.href = canvas.toDataURL("image/png");
+	};
+	img.src = faviconHref;
+}
+
+function playSound(src) {
+	var audio = new Audio(src);
+	var p = audio.play();
+	// Browsers may block playing before the page is interacted with
+	if (p && typeof p.catch === "function")
+		p.catch(function() {});
+}
+
+function handleCSSSnippetSearch(input) {
+	var snippets = document.querySelectorAll(".css-snippet");
+	input.oninput = function() {
+		var q = input.value.toLowerCase();
+		for (var i = 0; i < snippets.length; i++) {
+			var label = snippets[i].querySelector("label");
+			var text = (label.textContent + " " + label.title).toLowerCase();
+			snippets[i].style.display = text.indexOf(q) < 0 ? "none" : "";
+		}
+	}
+}
+
+document.addEventListener("DOMContentLoaded", function() { 
+	checkBasePath();
+	checkCSRFToken();
+	checkAntiDopamineMode();
+	checkInfiniteScroll();
+
+	if ("serviceWorker" in navigator)
+		navigator.serviceWorker.register(basePath + "/sw.js");
+
+	handleStatuses(document);
+
+	var followForm = document.querySelector(".user-follow");
+	if (followForm)
+		handleFollowForm(followForm);
+
+	var muteForm = document.querySelector(".user-mute");
+	if (muteForm)
+		handleMuteForm(muteForm);
+
 	var links = document.querySelectorAll(".user-profile-decription a");
 	for (var j = 0; j < links.length; j++) {
 		links[j].target = "_blank";
 	}
 
-	var links = document.querySelectorAll(".status-media-container .img-link");
-	for (var j = 0; j < links.length; j++) {
-		handleImgPreview(links[j]);
+	if (infiniteScroll) {
+		var timeline = document.querySelector(".timeline-statuses");
+		var nextLink = document.querySelector(".pagination .next-link");
+		if (timeline && nextLink)
+			handleInfiniteScroll(timeline, nextLink);
+	}
+
+	var notificationCount = document.querySelector(".notification-count");
+	if (notificationCount) {
+		var sound = notificationCount.dataset.sound;
+		var badge = notificationCount.dataset.badge === "true";
+		var lastCount = -1;
+		pollNotificationCount(notificationCount.dataset.interval, function(count) {
+			notificationCount.innerHTML = count > 0 ? "(" + count + ")" : "";
+			updateTitleCount(count);
+			if (badge)
+				updateFaviconBadge(count);
+			if (sound && lastCount >= 0 && count > lastCount)
+				playSound(sound);
+			lastCount = count;
+		});
 	}
+
+	var notificationTitle = document.querySelector(".notification-title-container[data-interval]");
+	if (notificationTitle) {
+		var unread = notificationTitle.dataset.unread;
+		pollNotificationCount(notificationTitle.dataset.interval, function(count) {
+			if (String(count) !== unread)
+				location.reload();
+		});
+	}
+
+	var mentionAlerts = document.querySelector(".mention-alerts");
+	if (mentionAlerts)
+		pollMentions(mentionAlerts.dataset.interval);
+
+	var desktopNotifications = document.querySelector("#desktop-notifications");
+	if (desktopNotifications)
+		handleDesktopNotificationsSetting(desktopNotifications);
+
+	var snippetSearch = document.querySelector(".css-snippet-search");
+	if (snippetSearch)
+		handleCSSSnippetSearch(snippetSearch);
 });
 
 // @license-end
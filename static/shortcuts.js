@@ -0,0 +1,159 @@
+// @license magnet:?xt=urn:btih:90dc5c0be029de84e523b9b3922520e79e0e6f08&dn=cc0.txt CC0
+
+// Keyboard shortcuts for fluoride mode. Status shortcuts act on the selected
+// status, which is moved with j and k. Shortcuts are ignored while typing in
+// a form field.
+
+var shortcutHelp = [
+	["j", "Select the next post"],
+	["k", "Select the previous post"],
+	["f", "Like the selected post"],
+	["b", "Retweet the selected post"],
+	["r", "Reply to the selected post"],
+	["o", "Open the thread of the selected post"],
+	["n", "Write a new post"],
+	["g h", "Go to the home timeline"],
+	["g n", "Go to the notifications"],
+	["?", "Show this help"]
+];
+
+var selectedStatus = null;
+var pendingG = false;
+
+// Pages are shown in frames, links go to the main frame if there's one
+function mainWindow() {
+	if (window.top !== window && window.top.frames["main"])
+		return window.top.frames["main"];
+	return window;
+}
+
+function selectStatus(delta) {
+	var statuses = document.querySelectorAll(".status-container-container");
+	if (statuses.length < 1)
+		return;
+	var i = Array.prototype.indexOf.call(statuses, selectedStatus);
+	if (i < 0)
+		i = delta > 0 ? 0 : statuses.length - 1;
+	else
+		i = Math.min(Math.max(i + delta, 0), statuses.length - 1);
+	if (selectedStatus)
+		selectedStatus.classList.remove("shortcut-selected");
+	selectedStatus = statuses[i];
+	selectedStatus.classList.add("shortcut-selected");
+	selectedStatus.scrollIntoView({block: "nearest"});
+}
+
+function clickInSelected(selector) {
+	if (!selectedStatus)
+		return;
+	var el = selectedStatus.querySelector(selector);
+	if (el)
+		el.click();
+}
+
+function focusComposer() {
+	var nav = window.top.frames["nav"];
+	var doc = nav ? nav.document : document;
+	var textarea = doc.querySelector(".post-content");
+	if (textarea)
+		textarea.focus();
+}
+
+function toggleShortcutHelp() {
+	var help = document.querySelector(".shortcut-help");
+	if (help) {
+		help.parentElement.removeChild(help);
+		return;
+	}
+	help = document.createElement("div");
+	help.className = "shortcut-help";
+	var table = document.createElement("table");
+	for (var i = 0; i < shortcutHelp.length; i++) {
+		var tr = document.createElement("tr");
+		var key = document.createElement("td");
+		var keys = shortcutHelp[i][0].split(" ");
+		for (var j = 0; j < keys.length; j++) {
+			var kbd = document.createElement("kbd");
+			kbd.textContent = keys[j];
+			key.appendChild(kbd);
+			key.appendChild(document.createTextNode(" "));
+		}
+		var desc = document.createElement("td");
+		desc.textContent = shortcutHelp[i][1];
+		tr.appendChild(key);
+		tr.appendChild(desc);
+		table.appendChild(tr);
+	}
+	help.appendChild(table);
+	help.onclick = toggleShortcutHelp;
+	document.body.appendChild(help);
+}
+
+function isTyping(el) {
+	if (!el)
+		return false;
+	var tag = el.tagName;
+	return tag === "INPUT" || tag === "TEXTAREA" || tag === "SELECT" ||
+		el.isContentEditable;
+}
+
+document.addEventListener("keydown", function(event) {
+	if (event.ctrlKey || event.altKey || event.metaKey ||
+		isTyping(event.target))
+		return;
+
+	if (pendingG) {
+		pendingG = false;
+		switch (event.key) {
+		case "h":
+			mainWindow().location.href = basePath + "/timeline/home";
+			break;
+		case "n":
+			mainWindow().location.href = basePath + "/notifications";
+			break;
+		default:
+			return;
+		}
+		event.preventDefault();
+		return;
+	}
+
+	switch (event.key) {
+	case "j":
+		selectStatus(1);
+		break;
+	case "k":
+		selectStatus(-1);
+		break;
+	case "f":
+		clickInSelected(".status-like [type='submit']");
+		break;
+	case "b":
+		clickInSelected(".status-retweet [type='submit']");
+		break;
+	case "r":
+		clickInSelected(".status-reply");
+		break;
+	case "o":
+		clickInSelected(".status-reply-count");
+		break;
+	case "n":
+		focusComposer();
+		break;
+	case "g":
+		pendingG = true;
+		break;
+	case "?":
+		toggleShortcutHelp();
+		break;
+	case "Escape":
+		if (document.querySelector(".shortcut-help"))
+			toggleShortcutHelp();
+		break;
+	default:
+		return;
+	}
+	event.preventDefault();
+});
+
+// @license-end
@@ -0,0 +1,16 @@
+// @license magnet:?xt=urn:btih:90dc5c0be029de84e523b9b3922520e79e0e6f08&dn=cc0.txt CC0
+
+// The service worker only makes bloat installable. Requests aren't cached,
+// they go to the server as usual.
+
+self.addEventListener("install", function() {
+	self.skipWaiting();
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener("fetch", function() {});
+
+// @license-end
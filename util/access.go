@@ -0,0 +1,112 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusWriter records the status code and the size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// AccessLog writes an entry for every request, either in the combined log
+// format of Apache and nginx, or as JSON objects.
+type AccessLog struct {
+	m    sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+func NewAccessLog(w io.Writer, json bool) *AccessLog {
+	return &AccessLog{w: w, json: json}
+}
+
+type accessEntry struct {
+	Time      string `json:"time"`
+	Remote    string `json:"remote"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Proto     string `json:"proto"`
+	Status    int    `json:"status"`
+	Size      int64  `json:"size"`
+	Referer   string `json:"referer"`
+	UserAgent string `json:"user_agent"`
+	Took      int64  `json:"took_ms"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// quoteCombined escapes a value that is quoted in the combined format.
+func quoteCombined(v string) string {
+	if len(v) < 1 {
+		return "-"
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (a *AccessLog) write(e accessEntry, t time.Time) {
+	var line string
+	if a.json {
+		data, _ := json.Marshal(e)
+		line = string(data) + "\n"
+	} else {
+		size := "-"
+		if e.Size > 0 {
+			size = strconv.FormatInt(e.Size, 10)
+		}
+		line = fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+			e.Remote, t.Format("02/Jan/2006:15:04:05 -0700"),
+			quoteCombined(e.Method), quoteCombined(e.URI),
+			quoteCombined(e.Proto), e.Status, size,
+			quoteCombined(e.Referer), quoteCombined(e.UserAgent))
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	io.WriteString(a.w, line)
+}
+
+// Handler logs the requests served by next. remote returns the address of
+// the client of a request.
+func (a *AccessLog) Handler(next http.Handler,
+	remote func(r *http.Request) string) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		a.write(accessEntry{
+			Time:      start.Format(time.RFC3339),
+			Remote:    remote(r),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    sw.status,
+			Size:      sw.size,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Took:      time.Since(start).Milliseconds(),
+			RequestID: RequestID(r.Context()),
+		}, start)
+	})
+}
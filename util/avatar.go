@@ -0,0 +1,195 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// AvatarSizes are the sizes avatars are rendered at by the templates.
+var AvatarSizes = map[int]bool{24: true, 48: true, 64: true, 96: true}
+
+// Avatars larger than avatarMaxSize bytes or avatarMaxPixels pixels aren't
+// scaled.
+const (
+	avatarMaxSize   = 10 << 20
+	avatarMaxPixels = 4096 * 4096
+)
+
+// AvatarCache keeps downscaled copies of avatars in a directory. The copies
+// are twice the rendered size, to stay sharp on high density displays.
+type AvatarCache struct {
+	dir     string
+	fetcher *MediaProxy
+}
+
+func NewAvatarCache(dir string, fetcher *MediaProxy) (c *AvatarCache,
+	err error) {
+
+	err = os.Mkdir(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return
+	}
+	return &AvatarCache{
+		dir:     dir,
+		fetcher: fetcher,
+	}, nil
+}
+
+// AvatarPath returns the path of the avatar endpoint for the avatar at u,
+// scaled to size.
+func AvatarPath(u string, size int) string {
+	return "/avatar/" + strconv.Itoa(size) + "/" +
+		base64.RawURLEncoding.EncodeToString([]byte(u))
+}
+
+func (c *AvatarCache) file(u string, size int) string {
+	sum := sha256.Sum256([]byte(u))
+	return filepath.Join(c.dir,
+		hex.EncodeToString(sum[:])+"-"+strconv.Itoa(size))
+}
+
+// Serve writes the avatar at u scaled to size to w. It returns false without
+// writing anything if the avatar can't be decoded.
+func (c *AvatarCache) Serve(w http.ResponseWriter, r *http.Request,
+	u string, size int) (ok bool, err error) {
+
+	name := c.file(u, size)
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		data, err = c.scale(r.Context(), u, size)
+		if err != nil || len(data) < 1 {
+			return
+		}
+		err = writeFileAtomic(name, data)
+		if err != nil {
+			return
+		}
+	} else if err != nil {
+		return
+	}
+	// Older versions kept the avatars that can't be decoded as empty files
+	if len(data) < 1 {
+		return false, nil
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", http.DetectContentType(data))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	// Avatars get a new URL when they're changed
+	header.Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Write(data)
+	return true, nil
+}
+
+// scale returns the avatar at u scaled to size, encoded as JPEG or as PNG
+// if it has transparent parts, or nothing if it can't be decoded.
+func (c *AvatarCache) scale(ctx context.Context, u string,
+	size int) (data []byte, err error) {
+
+	src, err := c.fetcher.Fetch(ctx, u, avatarMaxSize)
+	if err != nil {
+		return
+	}
+	// A small file can declare a huge image, so the size is checked
+	// before decoding it
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil || cfg.Width < 1 || cfg.Height < 1 ||
+		int64(cfg.Width)*int64(cfg.Height) > avatarMaxPixels {
+		return nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, nil
+	}
+	thumb := thumbnail(img, size*2)
+	var b bytes.Buffer
+	if thumb.Opaque() {
+		err = jpeg.Encode(&b, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&b, thumb)
+	}
+	if err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
+
+// thumbnail crops the center square of img and scales it down to n×n pixels,
+// each of them being the average of the pixels it covers. Smaller images
+// aren't scaled up.
+func thumbnail(img image.Image, n int) *image.RGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	if side < n {
+		n = side
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	// The pixels are read from the RGBA pixel data, which is much faster
+	// than going through img.At. Other types of images are converted by
+	// draw, which is fast for the ones the decoders return.
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, side, side))
+		draw.Draw(src, src.Rect, img, image.Pt(x0, y0), draw.Src)
+		x0, y0 = 0, 0
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		sy0, sy1 := y0+y*side/n, y0+(y+1)*side/n
+		for x := 0; x < n; x++ {
+			sx0, sx1 := x0+x*side/n, x0+(x+1)*side/n
+			var sum [4]uint64
+			var count uint64
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					sum[0] += uint64(src.Pix[i])
+					sum[1] += uint64(src.Pix[i+1])
+					sum[2] += uint64(src.Pix[i+2])
+					sum[3] += uint64(src.Pix[i+3])
+					i += 4
+					count++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			for k := range sum {
+				dst.Pix[j+k] = uint8(sum[k] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// Clean removes the avatars cached before maxAge ago.
+func (c *AvatarCache) Clean(maxAge time.Duration) (err error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && time.Since(info.ModTime()) > maxAge {
+			os.Remove(filepath.Join(c.dir, info.Name()))
+		}
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup writes a gzipped tar archive of the databases to w. The values of
+// each database are stored under a directory named after the database.
+func Backup(w io.Writer, dbs ...Store) (err error) {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	for _, db := range dbs {
+		dir := db.Name()
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir + "/",
+			Mode:     0755,
+			ModTime:  now,
+		})
+		if err != nil {
+			return
+		}
+		var keys []string
+		keys, err = db.Keys()
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			var val []byte
+			val, err = db.Get(key)
+			if err == errNoSuchKey {
+				// Removed since it was listed
+				continue
+			}
+			if err != nil {
+				return
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     dir + "/" + key,
+				Mode:     0644,
+				Size:     int64(len(val)),
+				ModTime:  now,
+			})
+			if err != nil {
+				return
+			}
+			_, err = tw.Write(val)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	return gw.Close()
+}
+
+// BackupFile writes the backup of the databases to the file dest. The file
+// only appears once the backup is complete.
+func BackupFile(dest string, dbs ...Store) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(dest), ".tmp-backup-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	err = Backup(f, dbs...)
+	if err != nil {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), dest)
+}
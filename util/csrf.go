@@ -0,0 +1,52 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSRFTokenLifetime is how long the tokens returned by CSRFToken are valid
+// for. Tokens change every hour, so that a token that leaks, e.g. through
+// a saved page, stops working after a while without the session.
+const CSRFTokenLifetime = 7 * 24 * time.Hour
+
+func csrfMAC(secret string, hour int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(hour, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// CSRFToken returns the token of the forms at t, derived from the CSRF
+// secret of a session.
+func CSRFToken(secret string, t time.Time) string {
+	if len(secret) < 1 {
+		return ""
+	}
+	hour := t.Unix() / 3600
+	return strconv.FormatInt(hour, 36) + "." + csrfMAC(secret, hour)
+}
+
+// ValidCSRFToken reports whether token was returned by CSRFToken for secret
+// within CSRFTokenLifetime before now.
+func ValidCSRFToken(secret string, token string, now time.Time) bool {
+	if len(secret) < 1 {
+		return false
+	}
+	i := strings.IndexByte(token, '.')
+	if i < 1 {
+		return false
+	}
+	hour, err := strconv.ParseInt(token[:i], 36, 64)
+	if err != nil {
+		return false
+	}
+	current := now.Unix() / 3600
+	if hour > current || current-hour > int64(CSRFTokenLifetime/time.Hour) {
+		return false
+	}
+	return hmac.Equal([]byte(token[i+1:]), []byte(csrfMAC(secret, hour)))
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OverlayFS is a http.FileSystem which opens files from the first of its
+// file systems that has them, so earlier ones override later ones.
+type OverlayFS []http.FileSystem
+
+func (fs OverlayFS) Open(name string) (f http.File, err error) {
+	for _, d := range fs {
+		f, err = d.Open(name)
+		if err == nil || !os.IsNotExist(err) {
+			return
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Fingerprint returns short hashes of the contents of the files in files,
+// by their path relative to its root. The files are listed from dirs, which
+// are the file systems files serves from.
+func Fingerprint(files http.FileSystem, dirs ...fs.FS) (
+	hashes map[string]string, err error) {
+
+	hashes = make(map[string]string)
+	for _, dir := range dirs {
+		err = fs.WalkDir(dir, ".", func(p string, d fs.DirEntry,
+			err error) error {
+
+			if err != nil {
+				// The override directory needn't have static files
+				if p == "." && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			name := "/" + p
+			if _, ok := hashes[name]; ok {
+				return nil
+			}
+			f, err := files.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			if err != nil {
+				return err
+			}
+			hashes[name] = hex.EncodeToString(h.Sum(nil))[:12]
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Themes returns the names of the stylesheets in the themes directory of
+// dirs, which are the file systems of the static files. Names are used in
+// URLs as is, so the ones with other characters than letters, digits, '-' and
+// '_' are left out.
+func Themes(dirs ...fs.FS) (themes []string, err error) {
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		var files []string
+		files, err = fs.Glob(dir, "themes/*.css")
+		if err != nil {
+			return
+		}
+		for _, f := range files {
+			name := strings.TrimSuffix(path.Base(f), ".css")
+			if seen[name] || !isThemeName(name) {
+				continue
+			}
+			seen[name] = true
+			themes = append(themes, name)
+		}
+	}
+	sort.Strings(themes)
+	return
+}
+
+func isThemeName(name string) bool {
+	if len(name) < 1 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// StaticURL returns the URL of the static file name, with its fingerprint
+// in the query so that it changes along with the file.
+func StaticURL(hashes map[string]string, name string) string {
+	u := path.Join("/static", name)
+	if h, ok := hashes[path.Join("/", name)]; ok {
+		u += "?v=" + h
+	}
+	return u
+}
+
+// modTimeFS gives the files of a http.FileSystem without a modification
+// time, i.e. the embedded ones, the modification time t.
+type modTimeFS struct {
+	http.FileSystem
+	t time.Time
+}
+
+func (fs modTimeFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return modTimeFile{f, fs.t}, nil
+}
+
+type modTimeFile struct {
+	http.File
+	t time.Time
+}
+
+func (f modTimeFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil || !fi.ModTime().IsZero() {
+		return fi, err
+	}
+	return modTimeInfo{fi, f.t}, nil
+}
+
+type modTimeInfo struct {
+	os.FileInfo
+	t time.Time
+}
+
+func (fi modTimeInfo) ModTime() time.Time {
+	return fi.t
+}
+
+// buildTime returns the modification time of the executable, which the
+// embedded files are as old as at most, or the current time if it's
+// unknown.
+func buildTime() time.Time {
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return time.Now()
+}
+
+// StaticHandler serves the files in files. Requests for the current
+// fingerprint of a file are allowed to be cached forever, others have to be
+// revalidated. The fingerprint is used as ETag, and the embedded files are
+// given the time of the executable as Last-Modified, so that conditional
+// requests get a 304 response even without fingerprints.
+func StaticHandler(files http.FileSystem,
+	hashes map[string]string) http.Handler {
+	fileServer := http.FileServer(modTimeFS{files, buildTime()})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := hashes[path.Clean(r.URL.Path)]
+		if ok {
+			w.Header().Set("ETag", `"`+h+`"`)
+		}
+		v := r.URL.Query().Get("v")
+		if ok && v == h {
+			w.Header().Set("Cache-Control",
+				"public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,17 @@
+package util
+
+import "net/http"
+
+// HeaderHandler sets the headers in h on all the responses of next, unless
+// next sets them itself.
+func HeaderHandler(next http.Handler, h http.Header) http.Handler {
+	if len(h) < 1 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		next.ServeHTTP(w, r)
+	})
+}
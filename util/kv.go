@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -14,12 +15,61 @@ var (
 	errNoSuchKey  = errors.New("no such key")
 )
 
+// Store is a key value store. Database keeps the values in files,
+// RedisDatabase in a Redis server and SQLDatabase in a SQL database.
+type Store interface {
+	Name() string
+	Set(key string, val []byte) error
+	Get(key string) ([]byte, error)
+	Remove(key string)
+	Keys() ([]string, error)
+}
+
+// ExpiringStore is a Store that can remove values by itself once they
+// expire, so that values nobody asks for again don't stay around forever.
+type ExpiringStore interface {
+	Store
+	SetExpiring(key string, val []byte, exp time.Time) error
+}
+
 type Database struct {
 	cache   map[string][]byte
 	basedir string
 	m       sync.RWMutex
 }
 
+// Keys starting with a '.' are reserved for temporary files.
+func isValidKey(key string) bool {
+	return len(key) > 0 && key[0] != '.' &&
+		!strings.ContainsRune(key, os.PathSeparator)
+}
+
+func writeFileAtomic(name string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), name)
+}
+
 func NewDatabse(basedir string) (db *Database, err error) {
 	err = os.Mkdir(basedir, 0755)
 	if err != nil && !os.IsExist(err) {
@@ -32,12 +82,20 @@ func NewDatabse(basedir string) (db *Database, err error) {
 	}, nil
 }
 
+// Name returns the name of the base directory of the database.
+func (db *Database) Name() string {
+	return filepath.Base(db.basedir)
+}
+
 func (db *Database) Set(key string, val []byte) (err error) {
-	if len(key) < 1 || strings.ContainsRune(key, os.PathSeparator) {
+	if !isValidKey(key) {
 		return errInvalidKey
 	}
 
-	err = ioutil.WriteFile(filepath.Join(db.basedir, key), val, 0644)
+	// Values are written to a temporary file which is then renamed, so
+	// that backups taken while the server is running never see a partially
+	// written value.
+	err = writeFileAtomic(filepath.Join(db.basedir, key), val)
 	if err != nil {
 		return
 	}
@@ -50,7 +108,7 @@ func (db *Database) Set(key string, val []byte) (err error) {
 }
 
 func (db *Database) Get(key string) (val []byte, err error) {
-	if len(key) < 1 || strings.ContainsRune(key, os.PathSeparator) {
+	if !isValidKey(key) {
 		return nil, errInvalidKey
 	}
 
@@ -77,7 +135,7 @@ func (db *Database) Get(key string) (val []byte, err error) {
 }
 
 func (db *Database) Remove(key string) {
-	if len(key) < 1 || strings.ContainsRune(key, os.PathSeparator) {
+	if !isValidKey(key) {
 		return
 	}
 
@@ -89,3 +147,17 @@ func (db *Database) Remove(key string) {
 
 	return
 }
+
+// Keys returns all the keys stored in the database.
+func (db *Database) Keys() (keys []string, err error) {
+	infos, err := ioutil.ReadDir(db.basedir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && isValidKey(info.Name()) {
+			keys = append(keys, info.Name())
+		}
+	}
+	return
+}
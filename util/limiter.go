@@ -0,0 +1,86 @@
+package util
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket for each key. A bucket holds up to burst tokens
+// and is refilled with rate tokens per second, and every request takes one,
+// or less with AllowN.
+// A nil Limiter allows everything.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	m       sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter that allows perMinute requests per minute
+// for each key, and up to burst at once. It returns nil if perMinute is 0.
+func NewLimiter(perMinute int, burst int) *Limiter {
+	if perMinute < 1 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty, it
+// returns false and how long it takes until the next token.
+func (l *Limiter) Allow(key string) (ok bool, retry time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN is like Allow, but takes n tokens, which can be a fraction of one
+// for cheaper requests.
+func (l *Limiter) AllowN(key string, n float64) (ok bool,
+	retry time.Duration) {
+
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.m.Lock()
+	defer l.m.Unlock()
+	if len(l.buckets) > 1000 {
+		l.prune(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst,
+		b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < n {
+		wait := (n - b.tokens) / l.rate
+		return false, time.Duration(math.Ceil(wait)) * time.Second
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// prune removes the buckets that have filled up again, which are the same
+// as new ones.
+func (l *Limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the name, e.g. "warn".
+func ParseLevel(name string) (Level, bool) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), true
+		}
+	}
+	return 0, false
+}
+
+// Logger writes the entries of a level and above, one per line, either as
+// text of the form
+//
+//	2006/01/02 15:04:05 INFO message key=value key="quoted value"
+//
+// or as JSON objects with the time, level and msg fields followed by the
+// fields of the entry.
+type Logger struct {
+	m     sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+func NewLogger(w io.Writer, level Level, json bool) *Logger {
+	return &Logger{w: w, level: level, json: json}
+}
+
+// Enabled reports whether the entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Log writes an entry with msg and the fields given as pairs of keys and
+// values.
+func (l *Logger) Log(level Level, msg string, fields ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	if l.json {
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+	} else {
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteByte(' ')
+		b.WriteString(msg)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var val interface{} = "(missing)"
+		if i+1 < len(fields) {
+			val = fields[i+1]
+		}
+		if l.json {
+			b.WriteByte(',')
+			writeJSON(&b, key)
+			b.WriteByte(':')
+			switch val.(type) {
+			case bool, int, int64, float64:
+				writeJSON(&b, val)
+			default:
+				writeJSON(&b, logString(val))
+			}
+		} else {
+			b.WriteByte(' ')
+			b.WriteString(key)
+			b.WriteByte('=')
+			b.WriteString(quoteLogValue(logString(val)))
+		}
+	}
+	if l.json {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	l.m.Lock()
+	defer l.m.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+func writeJSON(b *strings.Builder, v interface{}) {
+	data, _ := json.Marshal(v)
+	b.Write(data)
+}
+
+func logString(v interface{}) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return fmt.Sprint(v)
+}
+
+// quoteLogValue quotes the values of the text format that would be
+// ambiguous otherwise.
+func quoteLogValue(v string) string {
+	if len(v) < 1 {
+		return `""`
+	}
+	for _, r := range v {
+		if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) ||
+			!unicode.IsPrint(r) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LevelDebug, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LevelInfo, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LevelWarn, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+}
+
+// logTransport logs the requests to the instances.
+type logTransport struct {
+	http.RoundTripper
+	l *Logger
+}
+
+func (t *logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		t.l.Debug("upstream request", "request_id",
+			RequestID(req.Context()), "method", req.Method,
+			"host", req.URL.Host, "path", req.URL.Path, "err", err,
+			"took", time.Since(start))
+	} else {
+		t.l.Debug("upstream request", "request_id",
+			RequestID(req.Context()), "method", req.Method,
+			"host", req.URL.Host, "path", req.URL.Path,
+			"status", resp.StatusCode, "took", time.Since(start))
+	}
+	return resp, err
+}
+
+// Transport returns rt with the requests to the instances logged at the
+// debug level.
+func (l *Logger) Transport(rt http.RoundTripper) http.RoundTripper {
+	if !l.Enabled(LevelDebug) {
+		return rt
+	}
+	return &logTransport{rt, l}
+}
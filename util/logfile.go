@@ -0,0 +1,121 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogFile is a log file that is rotated once it grows larger than MaxSize
+// or older than MaxAge, by renaming it with the time of the rotation as
+// suffix, e.g. "log.20060102-150405.000". Only the MaxFiles latest rotated
+// files are kept. Zero values disable the respective limits.
+type LogFile struct {
+	MaxSize  int64
+	MaxAge   time.Duration
+	MaxFiles int
+
+	m      sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenLogFile opens the log file at path for appending, creating it if it
+// doesn't exist.
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.size > 0 && (l.MaxSize > 0 && l.size+int64(len(p)) > l.MaxSize ||
+		l.MaxAge > 0 && time.Since(l.opened) > l.MaxAge) {
+		// The entries keep going to the current file if the rotation
+		// fails, rather than getting lost
+		l.rotate()
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *LogFile) rotate() error {
+	name := l.path + "." + time.Now().Format("20060102-150405.000")
+	err := os.Rename(l.path, name)
+	if err != nil {
+		return err
+	}
+	err = l.reopen()
+	if err != nil {
+		return err
+	}
+	if l.MaxFiles > 0 {
+		l.removeOld()
+	}
+	return nil
+}
+
+// removeOld removes the rotated files but the MaxFiles latest ones, whose
+// names sort by the time of the rotation.
+func (l *LogFile) removeOld() {
+	files, err := filepath.Glob(l.path + ".*-*")
+	if err != nil || len(files) <= l.MaxFiles {
+		return
+	}
+	sort.Strings(files)
+	for _, f := range files[:len(files)-l.MaxFiles] {
+		os.Remove(f)
+	}
+}
+
+// reopen opens the file at the path again, keeping the current one if that
+// fails.
+func (l *LogFile) reopen() error {
+	f := l.f
+	err := l.open()
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return nil
+}
+
+// Reopen opens the file at the path again, after it was moved away, e.g. by
+// logrotate.
+func (l *LogFile) Reopen() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.reopen()
+}
+
+func (l *LogFile) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.f.Close()
+}
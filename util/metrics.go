@@ -0,0 +1,323 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects counters and histograms, and serves them in the text
+// format of Prometheus. All the methods do nothing on a nil Metrics, so that
+// the metrics can be disabled by not creating one.
+type Metrics struct {
+	m       sync.Mutex
+	metrics []*metric
+	names   map[string]*metric
+}
+
+const (
+	counterMetric   = "counter"
+	histogramMetric = "histogram"
+	gaugeMetric     = "gauge"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+	// gauge is called on every scrape
+	gauge func() float64
+}
+
+type series struct {
+	labels string
+	value  float64
+	counts []uint64
+}
+
+// The upper bounds of the buckets of the histograms, in seconds
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+	5, 10}
+
+func NewMetrics() *Metrics {
+	return &Metrics{names: make(map[string]*metric)}
+}
+
+func (m *Metrics) register(mt *metric) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	if _, ok := m.names[mt.name]; ok {
+		panic("metric registered twice: " + mt.name)
+	}
+	mt.series = make(map[string]*series)
+	m.metrics = append(m.metrics, mt)
+	m.names[mt.name] = mt
+}
+
+// Counter registers a counter with the label names.
+func (m *Metrics) Counter(name string, help string, labels ...string) {
+	m.register(&metric{name: name, help: help, kind: counterMetric,
+		labels: labels})
+}
+
+// Histogram registers a histogram of durations with the label names.
+func (m *Metrics) Histogram(name string, help string, labels ...string) {
+	m.register(&metric{name: name, help: help, kind: histogramMetric,
+		labels: labels})
+}
+
+// Gauge registers a gauge whose value is returned by f when scraped.
+func (m *Metrics) Gauge(name string, help string, f func() float64) {
+	m.register(&metric{name: name, help: help, kind: gaugeMetric, gauge: f})
+}
+
+// get returns the series of the metric with the label values, which are
+// in the order of the label names of the metric.
+func (m *Metrics) get(name string, values []string) *series {
+	mt, ok := m.names[name]
+	if !ok || len(values) != len(mt.labels) {
+		panic("unknown metric or wrong labels: " + name)
+	}
+	var b strings.Builder
+	for i, l := range mt.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	labels := b.String()
+	s, ok := mt.series[labels]
+	if !ok {
+		s = &series{labels: labels}
+		if mt.kind == histogramMetric {
+			s.counts = make([]uint64, len(durationBuckets)+1)
+		}
+		mt.series[labels] = s
+	}
+	return s
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Add adds v to the counter with the label values.
+func (m *Metrics) Add(name string, v float64, values ...string) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.get(name, values).value += v
+}
+
+// Observe adds the duration d to the histogram with the label values.
+func (m *Metrics) Observe(name string, d time.Duration, values ...string) {
+	if m == nil {
+		return
+	}
+	secs := d.Seconds()
+	m.m.Lock()
+	defer m.m.Unlock()
+	s := m.get(name, values)
+	s.value += secs
+	i := sort.SearchFloat64s(durationBuckets, secs)
+	s.counts[i]++
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteTo writes the metrics in the text format of Prometheus.
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	var b strings.Builder
+	m.m.Lock()
+	metrics := append([]*metric(nil), m.metrics...)
+	for _, mt := range metrics {
+		if mt.kind == gaugeMetric {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help,
+			mt.name, mt.kind)
+		var keys []string
+		for k := range mt.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := mt.series[k]
+			if mt.kind == counterMetric {
+				fmt.Fprintf(&b, "%s{%s} %s\n", mt.name, s.labels,
+					formatFloat(s.value))
+				continue
+			}
+			sep := ""
+			if len(s.labels) > 0 {
+				sep = ","
+			}
+			var count uint64
+			for i, c := range s.counts {
+				count += c
+				le := "+Inf"
+				if i < len(durationBuckets) {
+					le = formatFloat(durationBuckets[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket{%s%sle=\"%s\"} %d\n", mt.name,
+					s.labels, sep, le, count)
+			}
+			fmt.Fprintf(&b, "%s_sum{%s} %s\n", mt.name, s.labels,
+				formatFloat(s.value))
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", mt.name, s.labels, count)
+		}
+	}
+	m.m.Unlock()
+	// Gauges may be slow, e.g. count the keys of a store, so they're
+	// called without the lock
+	for _, mt := range metrics {
+		if mt.kind != gaugeMetric {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", mt.name,
+			mt.help, mt.name, mt.kind, mt.name, formatFloat(mt.gauge()))
+	}
+	c, err := io.WriteString(w, b.String())
+	return int64(c), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// Middleware returns a middleware that counts the requests, and measures
+// how long they take, by the route returned by route and the status code.
+func (m *Metrics) Middleware(
+	route func(r *http.Request) string) func(http.Handler) http.Handler {
+	if m == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	m.Counter("bloat_http_requests_total",
+		"Requests served, by route and status code.", "route", "code")
+	m.Histogram("bloat_http_request_duration_seconds",
+		"Time taken to serve the requests, by route.", "route")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			rt := route(r)
+			m.Add("bloat_http_requests_total", 1, rt,
+				strconv.Itoa(sw.status))
+			m.Observe("bloat_http_request_duration_seconds",
+				time.Since(start), rt)
+		})
+	}
+}
+
+// metricsTransport measures the requests to the instances.
+type metricsTransport struct {
+	http.RoundTripper
+	m *Metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	result := "error"
+	if err == nil {
+		result = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+	t.m.Add("bloat_upstream_requests_total", 1, req.URL.Host, result)
+	t.m.Observe("bloat_upstream_request_duration_seconds", time.Since(start),
+		req.URL.Host)
+	return resp, err
+}
+
+// Transport returns rt with the requests measured by instance, and counted
+// by instance and either the class of the status code, e.g. "2xx", or
+// "error" if no response came.
+func (m *Metrics) Transport(rt http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return rt
+	}
+	m.Counter("bloat_upstream_requests_total",
+		"Requests to the instances, by instance and result.", "instance",
+		"result")
+	m.Histogram("bloat_upstream_request_duration_seconds",
+		"Time until the response headers of the instances, by instance.",
+		"instance")
+	return &metricsTransport{rt, m}
+}
+
+// metricsStore measures the operations of a store.
+type metricsStore struct {
+	Store
+	m *Metrics
+}
+
+func (s *metricsStore) observe(op string, start time.Time) {
+	s.m.Observe("bloat_store_operation_duration_seconds", time.Since(start),
+		s.Name(), op)
+}
+
+func (s *metricsStore) Set(key string, val []byte) error {
+	defer s.observe("set", time.Now())
+	return s.Store.Set(key, val)
+}
+
+// SetExpiring falls back to Set for stores that don't expire values, which
+// remove them once they're read after expiring instead.
+func (s *metricsStore) SetExpiring(key string, val []byte,
+	exp time.Time) error {
+	defer s.observe("set", time.Now())
+	if es, ok := s.Store.(ExpiringStore); ok {
+		return es.SetExpiring(key, val, exp)
+	}
+	return s.Store.Set(key, val)
+}
+
+func (s *metricsStore) Get(key string) ([]byte, error) {
+	defer s.observe("get", time.Now())
+	return s.Store.Get(key)
+}
+
+func (s *metricsStore) Remove(key string) {
+	defer s.observe("remove", time.Now())
+	s.Store.Remove(key)
+}
+
+func (s *metricsStore) Keys() ([]string, error) {
+	defer s.observe("keys", time.Now())
+	return s.Store.Keys()
+}
+
+// Store returns db with its operations measured.
+func (m *Metrics) Store(db Store) Store {
+	if m == nil {
+		return db
+	}
+	m.m.Lock()
+	_, ok := m.names["bloat_store_operation_duration_seconds"]
+	m.m.Unlock()
+	if !ok {
+		m.Histogram("bloat_store_operation_duration_seconds",
+			"Time taken by the operations of the stores, by store and operation.",
+			"store", "op")
+	}
+	return &metricsStore{db, m}
+}
@@ -0,0 +1,263 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	errProxyURL      = errors.New("invalid media url")
+	errProxyHost     = errors.New("media host not allowed")
+	errProxyAddress  = errors.New("media address not allowed")
+	errProxyTooLarge = errors.New("media too large")
+)
+
+// MediaProxy fetches remote media on behalf of the browser, so that the
+// browser only ever talks to bloat. Only hosts in the allowlist are fetched
+// from, or any host if the allowlist is empty, but never hosts on loopback
+// or private networks.
+type MediaProxy struct {
+	hosts   map[string]bool
+	maxSize int64
+	client  *http.Client
+	// UserAgent is sent to the media hosts, unless it's empty
+	UserAgent string
+}
+
+func NewMediaProxy(allowedHosts []string, maxSize int64) *MediaProxy {
+	hosts := make(map[string]bool)
+	for _, h := range allowedHosts {
+		hosts[strings.ToLower(h)] = true
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return errProxyAddress
+			}
+			return nil
+		},
+	}
+	p := &MediaProxy{
+		hosts:   hosts,
+		maxSize: maxSize,
+	}
+	p.client = &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 4,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			if !p.isAllowed(req.URL) {
+				return errProxyHost
+			}
+			return nil
+		},
+	}
+	return p
+}
+
+func (p *MediaProxy) isAllowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return len(p.hosts) < 1 || p.hosts[strings.ToLower(u.Hostname())]
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	private := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"100.64.0.0/10", "fc00::/7"}
+	for _, cidr := range private {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ProxyPath returns the path of the proxy endpoint for the media at u.
+func ProxyPath(u string) string {
+	return "/proxy/" + base64.RawURLEncoding.EncodeToString([]byte(u))
+}
+
+// EmojiPath returns the path of the emoji image endpoint for the image at u.
+func EmojiPath(u string) string {
+	return "/emoji/" + base64.RawURLEncoding.EncodeToString([]byte(u))
+}
+
+// ProxyURL returns the media URL encoded in the last element of a path
+// returned by ProxyPath, AvatarPath or EmojiPath.
+func ProxyURL(encoded string) (u string, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errProxyURL
+	}
+	return string(data), nil
+}
+
+// ImageType returns the content type of data, and whether it's an image that
+// can be served from bloat's own origin. SVG images are left out, as they can
+// have scripts.
+func ImageType(data []byte) (ct string, ok bool) {
+	ct = http.DetectContentType(data)
+	ok = strings.HasPrefix(ct, "image/") &&
+		!strings.HasPrefix(ct, "image/svg")
+	return
+}
+
+var proxyResponseHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"ETag",
+	"Last-Modified",
+}
+
+var proxyRequestHeaders = []string{
+	"Range",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// Serve fetches the media at u and writes it to w. Conditional and range
+// requests are passed on, so that browsers can revalidate their cached copy
+// and seek in audio and video.
+func (p *MediaProxy) Serve(w http.ResponseWriter, r *http.Request,
+	u string) (err error) {
+
+	pu, err := url.Parse(u)
+	if err != nil {
+		return errProxyURL
+	}
+	if !p.isAllowed(pu) {
+		return errProxyHost
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(r.Context())
+	if len(p.UserAgent) > 0 {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	for _, h := range proxyRequestHeaders {
+		if v := r.Header.Get(h); len(v) > 0 {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+	default:
+		return errors.New("media request failed: " + resp.Status)
+	}
+	if p.maxSize > 0 && resp.ContentLength > p.maxSize {
+		return errProxyTooLarge
+	}
+
+	header := w.Header()
+	header.Del("Content-Type")
+	for _, h := range proxyResponseHeaders {
+		if v := resp.Header.Get(h); len(v) > 0 {
+			header.Set(h, v)
+		}
+	}
+	// Remote media doesn't change, but the responses are only for the
+	// signed in user.
+	header.Set("Cache-Control", "private, max-age=604800")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.WriteHeader(resp.StatusCode)
+
+	body := io.Reader(resp.Body)
+	if p.maxSize > 0 {
+		body = io.LimitReader(resp.Body, p.maxSize)
+	}
+	// The response can't be turned into an error page anymore, and
+	// browsers often stop loading audio and video halfway anyway.
+	io.Copy(w, body)
+	return nil
+}
+
+// Open returns the body of the response for the media at u, and its size,
+// which is -1 if it's unknown.
+func (p *MediaProxy) Open(ctx context.Context, u string) (body io.ReadCloser,
+	size int64, err error) {
+
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, 0, errProxyURL
+	}
+	if !p.isAllowed(pu) {
+		return nil, 0, errProxyHost
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	if len(p.UserAgent) > 0 {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, errors.New("media request failed: " + resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Fetch returns the media at u, which must not be larger than limit bytes.
+func (p *MediaProxy) Fetch(ctx context.Context, u string,
+	limit int64) (data []byte, err error) {
+
+	body, size, err := p.Open(ctx, u)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if size > limit {
+		return nil, errProxyTooLarge
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > limit {
+		return nil, errProxyTooLarge
+	}
+	return
+}
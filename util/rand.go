@@ -29,3 +29,7 @@ func NewSessionID() (string, error) {
 func NewCSRFToken() (string, error) {
 	return NewRandID(24)
 }
+
+func NewFeedToken() (string, error) {
+	return NewRandID(32)
+}
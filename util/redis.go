@@ -0,0 +1,269 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRedisProtocol = errors.New("redis: protocol error")
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisDatabase is a Store keeping its values in a Redis server, so that
+// several bloat instances can share them. Keys are prefixed with
+// "bloat:NAME:" to keep the stores apart. Unlike Database, values are not
+// cached in memory since other instances may change them at any time.
+type RedisDatabase struct {
+	network  string
+	address  string
+	password string
+	name     string
+	prefix   string
+
+	m    sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisDatabase returns a store named name on the Redis server at address,
+// which is either "HOST:PORT" or "unix:PATH".
+func NewRedisDatabase(address, password, name string) (db *RedisDatabase,
+	err error) {
+
+	db = &RedisDatabase{
+		network:  "tcp",
+		address:  address,
+		password: password,
+		name:     name,
+		prefix:   "bloat:" + name + ":",
+	}
+	if strings.HasPrefix(address, "unix:") {
+		db.network = "unix"
+		db.address = address[len("unix:"):]
+	}
+
+	// Fail early if the server is unreachable
+	_, err = db.do("PING")
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *RedisDatabase) Name() string {
+	return db.name
+}
+
+func (db *RedisDatabase) dial() (err error) {
+	conn, err := net.DialTimeout(db.network, db.address, 10*time.Second)
+	if err != nil {
+		return
+	}
+	db.conn = conn
+	db.rd = bufio.NewReader(conn)
+	if len(db.password) > 0 {
+		_, err = db.roundTrip("AUTH", db.password)
+		if err != nil {
+			db.close()
+			return
+		}
+	}
+	return
+}
+
+// Close closes the connection to the server. It's reopened if the store is
+// used again.
+func (db *RedisDatabase) Close() error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	db.close()
+	return nil
+}
+
+func (db *RedisDatabase) close() {
+	if db.conn != nil {
+		db.conn.Close()
+		db.conn = nil
+	}
+}
+
+func (db *RedisDatabase) roundTrip(args ...string) (reply interface{},
+	err error) {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	db.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(db.conn, b.String())
+	if err != nil {
+		return
+	}
+	return readRedisReply(db.rd)
+}
+
+// do sends a command to the server and returns its reply. The connection is
+// re-established once if it was broken, e.g. by a restart of the server.
+func (db *RedisDatabase) do(args ...string) (reply interface{}, err error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	for retry := 0; retry < 2; retry++ {
+		if db.conn == nil {
+			err = db.dial()
+			if err != nil {
+				return
+			}
+		}
+		reply, err = db.roundTrip(args...)
+		if _, ok := err.(redisError); ok || err == nil {
+			return
+		}
+		db.close()
+	}
+	return
+}
+
+// readRedisReply reads a reply in the Redis serialization protocol. Bulk
+// strings are returned as []byte, with nil for the null bulk string, and
+// arrays as []interface{}.
+func readRedisReply(rd *bufio.Reader) (reply interface{}, err error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	val := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return val, nil
+	case '-':
+		return nil, redisError(val)
+	case ':':
+		return strconv.ParseInt(val, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(rd, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i], err = readRedisReply(rd)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return arr, nil
+	}
+	return nil, errRedisProtocol
+}
+
+func (db *RedisDatabase) Set(key string, val []byte) (err error) {
+	if !isValidKey(key) {
+		return errInvalidKey
+	}
+	_, err = db.do("SET", db.prefix+key, string(val))
+	return
+}
+
+// SetExpiring sets the value of key, which Redis removes at exp.
+func (db *RedisDatabase) SetExpiring(key string, val []byte,
+	exp time.Time) (err error) {
+	if !isValidKey(key) {
+		return errInvalidKey
+	}
+	ms := time.Until(exp).Milliseconds()
+	if ms < 1 {
+		db.Remove(key)
+		return
+	}
+	_, err = db.do("SET", db.prefix+key, string(val),
+		"PX", strconv.FormatInt(ms, 10))
+	return
+}
+
+func (db *RedisDatabase) Get(key string) (val []byte, err error) {
+	if !isValidKey(key) {
+		return nil, errInvalidKey
+	}
+	reply, err := db.do("GET", db.prefix+key)
+	if err != nil {
+		return
+	}
+	val, ok := reply.([]byte)
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	return
+}
+
+func (db *RedisDatabase) Remove(key string) {
+	if !isValidKey(key) {
+		return
+	}
+	db.do("DEL", db.prefix+key)
+}
+
+// Keys returns all the keys stored in the database. It uses SCAN rather
+// than KEYS to avoid blocking the server on large databases.
+func (db *RedisDatabase) Keys() (keys []string, err error) {
+	cursor := "0"
+	for {
+		var reply interface{}
+		reply, err = db.do("SCAN", cursor, "MATCH", db.prefix+"*",
+			"COUNT", "1000")
+		if err != nil {
+			return
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return nil, errRedisProtocol
+		}
+		next, ok1 := arr[0].([]byte)
+		items, ok2 := arr[1].([]interface{})
+		if !ok1 || !ok2 {
+			return nil, errRedisProtocol
+		}
+		for _, item := range items {
+			if k, ok := item.([]byte); ok {
+				keys = append(keys, string(k[len(db.prefix):]))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return
+		}
+	}
+}
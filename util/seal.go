@@ -0,0 +1,81 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errSealed = errors.New("invalid sealed data")
+
+// Sealer encrypts and authenticates data that is handed to the browser, so
+// that it can be neither read nor changed there.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer returns a Sealer with a key derived from secret.
+func NewSealer(secret string) (*Sealer, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal compresses and encrypts data into a string that is safe to use as a
+// cookie value.
+func (s *Sealer) Seal(data []byte) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, buf.Bytes(), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the data sealed into v, or an error if v wasn't sealed with
+// the same secret or was changed since.
+func (s *Sealer) Open(v string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errSealed
+	}
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errSealed
+	}
+	data, err := s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errSealed
+	}
+	// Sealed data is small, so anything larger isn't from Seal
+	r := io.LimitReader(flate.NewReader(bytes.NewReader(data)), 1<<20)
+	return ioutil.ReadAll(r)
+}
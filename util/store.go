@@ -0,0 +1,122 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend holds the stores of a storage backend, e.g. the session and the
+// app stores. Backends that hold connections implement io.Closer too, and
+// are closed once bloat stops using the stores.
+type Backend interface {
+	Store(name string) (Store, error)
+}
+
+// Driver opens a backend. The format of source is up to the driver, e.g.
+// the address of a server.
+type Driver func(source string) (Backend, error)
+
+var (
+	driversMu sync.Mutex
+	drivers   = make(map[string]Driver)
+)
+
+// RegisterDriver makes a storage backend available under name. Backends
+// outside of bloat register themselves in the init function of their
+// package, which is then imported for its side effects in main.go.
+func RegisterDriver(name string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if _, ok := drivers[name]; ok {
+		panic("store driver registered twice: " + name)
+	}
+	drivers[name] = d
+}
+
+// Drivers returns the names of the registered drivers, sorted.
+func Drivers() (names []string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// OpenBackend opens the backend of the driver registered as name.
+func OpenBackend(name string, source string) (Backend, error) {
+	driversMu.Lock()
+	d, ok := drivers[name]
+	driversMu.Unlock()
+	if !ok {
+		return nil, errors.New("unknown store driver " + name +
+			", the drivers are " + strings.Join(Drivers(), ", "))
+	}
+	return d(source)
+}
+
+// fileBackend keeps each store in a directory under dir.
+type fileBackend string
+
+func (dir fileBackend) Store(name string) (Store, error) {
+	return NewDatabse(filepath.Join(string(dir), name))
+}
+
+// redisBackend keeps the stores in a Redis server.
+type redisBackend struct {
+	address  string
+	password string
+	stores   []*RedisDatabase
+}
+
+func (b *redisBackend) Store(name string) (Store, error) {
+	db, err := NewRedisDatabase(b.address, b.password, name)
+	if err != nil {
+		return nil, err
+	}
+	b.stores = append(b.stores, db)
+	return db, nil
+}
+
+func (b *redisBackend) Close() error {
+	for _, db := range b.stores {
+		db.Close()
+	}
+	return nil
+}
+
+func init() {
+	RegisterDriver("file", func(source string) (Backend, error) {
+		err := os.Mkdir(source, 0755)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		return fileBackend(source), nil
+	})
+	// The source is "ADDRESS [password=PASSWORD]"
+	RegisterDriver("redis", func(source string) (Backend, error) {
+		b := new(redisBackend)
+		for i, f := range strings.Fields(source) {
+			switch {
+			case i == 0:
+				b.address = f
+			case strings.HasPrefix(f, "password="):
+				b.password = strings.TrimPrefix(f, "password=")
+			default:
+				return nil, errors.New("invalid redis source: " + f)
+			}
+		}
+		return b, nil
+	})
+	RegisterDriver("sqlite", func(source string) (Backend, error) {
+		return OpenSQLite(source)
+	})
+	RegisterDriver("postgres", func(source string) (Backend, error) {
+		return OpenPostgres(source)
+	})
+}